@@ -0,0 +1,170 @@
+// Command balancecheck recomputes balances from every transaction and
+// payment and reports where the running balances the database keeps have
+// drifted from them. It exits with status 1 if anything has drifted.
+//
+// Usage:
+//
+//	balancecheck [-tolerance 0.01] [-fix]
+//
+// With -fix, drifted balances are rebuilt from scratch afterwards.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ishushreyas/expense-tracker/db"
+	"github.com/ishushreyas/expense-tracker/ledger"
+	"github.com/jackc/pgx/v5"
+)
+
+// replay nets every record the running balances are meant to cover, once
+// for expenses alone and once together with settlements.
+func replay(ctx context.Context, tx pgx.Tx) (expenses, all *ledger.Ledger, err error) {
+	expenses, all = ledger.New(), ledger.New()
+
+	rows, err := tx.Query(ctx, `
+		SELECT id, payer_id, amount::float8, members
+		FROM transactions
+		WHERE is_deleted = false AND status <> 'rejected'
+	`)
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		var e ledger.Expense
+		if err := rows.Scan(&e.ID, &e.PayerID, &e.Amount, &e.Members); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		expenses.AddExpense(e)
+		all.AddExpense(e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	rows, err = tx.Query(ctx, `
+		SELECT id, payer_id, reciever_id, amount::float8
+		FROM payments
+		WHERE is_deleted = false AND status = 'confirmed'
+	`)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s ledger.Settlement
+		if err := rows.Scan(&s.ID, &s.FromID, &s.ToID, &s.Amount); err != nil {
+			return nil, nil, err
+		}
+		all.AddSettlement(s)
+	}
+	return expenses, all, rows.Err()
+}
+
+// drift lists every member and pair whose stored balance is off by more
+// than tolerance.
+func drift(snapshot *db.BalanceSnapshot, expenses, all *ledger.Ledger, tolerance float64) []string {
+	var problems []string
+	off := func(got, want float64) bool {
+		return math.Abs(got-want) > tolerance
+	}
+
+	storedExpenses := ledger.FromSnapshot(snapshot.Expenses, nil)
+	stored := snapshot.Ledger()
+
+	members := map[uuid.UUID]bool{}
+	for _, l := range []*ledger.Ledger{stored, all} {
+		for _, userID := range l.Members() {
+			members[userID] = true
+		}
+	}
+	for userID := range members {
+		if got, want := storedExpenses.Balance(userID), expenses.Balance(userID); off(got, want) {
+			problems = append(problems, fmt.Sprintf("member %s: expense balance %.2f, recomputed %.2f", userID, got, want))
+		}
+		if got, want := stored.Balance(userID), all.Balance(userID); off(got, want) {
+			problems = append(problems, fmt.Sprintf("member %s: balance %.2f, recomputed %.2f", userID, got, want))
+		}
+	}
+
+	type pair struct{ debtor, creditor uuid.UUID }
+	pairs := map[pair]bool{}
+	for _, l := range []*ledger.Ledger{stored, all} {
+		for _, p := range l.Pairs() {
+			pairs[pair{p.DebtorID, p.CreditorID}] = true
+		}
+	}
+	for p := range pairs {
+		if got, want := stored.Owes(p.debtor, p.creditor), all.Owes(p.debtor, p.creditor); off(got, want) {
+			problems = append(problems, fmt.Sprintf("pair %s owes %s: %.2f, recomputed %.2f", p.debtor, p.creditor, got, want))
+		}
+	}
+	return problems
+}
+
+func main() {
+	os.Exit(run())
+}
+
+// run checks the balances and returns the exit status, so the deferred
+// cleanup happens before the process exits.
+func run() int {
+	tolerance := flag.Float64("tolerance", 0.01, "largest difference not reported as drift")
+	fix := flag.Bool("fix", false, "rebuild the running balances if they have drifted")
+	flag.Parse()
+
+	if _, err := db.InitDatabase(); err != nil {
+		log.Printf("Failed to connect to database: %v", err)
+		return 1
+	}
+	defer db.CloseDatabase()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	// Read the records and the running balances as of the same moment
+	var problems []string
+	err := pgx.BeginTxFunc(ctx, db.Pool, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly}, func(tx pgx.Tx) error {
+		expenses, all, err := replay(ctx, tx)
+		if err != nil {
+			return err
+		}
+		snapshot, err := db.LoadBalancesTx(ctx, tx)
+		if err != nil {
+			return err
+		}
+		problems = drift(snapshot, expenses, all, *tolerance)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to check balances: %v", err)
+		return 1
+	}
+
+	if len(problems) == 0 {
+		fmt.Println("Balances are consistent")
+		return 0
+	}
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	fmt.Printf("%d balances drifted\n", len(problems))
+
+	if *fix {
+		if err := db.RebuildBalances(ctx); err != nil {
+			log.Printf("Failed to rebuild balances: %v", err)
+			return 1
+		}
+		fmt.Println("Rebuilt balances from scratch")
+	}
+	return 1
+}
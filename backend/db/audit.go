@@ -0,0 +1,59 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// AuditEntry is one recorded change to an audited row. Before is empty for
+// creations and After for deletions.
+type AuditEntry struct {
+	ID         int64           `json:"id" db:"id"`
+	EntityType string          `json:"entity_type" db:"entity_type"`
+	EntityID   string          `json:"entity_id" db:"entity_id"`
+	Action     string          `json:"action" db:"action"`
+	ActorID    *uuid.UUID      `json:"actor_id" db:"actor_id"`
+	ChangedAt  time.Time       `json:"changed_at" db:"changed_at"`
+	Before     json.RawMessage `json:"before" db:"before"`
+	After      json.RawMessage `json:"after" db:"after"`
+}
+
+// SetActor attributes the changes tx makes to actorID in the audit log.
+// uuid.Nil leaves them unattributed.
+func SetActor(ctx context.Context, tx pgx.Tx, actorID uuid.UUID) error {
+	if actorID == uuid.Nil {
+		return nil
+	}
+	_, err := tx.Exec(ctx, "SELECT set_config('app.actor_id', $1, true)", actorID.String())
+	return err
+}
+
+// WithActor runs fn in a transaction on pool whose changes are attributed
+// to actorID, committing if fn succeeds.
+func WithActor(ctx context.Context, pool *pgxpool.Pool, actorID uuid.UUID, fn func(pgx.Tx) error) error {
+	return pgx.BeginFunc(ctx, pool, func(tx pgx.Tx) error {
+		if err := SetActor(ctx, tx, actorID); err != nil {
+			return err
+		}
+		return fn(tx)
+	})
+}
+
+// EntityHistory returns the audit log of one row, oldest change first.
+func EntityHistory(ctx context.Context, entityType, entityID string) ([]AuditEntry, error) {
+	rows, err := Pool.Query(ctx, `
+		SELECT id, entity_type, entity_id, action, actor_id, changed_at, before, after
+		FROM audit_log
+		WHERE entity_type = $1 AND entity_id = $2
+		ORDER BY id
+	`, entityType, entityID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[AuditEntry])
+}
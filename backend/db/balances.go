@@ -0,0 +1,113 @@
+package db
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+	"github.com/ishushreyas/expense-tracker/ledger"
+	"github.com/jackc/pgx/v5"
+)
+
+// Triggers keep member_balances and pair_balances (see schema.go) in step
+// with every write to transactions and payments, in the same database
+// transaction as the write. They only ever describe the present, across
+// all time; filtered or historical balances still come from the records.
+
+// BalanceSnapshot is the running balances as the database holds them,
+// unrounded.
+type BalanceSnapshot struct {
+	// Expenses is each member's net from shared expenses alone
+	Expenses map[uuid.UUID]float64
+	// Settlements is each member's net from confirmed payments alone
+	Settlements map[uuid.UUID]float64
+	// Pairs is what each debtor owes each creditor, expenses and
+	// settlements together. Amounts may be negative.
+	Pairs []ledger.PairBalance
+}
+
+// Net returns each member's overall balance.
+func (s *BalanceSnapshot) Net() map[uuid.UUID]float64 {
+	net := make(map[uuid.UUID]float64, len(s.Expenses))
+	for userID, amount := range s.Expenses {
+		net[userID] += amount
+	}
+	for userID, amount := range s.Settlements {
+		net[userID] += amount
+	}
+	return net
+}
+
+// Ledger returns the snapshot as a ledger of expenses and settlements.
+func (s *BalanceSnapshot) Ledger() *ledger.Ledger {
+	return ledger.FromSnapshot(s.Net(), s.Pairs)
+}
+
+// LoadBalances reads the running balances in one consistent snapshot.
+func LoadBalances(ctx context.Context) (*BalanceSnapshot, error) {
+	var snapshot *BalanceSnapshot
+	err := pgx.BeginTxFunc(ctx, Pool, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly}, func(tx pgx.Tx) error {
+		var err error
+		snapshot, err = LoadBalancesTx(ctx, tx)
+		return err
+	})
+	return snapshot, err
+}
+
+// LoadBalancesTx reads the running balances as tx sees them. Use a
+// repeatable read transaction to compare them with the records.
+func LoadBalancesTx(ctx context.Context, tx pgx.Tx) (*BalanceSnapshot, error) {
+	snapshot := &BalanceSnapshot{
+		Expenses:    make(map[uuid.UUID]float64),
+		Settlements: make(map[uuid.UUID]float64),
+	}
+
+	rows, err := tx.Query(ctx, `SELECT user_id, expense_net::float8, settlement_net::float8 FROM member_balances`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var (
+			userID                uuid.UUID
+			expenses, settlements float64
+		)
+		if err := rows.Scan(&userID, &expenses, &settlements); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		snapshot.Expenses[userID] = expenses
+		snapshot.Settlements[userID] = settlements
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = tx.Query(ctx, `SELECT user_a, user_b, amount::float8 FROM pair_balances`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var pair ledger.PairBalance
+		if err := rows.Scan(&pair.DebtorID, &pair.CreditorID, &pair.Amount); err != nil {
+			return nil, err
+		}
+		snapshot.Pairs = append(snapshot.Pairs, pair)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// RebuildBalances recomputes the running balances from scratch, holding
+// off writers to transactions and payments until it is done.
+func RebuildBalances(ctx context.Context) error {
+	return pgx.BeginFunc(ctx, Pool, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `LOCK TABLE transactions, payments IN SHARE ROW EXCLUSIVE MODE`); err != nil {
+			return err
+		}
+		_, err := tx.Exec(ctx, `SELECT rebuild_balances()`)
+		return err
+	})
+}
@@ -45,6 +45,10 @@ func InitDatabase() (*pgxpool.Pool, error) {
 	}
 
 	log.Println("Successfully connected to database")
+
+	if err := Migrate(context.Background()); err != nil {
+		return nil, err
+	}
 	return Pool, nil
 }
 
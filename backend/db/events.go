@@ -0,0 +1,62 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// Event is a persisted realtime event. Audience lists the users allowed to
+// see it; an empty audience means everyone.
+type Event struct {
+	ID        int64           `json:"id" db:"id"`
+	Topic     string          `json:"topic" db:"topic"`
+	Type      string          `json:"type" db:"type"`
+	Payload   json.RawMessage `json:"payload" db:"payload"`
+	Audience  []uuid.UUID     `json:"-" db:"audience"`
+	CreatedAt time.Time       `json:"created_at" db:"created_at"`
+}
+
+// AppendEvent stores event in the log, filling in its ID and CreatedAt.
+func AppendEvent(ctx context.Context, event *Event) error {
+	if event.Audience == nil {
+		event.Audience = []uuid.UUID{}
+	}
+	return Pool.QueryRow(ctx, `
+		INSERT INTO events (topic, type, payload, audience)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at
+	`, event.Topic, event.Type, event.Payload, event.Audience).Scan(&event.ID, &event.CreatedAt)
+}
+
+// EventsSince returns up to limit events after afterID on the given topics
+// that userID is allowed to see, oldest first.
+func EventsSince(ctx context.Context, afterID int64, userID uuid.UUID, topics []string, limit int) ([]Event, error) {
+	rows, err := Pool.Query(ctx, `
+		SELECT id, topic, type, payload, audience, created_at
+		FROM events
+		WHERE id > $1
+		AND topic = ANY($2)
+		AND (cardinality(audience) = 0 OR $3 = ANY(audience))
+		ORDER BY id
+		LIMIT $4
+	`, afterID, topics, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Event])
+}
+
+// PruneEvents deletes events logged before cutoff, returning how many went.
+func PruneEvents(ctx context.Context, cutoff time.Time) (int64, error) {
+	tag, err := Pool.Exec(ctx, "DELETE FROM events WHERE created_at < $1", cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
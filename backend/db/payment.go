@@ -5,20 +5,55 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+// Transaction statuses. A transaction starts pending and becomes confirmed
+// once every member other than the payer confirms it; any dispute marks it
+// disputed, and the payer can reject it outright.
+const (
+	TransactionPending   = "pending"
+	TransactionConfirmed = "confirmed"
+	TransactionDisputed  = "disputed"
+	TransactionRejected  = "rejected"
+)
+
 type Transaction struct {
 	ID         uuid.UUID   `json:"id" db:"id"`
 	PayerID    uuid.UUID   `json:"payer_id" db:"payer_id"`
 	Amount     float64     `json:"amount" db:"amount"`
 	Members    []uuid.UUID `json:"members" db:"members"`
 	Remark     string      `json:"remark" db:"remark"`
+	Status     string      `json:"status" db:"status"`
 	CreatedAt  time.Time   `json:"created_at" db:"created_at"`
+	OccurredOn time.Time   `json:"occurred_on" db:"occurred_on"`
 	IsDeleted  bool        `json:"is_deleted" db:"is_deleted"`
 	DeletedAt  *time.Time  `json:"deleted_at,omitempty" db:"deleted_at"`
 }
 
+// DeriveTransactionStatus computes a transaction's status from the responses
+// of its members, keyed by user. The payer's own share needs no confirmation.
+func DeriveTransactionStatus(payerID uuid.UUID, members []uuid.UUID, responses map[uuid.UUID]string) string {
+	confirmed := true
+	for _, member := range members {
+		if member == payerID {
+			continue
+		}
+		switch responses[member] {
+		case TransactionDisputed:
+			return TransactionDisputed
+		case TransactionConfirmed:
+		default:
+			confirmed = false
+		}
+	}
+	if confirmed {
+		return TransactionConfirmed
+	}
+	return TransactionPending
+}
+
 type TransactionRepository struct {
 	db *pgxpool.Pool
 }
@@ -27,21 +62,112 @@ func NewTransactionRepository(db *pgxpool.Pool) *TransactionRepository {
 	return &TransactionRepository{db: db}
 }
 
-func (r *TransactionRepository) CreateTransaction(txn *Transaction) error {
+// CreateTransaction stores txn on behalf of actorID. A zero OccurredOn
+// means today.
+func (r *TransactionRepository) CreateTransaction(actorID uuid.UUID, txn *Transaction) error {
 	query := `
 		INSERT INTO transactions 
-		(id, payer_id, amount, members, remark, created_at) 
-		VALUES ($1, $2, $3, $4, $5, $6)
+		(id, payer_id, amount, members, remark, status, created_at, occurred_on) 
+		VALUES ($1, $2, $3, $4, $5, $6, $7, COALESCE($8, CURRENT_DATE))
+		RETURNING occurred_on
+	`
+	if txn.Status == "" {
+		txn.Status = DeriveTransactionStatus(txn.PayerID, txn.Members, nil)
+	}
+	return WithActor(context.Background(), r.db, actorID, func(tx pgx.Tx) error {
+		return tx.QueryRow(
+			context.Background(),
+			query,
+			txn.ID,
+			txn.PayerID,
+			txn.Amount,
+			txn.Members,
+			txn.Remark,
+			txn.Status,
+			txn.CreatedAt,
+			nullableDate(txn.OccurredOn),
+		).Scan(&txn.OccurredOn)
+	})
+}
+
+// nullableDate stores the zero time as NULL.
+func nullableDate(date time.Time) *time.Time {
+	if date.IsZero() {
+		return nil
+	}
+	return &date
+}
+
+// Payment statuses. A payment is pending until its reciever confirms the
+// money arrived; only confirmed payments settle balances.
+const (
+	PaymentPending   = "pending"
+	PaymentConfirmed = "confirmed"
+	PaymentRejected  = "rejected"
+)
+
+type Payment struct {
+	ID          uuid.UUID  `json:"id" db:"id"`
+	PayerID     uuid.UUID  `json:"payer_id" db:"payer_id"`
+	Amount      float64    `json:"amount" db:"amount"`
+	RecieverID  uuid.UUID  `json:"reciever_id" db:"reciever_id"`
+	Remark      string     `json:"remark" db:"remark"`
+	Status      string     `json:"status" db:"status"`
+	ConfirmedAt *time.Time `json:"confirmed_at,omitempty" db:"confirmed_at"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+	OccurredOn  time.Time  `json:"occurred_on" db:"occurred_on"`
+	IsDeleted   bool       `json:"is_deleted" db:"is_deleted"`
+	DeletedAt   *time.Time `json:"deleted_at,omitempty" db:"deleted_at"`
+}
+
+// CreatePayment stores payment on behalf of actorID. A zero OccurredOn
+// means today.
+func (r *TransactionRepository) CreatePayment(actorID uuid.UUID, payment *Payment) error {
+	query := `
+		INSERT INTO payments
+		(id, payer_id, amount, reciever_id, remark, status, created_at, occurred_on)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, COALESCE($8, CURRENT_DATE))
+		RETURNING occurred_on
 	`
-	_, err := r.db.Exec(
-		context.Background(),
-		query,
-		txn.ID,
-		txn.PayerID,
-		txn.Amount,
-		txn.Members,
-		txn.Remark,
-		txn.CreatedAt,
-	)
-	return err
+	if payment.Status == "" {
+		payment.Status = PaymentPending
+	}
+	return WithActor(context.Background(), r.db, actorID, func(tx pgx.Tx) error {
+		return tx.QueryRow(
+			context.Background(),
+			query,
+			payment.ID,
+			payment.PayerID,
+			payment.Amount,
+			payment.RecieverID,
+			payment.Remark,
+			payment.Status,
+			payment.CreatedAt,
+			nullableDate(payment.OccurredOn),
+		).Scan(&payment.OccurredOn)
+	})
+}
+
+// Payment request statuses. An open request is outstanding until the payee
+// accepts it (turning it into a payment) or declines it, or the requester
+// cancels it.
+const (
+	RequestOpen      = "open"
+	RequestAccepted  = "accepted"
+	RequestDeclined  = "declined"
+	RequestCancelled = "cancelled"
+)
+
+// PaymentRequest asks PayeeID to pay RequesterID an amount.
+type PaymentRequest struct {
+	ID          uuid.UUID  `json:"id" db:"id"`
+	RequesterID uuid.UUID  `json:"requester_id" db:"requester_id"`
+	PayeeID     uuid.UUID  `json:"payee_id" db:"payee_id"`
+	Amount      float64    `json:"amount" db:"amount"`
+	Note        string     `json:"note" db:"note"`
+	DueDate     *time.Time `json:"due_date,omitempty" db:"due_date"`
+	Status      string     `json:"status" db:"status"`
+	PaymentID   *uuid.UUID `json:"payment_id,omitempty" db:"payment_id"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+	RespondedAt *time.Time `json:"responded_at,omitempty" db:"responded_at"`
 }
@@ -0,0 +1,549 @@
+package db
+
+import (
+	"context"
+	"fmt"
+)
+
+// migrations are applied in order on every startup, so each statement must be
+// safe to run repeatedly against an already migrated database.
+var migrations = []string{
+	`CREATE TABLE IF NOT EXISTS events (
+		id BIGSERIAL PRIMARY KEY,
+		topic TEXT NOT NULL,
+		type TEXT NOT NULL,
+		payload JSONB NOT NULL,
+		audience UUID[] NOT NULL DEFAULT '{}',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS events_topic_id_idx ON events (topic, id)`,
+
+	// Transaction status lifecycle. Transactions recorded before this
+	// existed are taken as confirmed, like payments below; new ones start
+	// pending.
+	`ALTER TABLE transactions ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'confirmed'`,
+	`ALTER TABLE transactions ALTER COLUMN status SET DEFAULT 'pending'`,
+	`CREATE TABLE IF NOT EXISTS transaction_confirmations (
+		transaction_id UUID NOT NULL REFERENCES transactions(id) ON DELETE CASCADE,
+		user_id UUID NOT NULL,
+		status TEXT NOT NULL,
+		note TEXT NOT NULL DEFAULT '',
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (transaction_id, user_id)
+	)`,
+
+	// Payment confirmation by the reciever. Payments recorded before this
+	// existed are taken as confirmed; new ones start pending.
+	`ALTER TABLE payments ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'confirmed'`,
+	`ALTER TABLE payments ALTER COLUMN status SET DEFAULT 'pending'`,
+	`ALTER TABLE payments ADD COLUMN IF NOT EXISTS confirmed_at TIMESTAMPTZ`,
+	`ALTER TABLE payments ADD COLUMN IF NOT EXISTS reminded_at TIMESTAMPTZ`,
+
+	// Money requests
+	`CREATE TABLE IF NOT EXISTS payment_requests (
+		id UUID PRIMARY KEY,
+		requester_id UUID NOT NULL,
+		payee_id UUID NOT NULL,
+		amount NUMERIC NOT NULL CHECK (amount > 0),
+		note TEXT NOT NULL DEFAULT '',
+		due_date DATE,
+		status TEXT NOT NULL DEFAULT 'open',
+		payment_id UUID,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		responded_at TIMESTAMPTZ
+	)`,
+	`CREATE INDEX IF NOT EXISTS payment_requests_payee_idx ON payment_requests (payee_id, status)`,
+	`CREATE INDEX IF NOT EXISTS payment_requests_requester_idx ON payment_requests (requester_id, status)`,
+
+	// Prior versions of edited and deleted rows, kept for as-of queries.
+	// Each version was the live row from valid_from until valid_to.
+	`ALTER TABLE transactions ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ`,
+	`ALTER TABLE payments ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ`,
+	`CREATE TABLE IF NOT EXISTS transaction_versions (
+		version_id BIGSERIAL PRIMARY KEY,
+		id UUID NOT NULL,
+		payer_id UUID NOT NULL,
+		amount DOUBLE PRECISION NOT NULL,
+		members UUID[] NOT NULL,
+		remark TEXT,
+		status TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL,
+		is_deleted BOOLEAN NOT NULL,
+		deleted_at TIMESTAMPTZ,
+		valid_from TIMESTAMPTZ NOT NULL,
+		valid_to TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS transaction_versions_validity_idx ON transaction_versions (valid_from, valid_to)`,
+	`CREATE INDEX IF NOT EXISTS transaction_versions_id_idx ON transaction_versions (id)`,
+	`CREATE TABLE IF NOT EXISTS payment_versions (
+		version_id BIGSERIAL PRIMARY KEY,
+		id UUID NOT NULL,
+		payer_id UUID NOT NULL,
+		amount DOUBLE PRECISION NOT NULL,
+		reciever_id UUID NOT NULL,
+		remark TEXT,
+		status TEXT NOT NULL,
+		confirmed_at TIMESTAMPTZ,
+		created_at TIMESTAMPTZ NOT NULL,
+		is_deleted BOOLEAN NOT NULL,
+		deleted_at TIMESTAMPTZ,
+		valid_from TIMESTAMPTZ NOT NULL,
+		valid_to TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS payment_versions_validity_idx ON payment_versions (valid_from, valid_to)`,
+	`CREATE INDEX IF NOT EXISTS payment_versions_id_idx ON payment_versions (id)`,
+	`CREATE OR REPLACE FUNCTION keep_transaction_version() RETURNS trigger AS $$
+	BEGIN
+		IF TG_OP = 'UPDATE' AND (OLD.payer_id, OLD.amount, OLD.members, OLD.remark, OLD.status, OLD.is_deleted, OLD.occurred_on)
+			IS NOT DISTINCT FROM (NEW.payer_id, NEW.amount, NEW.members, NEW.remark, NEW.status, NEW.is_deleted, NEW.occurred_on) THEN
+			RETURN NEW;
+		END IF;
+		INSERT INTO transaction_versions
+			(id, payer_id, amount, members, remark, status, created_at, occurred_on, is_deleted, deleted_at, valid_from, valid_to)
+		VALUES
+			(OLD.id, OLD.payer_id, OLD.amount, OLD.members, OLD.remark, OLD.status, OLD.created_at, OLD.occurred_on,
+			 OLD.is_deleted, OLD.deleted_at, COALESCE(OLD.updated_at, OLD.created_at), now());
+		IF TG_OP = 'DELETE' THEN
+			RETURN OLD;
+		END IF;
+		NEW.updated_at := now();
+		NEW.version := OLD.version + 1;
+		RETURN NEW;
+	END;
+	$$ LANGUAGE plpgsql`,
+	`DROP TRIGGER IF EXISTS transactions_keep_version ON transactions`,
+	`CREATE TRIGGER transactions_keep_version BEFORE UPDATE OR DELETE ON transactions
+		FOR EACH ROW EXECUTE FUNCTION keep_transaction_version()`,
+	`CREATE OR REPLACE FUNCTION keep_payment_version() RETURNS trigger AS $$
+	BEGIN
+		IF TG_OP = 'UPDATE' AND (OLD.payer_id, OLD.amount, OLD.reciever_id, OLD.remark, OLD.status, OLD.is_deleted, OLD.occurred_on)
+			IS NOT DISTINCT FROM (NEW.payer_id, NEW.amount, NEW.reciever_id, NEW.remark, NEW.status, NEW.is_deleted, NEW.occurred_on) THEN
+			RETURN NEW;
+		END IF;
+		INSERT INTO payment_versions
+			(id, payer_id, amount, reciever_id, remark, status, confirmed_at, created_at, occurred_on, is_deleted, deleted_at, valid_from, valid_to)
+		VALUES
+			(OLD.id, OLD.payer_id, OLD.amount, OLD.reciever_id, OLD.remark, OLD.status, OLD.confirmed_at, OLD.created_at, OLD.occurred_on,
+			 OLD.is_deleted, OLD.deleted_at, COALESCE(OLD.updated_at, OLD.created_at), now());
+		IF TG_OP = 'DELETE' THEN
+			RETURN OLD;
+		END IF;
+		NEW.updated_at := now();
+		NEW.version := OLD.version + 1;
+		RETURN NEW;
+	END;
+	$$ LANGUAGE plpgsql`,
+	`DROP TRIGGER IF EXISTS payments_keep_version ON payments`,
+	`CREATE TRIGGER payments_keep_version BEFORE UPDATE OR DELETE ON payments
+		FOR EACH ROW EXECUTE FUNCTION keep_payment_version()`,
+
+	// Append-only audit log of every change to transactions, payments, users
+	// and stories. The actor is whoever SetActor named for the database
+	// transaction making the change, or NULL for the system.
+	`CREATE TABLE IF NOT EXISTS audit_log (
+		id BIGSERIAL PRIMARY KEY,
+		entity_type TEXT NOT NULL,
+		entity_id TEXT NOT NULL,
+		action TEXT NOT NULL,
+		actor_id UUID,
+		changed_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		before JSONB,
+		after JSONB
+	)`,
+	`CREATE INDEX IF NOT EXISTS audit_log_entity_idx ON audit_log (entity_type, entity_id, id)`,
+	`CREATE OR REPLACE FUNCTION audit_row() RETURNS trigger AS $$
+	DECLARE
+		old_row JSONB;
+		new_row JSONB;
+		change TEXT;
+	BEGIN
+		IF TG_OP <> 'INSERT' THEN
+			old_row := to_jsonb(OLD);
+		END IF;
+		IF TG_OP <> 'DELETE' THEN
+			new_row := to_jsonb(NEW);
+		END IF;
+
+		IF TG_OP = 'INSERT' THEN
+			change := 'create';
+		ELSIF TG_OP = 'DELETE' THEN
+			change := 'delete';
+		ELSIF old_row = new_row THEN
+			RETURN NULL;
+		ELSIF NOT COALESCE((old_row->>'is_deleted')::boolean, false) AND COALESCE((new_row->>'is_deleted')::boolean, false) THEN
+			change := 'soft_delete';
+		ELSIF COALESCE((old_row->>'is_deleted')::boolean, false) AND NOT COALESCE((new_row->>'is_deleted')::boolean, false) THEN
+			change := 'restore';
+		ELSE
+			change := 'update';
+		END IF;
+
+		INSERT INTO audit_log (entity_type, entity_id, action, actor_id, before, after)
+		VALUES (TG_ARGV[0], COALESCE(new_row, old_row)->>'id', change,
+			NULLIF(current_setting('app.actor_id', true), '')::uuid, old_row, new_row);
+		RETURN NULL;
+	END;
+	$$ LANGUAGE plpgsql`,
+	`CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+	BEGIN
+		RAISE EXCEPTION 'audit_log is append-only';
+	END;
+	$$ LANGUAGE plpgsql`,
+	`DROP TRIGGER IF EXISTS audit_log_append_only ON audit_log`,
+	`CREATE TRIGGER audit_log_append_only BEFORE UPDATE OR DELETE ON audit_log
+		FOR EACH STATEMENT EXECUTE FUNCTION audit_log_append_only()`,
+	`DROP TRIGGER IF EXISTS transactions_audit ON transactions`,
+	`CREATE TRIGGER transactions_audit AFTER INSERT OR UPDATE OR DELETE ON transactions
+		FOR EACH ROW EXECUTE FUNCTION audit_row('transaction')`,
+	`DROP TRIGGER IF EXISTS payments_audit ON payments`,
+	`CREATE TRIGGER payments_audit AFTER INSERT OR UPDATE OR DELETE ON payments
+		FOR EACH ROW EXECUTE FUNCTION audit_row('payment')`,
+	`DROP TRIGGER IF EXISTS users_audit ON users`,
+	`CREATE TRIGGER users_audit AFTER INSERT OR UPDATE OR DELETE ON users
+		FOR EACH ROW EXECUTE FUNCTION audit_row('user')`,
+	`DROP TRIGGER IF EXISTS stories_audit ON stories`,
+	`CREATE TRIGGER stories_audit AFTER INSERT OR UPDATE OR DELETE ON stories
+		FOR EACH ROW EXECUTE FUNCTION audit_row('story')`,
+
+	// Trash: who soft deleted a record, and a way to find old deletions to purge
+	`ALTER TABLE transactions ADD COLUMN IF NOT EXISTS deleted_by UUID`,
+	`ALTER TABLE payments ADD COLUMN IF NOT EXISTS deleted_by UUID`,
+	`CREATE INDEX IF NOT EXISTS transactions_trash_idx ON transactions (deleted_at) WHERE is_deleted`,
+	`CREATE INDEX IF NOT EXISTS payments_trash_idx ON payments (deleted_at) WHERE is_deleted`,
+
+	// Optimistic concurrency: the keep_*_version triggers bump version on
+	// every change, and it is served as the record's ETag
+	`ALTER TABLE transactions ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 1`,
+	`ALTER TABLE payments ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 1`,
+
+	// Responses to requests sent with an Idempotency-Key, replayed on retry.
+	// completed_at stays NULL while the first request is still running.
+	`CREATE TABLE IF NOT EXISTS idempotency_keys (
+		scope TEXT NOT NULL,
+		key TEXT NOT NULL,
+		request_hash TEXT NOT NULL,
+		status_code INTEGER,
+		headers JSONB,
+		body BYTEA,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		completed_at TIMESTAMPTZ,
+		PRIMARY KEY (scope, key)
+	)`,
+	`CREATE INDEX IF NOT EXISTS idempotency_keys_created_idx ON idempotency_keys (created_at)`,
+
+	// Keyset pagination orders lists by (created_at, id). Users who joined
+	// before this existed all share the migration time.
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now()`,
+	`CREATE INDEX IF NOT EXISTS transactions_page_idx ON transactions (created_at DESC, id DESC) WHERE is_deleted = false`,
+	`CREATE INDEX IF NOT EXISTS payments_page_idx ON payments (created_at DESC, id DESC) WHERE is_deleted = false`,
+	`CREATE INDEX IF NOT EXISTS users_page_idx ON users (created_at DESC, id DESC)`,
+	`CREATE INDEX IF NOT EXISTS stories_page_idx ON stories (timestamp DESC, id DESC)`,
+
+	// Full-text search. Queries must use these exact expressions to hit
+	// the indexes.
+	`CREATE INDEX IF NOT EXISTS transactions_search_idx ON transactions USING GIN (to_tsvector('english', COALESCE(remark, '')))`,
+	`CREATE INDEX IF NOT EXISTS payments_search_idx ON payments USING GIN (to_tsvector('english', COALESCE(remark, '')))`,
+	`CREATE INDEX IF NOT EXISTS stories_search_idx ON stories USING GIN (to_tsvector('english', COALESCE(content, '')))`,
+	// Users are found by username or name; users_search_idx only had the
+	// username.
+	`DROP INDEX IF EXISTS users_search_idx`,
+	`CREATE INDEX IF NOT EXISTS users_name_search_idx ON users USING GIN (to_tsvector('simple', COALESCE(username, '') || ' ' || COALESCE(name, '')))`,
+
+	// Free-form tags on transactions and payments
+	`CREATE TABLE IF NOT EXISTS tags (
+		id BIGSERIAL PRIMARY KEY,
+		name TEXT NOT NULL UNIQUE,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS tags_name_prefix_idx ON tags (name text_pattern_ops)`,
+	`CREATE TABLE IF NOT EXISTS transaction_tags (
+		transaction_id UUID NOT NULL REFERENCES transactions(id) ON DELETE CASCADE,
+		tag_id BIGINT NOT NULL REFERENCES tags(id) ON DELETE CASCADE,
+		PRIMARY KEY (transaction_id, tag_id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS transaction_tags_tag_idx ON transaction_tags (tag_id)`,
+	`CREATE TABLE IF NOT EXISTS payment_tags (
+		payment_id UUID NOT NULL REFERENCES payments(id) ON DELETE CASCADE,
+		tag_id BIGINT NOT NULL REFERENCES tags(id) ON DELETE CASCADE,
+		PRIMARY KEY (payment_id, tag_id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS payment_tags_tag_idx ON payment_tags (tag_id)`,
+
+	// Saved views: named query strings for the transaction list or summary
+	`CREATE TABLE IF NOT EXISTS saved_views (
+		id UUID PRIMARY KEY,
+		owner_id UUID NOT NULL,
+		name TEXT NOT NULL,
+		target TEXT NOT NULL,
+		query TEXT NOT NULL DEFAULT '',
+		shared BOOLEAN NOT NULL DEFAULT false,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		updated_at TIMESTAMPTZ,
+		UNIQUE (owner_id, name)
+	)`,
+	`CREATE INDEX IF NOT EXISTS saved_views_shared_idx ON saved_views (shared) WHERE shared`,
+
+	// Running balances, kept in step with transactions and payments by
+	// triggers so reading current balances needs no scan. expense_net is
+	// what /summary reports; adding settlement_net gives what /balances
+	// reports. A pair row holds what user_a owes user_b, with user_a <
+	// user_b. See ledger for the arithmetic these mirror.
+	`CREATE TABLE IF NOT EXISTS member_balances (
+		user_id UUID PRIMARY KEY,
+		expense_net NUMERIC NOT NULL DEFAULT 0,
+		settlement_net NUMERIC NOT NULL DEFAULT 0,
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS pair_balances (
+		user_a UUID NOT NULL,
+		user_b UUID NOT NULL,
+		amount NUMERIC NOT NULL DEFAULT 0,
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (user_a, user_b),
+		CHECK (user_a < user_b)
+	)`,
+	// Rows are upserted in key order so concurrent writers lock them in
+	// the same order.
+	`CREATE OR REPLACE FUNCTION apply_transaction_balance(payer UUID, amount NUMERIC, members UUID[], sign INT) RETURNS void AS $$
+	DECLARE
+		distinct_members UUID[];
+		share NUMERIC;
+	BEGIN
+		SELECT array_agg(DISTINCT m ORDER BY m) INTO distinct_members FROM unnest(members) m WHERE m IS NOT NULL;
+		IF distinct_members IS NULL THEN
+			RETURN;
+		END IF;
+		share := amount / cardinality(distinct_members);
+
+		INSERT INTO member_balances (user_id, expense_net)
+		SELECT user_id, SUM(delta) FROM (
+			SELECT payer, sign * amount
+			UNION ALL
+			SELECT m, -sign * share FROM unnest(distinct_members) m
+		) changes (user_id, delta)
+		GROUP BY user_id
+		ORDER BY user_id
+		ON CONFLICT (user_id) DO UPDATE
+		SET expense_net = member_balances.expense_net + EXCLUDED.expense_net, updated_at = now();
+
+		INSERT INTO pair_balances (user_a, user_b, amount)
+		SELECT LEAST(m, payer), GREATEST(m, payer), CASE WHEN m < payer THEN sign * share ELSE -sign * share END
+		FROM unnest(distinct_members) m
+		WHERE m <> payer
+		ORDER BY 1, 2
+		ON CONFLICT (user_a, user_b) DO UPDATE
+		SET amount = pair_balances.amount + EXCLUDED.amount, updated_at = now();
+	END;
+	$$ LANGUAGE plpgsql`,
+	`CREATE OR REPLACE FUNCTION apply_payment_balance(payer UUID, reciever UUID, amount NUMERIC, sign INT) RETURNS void AS $$
+	BEGIN
+		IF payer = reciever THEN
+			RETURN;
+		END IF;
+
+		INSERT INTO member_balances (user_id, settlement_net)
+		VALUES (payer, sign * amount), (reciever, -sign * amount)
+		ORDER BY 1
+		ON CONFLICT (user_id) DO UPDATE
+		SET settlement_net = member_balances.settlement_net + EXCLUDED.settlement_net, updated_at = now();
+
+		-- The payer owes the reciever amount less
+		INSERT INTO pair_balances (user_a, user_b, amount)
+		VALUES (LEAST(payer, reciever), GREATEST(payer, reciever),
+			CASE WHEN payer < reciever THEN -sign * amount ELSE sign * amount END)
+		ON CONFLICT (user_a, user_b) DO UPDATE
+		SET amount = pair_balances.amount + EXCLUDED.amount, updated_at = now();
+	END;
+	$$ LANGUAGE plpgsql`,
+	`CREATE OR REPLACE FUNCTION transactions_balance() RETURNS trigger AS $$
+	BEGIN
+		IF TG_OP = 'UPDATE' AND (OLD.payer_id, OLD.amount, OLD.members, OLD.status, OLD.is_deleted)
+			IS NOT DISTINCT FROM (NEW.payer_id, NEW.amount, NEW.members, NEW.status, NEW.is_deleted) THEN
+			RETURN NULL;
+		END IF;
+		IF TG_OP IN ('UPDATE', 'DELETE') AND NOT OLD.is_deleted AND OLD.status <> 'rejected' THEN
+			PERFORM apply_transaction_balance(OLD.payer_id, OLD.amount::numeric, OLD.members, -1);
+		END IF;
+		IF TG_OP IN ('INSERT', 'UPDATE') AND NOT NEW.is_deleted AND NEW.status <> 'rejected' THEN
+			PERFORM apply_transaction_balance(NEW.payer_id, NEW.amount::numeric, NEW.members, 1);
+		END IF;
+		RETURN NULL;
+	END;
+	$$ LANGUAGE plpgsql`,
+	`CREATE OR REPLACE FUNCTION payments_balance() RETURNS trigger AS $$
+	BEGIN
+		IF TG_OP = 'UPDATE' AND (OLD.payer_id, OLD.reciever_id, OLD.amount, OLD.status, OLD.is_deleted)
+			IS NOT DISTINCT FROM (NEW.payer_id, NEW.reciever_id, NEW.amount, NEW.status, NEW.is_deleted) THEN
+			RETURN NULL;
+		END IF;
+		IF TG_OP IN ('UPDATE', 'DELETE') AND NOT OLD.is_deleted AND OLD.status = 'confirmed' THEN
+			PERFORM apply_payment_balance(OLD.payer_id, OLD.reciever_id, OLD.amount::numeric, -1);
+		END IF;
+		IF TG_OP IN ('INSERT', 'UPDATE') AND NOT NEW.is_deleted AND NEW.status = 'confirmed' THEN
+			PERFORM apply_payment_balance(NEW.payer_id, NEW.reciever_id, NEW.amount::numeric, 1);
+		END IF;
+		RETURN NULL;
+	END;
+	$$ LANGUAGE plpgsql`,
+	// rebuild_balances recomputes both tables from scratch. Callers must
+	// keep writers out meanwhile, e.g. by locking transactions and payments.
+	`CREATE OR REPLACE FUNCTION rebuild_balances() RETURNS void AS $$
+	BEGIN
+		DELETE FROM member_balances;
+		DELETE FROM pair_balances;
+		PERFORM apply_transaction_balance(payer_id, amount::numeric, members, 1)
+		FROM transactions WHERE NOT is_deleted AND status <> 'rejected';
+		PERFORM apply_payment_balance(payer_id, reciever_id, amount::numeric, 1)
+		FROM payments WHERE NOT is_deleted AND status = 'confirmed';
+	END;
+	$$ LANGUAGE plpgsql`,
+	// Backfill once, in the same transaction that starts tracking writes
+	`DO $$
+	BEGIN
+		IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'transactions_balance' AND tgrelid = 'transactions'::regclass) THEN
+			LOCK TABLE transactions, payments IN SHARE ROW EXCLUSIVE MODE;
+			PERFORM rebuild_balances();
+			CREATE TRIGGER transactions_balance AFTER INSERT OR UPDATE OR DELETE ON transactions
+				FOR EACH ROW EXECUTE FUNCTION transactions_balance();
+			CREATE TRIGGER payments_balance AFTER INSERT OR UPDATE OR DELETE ON payments
+				FOR EACH ROW EXECUTE FUNCTION payments_balance();
+		END IF;
+	END;
+	$$`,
+
+	// Where each user is and how they read numbers. Dates in filters,
+	// buckets and exports follow timezone; locale, a BCP 47 tag, formats
+	// exports, with '' meaning plain 1234.50 and ISO dates.
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS timezone TEXT NOT NULL DEFAULT 'UTC'`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS locale TEXT NOT NULL DEFAULT ''`,
+
+	// The day an expense or payment happened, which may be before it was
+	// entered. created_at stays the audit timestamp. Existing rows are taken
+	// to have happened when they were entered, in their payer's timezone;
+	// the backfill bypasses the triggers so it isn't recorded as edits.
+	`ALTER TABLE transaction_versions ADD COLUMN IF NOT EXISTS occurred_on DATE`,
+	`ALTER TABLE payment_versions ADD COLUMN IF NOT EXISTS occurred_on DATE`,
+	`DO $$
+	BEGIN
+		IF NOT EXISTS (SELECT 1 FROM information_schema.columns
+			WHERE table_schema = current_schema() AND table_name = 'transactions' AND column_name = 'occurred_on') THEN
+			ALTER TABLE transactions ADD COLUMN occurred_on DATE;
+			ALTER TABLE transactions DISABLE TRIGGER USER;
+			UPDATE transactions t SET occurred_on = (t.created_at AT TIME ZONE
+				COALESCE((SELECT u.timezone FROM users u WHERE u.id = t.payer_id), 'UTC'))::date;
+			ALTER TABLE transactions ENABLE TRIGGER USER;
+			ALTER TABLE transactions ALTER COLUMN occurred_on SET DEFAULT CURRENT_DATE,
+				ALTER COLUMN occurred_on SET NOT NULL;
+			UPDATE transaction_versions v SET occurred_on = (v.created_at AT TIME ZONE
+				COALESCE((SELECT u.timezone FROM users u WHERE u.id = v.payer_id), 'UTC'))::date;
+		END IF;
+		IF NOT EXISTS (SELECT 1 FROM information_schema.columns
+			WHERE table_schema = current_schema() AND table_name = 'payments' AND column_name = 'occurred_on') THEN
+			ALTER TABLE payments ADD COLUMN occurred_on DATE;
+			ALTER TABLE payments DISABLE TRIGGER USER;
+			UPDATE payments p SET occurred_on = (p.created_at AT TIME ZONE
+				COALESCE((SELECT u.timezone FROM users u WHERE u.id = p.payer_id), 'UTC'))::date;
+			ALTER TABLE payments ENABLE TRIGGER USER;
+			ALTER TABLE payments ALTER COLUMN occurred_on SET DEFAULT CURRENT_DATE,
+				ALTER COLUMN occurred_on SET NOT NULL;
+			UPDATE payment_versions v SET occurred_on = (v.created_at AT TIME ZONE
+				COALESCE((SELECT u.timezone FROM users u WHERE u.id = v.payer_id), 'UTC'))::date;
+		END IF;
+	END;
+	$$`,
+	`CREATE INDEX IF NOT EXISTS transactions_occurred_idx ON transactions (occurred_on DESC, id DESC) WHERE is_deleted = false`,
+	`CREATE INDEX IF NOT EXISTS payments_occurred_idx ON payments (occurred_on DESC, id DESC) WHERE is_deleted = false`,
+
+	// Closed periods: once a range of days is settled, expenses and payments
+	// that occurred in it can't be added, changed or deleted until
+	// reopener_id reopens it. Only the fields the version history keeps are
+	// locked, so reminders and the like still work. Errors use SQLSTATE
+	// EP001 so handlers can tell them apart.
+	`CREATE TABLE IF NOT EXISTS closed_periods (
+		id BIGSERIAL PRIMARY KEY,
+		start_date DATE NOT NULL,
+		end_date DATE NOT NULL,
+		note TEXT NOT NULL DEFAULT '',
+		closed_by UUID NOT NULL,
+		closed_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		reopener_id UUID NOT NULL,
+		reopened_by UUID,
+		reopened_at TIMESTAMPTZ,
+		CHECK (start_date <= end_date)
+	)`,
+	`CREATE INDEX IF NOT EXISTS closed_periods_open_idx ON closed_periods (start_date, end_date) WHERE reopened_at IS NULL`,
+	`CREATE OR REPLACE FUNCTION refuse_closed_period() RETURNS trigger AS $$
+	DECLARE
+		period closed_periods%ROWTYPE;
+	BEGIN
+		IF TG_OP = 'UPDATE' AND NOT EXISTS (
+			SELECT 1 FROM unnest(TG_ARGV) col
+			WHERE to_jsonb(OLD)->col IS DISTINCT FROM to_jsonb(NEW)->col
+		) THEN
+			RETURN NEW;
+		END IF;
+		-- Records in the trash no longer count, so purging them is fine
+		IF TG_OP <> 'INSERT' AND NOT OLD.is_deleted THEN
+			SELECT * INTO period FROM closed_periods
+			WHERE reopened_at IS NULL AND OLD.occurred_on BETWEEN start_date AND end_date
+			ORDER BY start_date LIMIT 1;
+		END IF;
+		IF period.id IS NULL AND TG_OP <> 'DELETE' AND NOT NEW.is_deleted THEN
+			SELECT * INTO period FROM closed_periods
+			WHERE reopened_at IS NULL AND NEW.occurred_on BETWEEN start_date AND end_date
+			ORDER BY start_date LIMIT 1;
+		END IF;
+		IF period.id IS NOT NULL THEN
+			RAISE EXCEPTION 'The period from % to % is closed; it has to be reopened first', period.start_date, period.end_date
+				USING ERRCODE = 'EP001';
+		END IF;
+		IF TG_OP = 'DELETE' THEN
+			RETURN OLD;
+		END IF;
+		RETURN NEW;
+	END;
+	$$ LANGUAGE plpgsql`,
+	`DROP TRIGGER IF EXISTS transactions_closed_period ON transactions`,
+	`CREATE TRIGGER transactions_closed_period BEFORE INSERT OR UPDATE OR DELETE ON transactions
+		FOR EACH ROW EXECUTE FUNCTION refuse_closed_period('payer_id', 'amount', 'members', 'remark', 'status', 'is_deleted', 'occurred_on')`,
+	`DROP TRIGGER IF EXISTS payments_closed_period ON payments`,
+	`CREATE TRIGGER payments_closed_period BEFORE INSERT OR UPDATE OR DELETE ON payments
+		FOR EACH ROW EXECUTE FUNCTION refuse_closed_period('payer_id', 'amount', 'reciever_id', 'remark', 'status', 'is_deleted', 'occurred_on')`,
+	`DROP TRIGGER IF EXISTS closed_periods_audit ON closed_periods`,
+	`CREATE TRIGGER closed_periods_audit AFTER INSERT OR UPDATE OR DELETE ON closed_periods
+		FOR EACH ROW EXECUTE FUNCTION audit_row('closed_period')`,
+
+	// Old events are pruned by age
+	`CREATE INDEX IF NOT EXISTS events_created_at_idx ON events (created_at)`,
+
+	// A tag only exists while something carries it. Links also go when
+	// their record is hard deleted or purged from the trash, so this runs
+	// on every removed link rather than only on untagging.
+	`CREATE OR REPLACE FUNCTION drop_unused_tag() RETURNS trigger AS $$
+	BEGIN
+		DELETE FROM tags WHERE id = OLD.tag_id
+		AND NOT EXISTS (SELECT 1 FROM transaction_tags WHERE tag_id = OLD.tag_id)
+		AND NOT EXISTS (SELECT 1 FROM payment_tags WHERE tag_id = OLD.tag_id);
+		RETURN OLD;
+	END;
+	$$ LANGUAGE plpgsql`,
+	`DROP TRIGGER IF EXISTS transaction_tags_drop_unused ON transaction_tags`,
+	`CREATE TRIGGER transaction_tags_drop_unused AFTER DELETE ON transaction_tags
+		FOR EACH ROW EXECUTE FUNCTION drop_unused_tag()`,
+	`DROP TRIGGER IF EXISTS payment_tags_drop_unused ON payment_tags`,
+	`CREATE TRIGGER payment_tags_drop_unused AFTER DELETE ON payment_tags
+		FOR EACH ROW EXECUTE FUNCTION drop_unused_tag()`,
+	// Tags left behind by deletes before the trigger existed
+	`DELETE FROM tags WHERE NOT EXISTS (SELECT 1 FROM transaction_tags WHERE tag_id = tags.id)
+		AND NOT EXISTS (SELECT 1 FROM payment_tags WHERE tag_id = tags.id)`,
+}
+
+// Migrate brings the schema up to date with what the handlers expect.
+func Migrate(ctx context.Context) error {
+	for i, stmt := range migrations {
+		if _, err := Pool.Exec(ctx, stmt); err != nil {
+			return fmt.Errorf("migration %d failed: %v", i, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package db
+
+import "strings"
+
+// Rows of transactions and payments are versioned by triggers (see
+// schema.go): every edit or delete first copies the old row into
+// transaction_versions or payment_versions, stamped with the period it was
+// live. A row as it stood at time T is therefore either the live row, if it
+// already looked that way at T, or the one version whose period covers T.
+// Edits made before versioning was introduced are not recoverable.
+
+// TransactionsAsOf returns a FROM-clause subquery yielding the columns of
+// transactions as they stood at the timestamp bound to param (e.g. "$4").
+// When that parameter is NULL it yields the live rows.
+func TransactionsAsOf(param string) string {
+	return asOf(`(
+		SELECT id, payer_id, amount::float8 AS amount, members, remark, status, created_at, occurred_on,
+			is_deleted AND (:t IS NULL OR deleted_at IS NULL OR deleted_at <= :t) AS is_deleted,
+			CASE WHEN :t IS NULL OR deleted_at <= :t THEN deleted_at END AS deleted_at
+		FROM transactions
+		WHERE :t IS NULL OR (created_at <= :t AND COALESCE(updated_at, created_at) <= :t)
+		UNION ALL
+		SELECT id, payer_id, amount, members, remark, status, created_at, occurred_on, is_deleted, deleted_at
+		FROM transaction_versions
+		WHERE valid_from <= :t AND valid_to > :t
+	)`, param)
+}
+
+// PaymentsAsOf is TransactionsAsOf for payments.
+func PaymentsAsOf(param string) string {
+	return asOf(`(
+		SELECT id, payer_id, amount::float8 AS amount, reciever_id, remark, status,
+			CASE WHEN :t IS NULL OR confirmed_at <= :t THEN confirmed_at END AS confirmed_at,
+			created_at, occurred_on,
+			is_deleted AND (:t IS NULL OR deleted_at IS NULL OR deleted_at <= :t) AS is_deleted,
+			CASE WHEN :t IS NULL OR deleted_at <= :t THEN deleted_at END AS deleted_at
+		FROM payments
+		WHERE :t IS NULL OR (created_at <= :t AND COALESCE(updated_at, created_at) <= :t)
+		UNION ALL
+		SELECT id, payer_id, amount, reciever_id, remark, status, confirmed_at, created_at, occurred_on, is_deleted, deleted_at
+		FROM payment_versions
+		WHERE valid_from <= :t AND valid_to > :t
+	)`, param)
+}
+
+func asOf(query, param string) string {
+	return strings.ReplaceAll(query, ":t", param+"::timestamptz")
+}
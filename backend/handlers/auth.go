@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+
+	"firebase.google.com/go/auth"
+	"github.com/google/uuid"
+	"github.com/ishushreyas/expense-tracker/db"
+	"github.com/jackc/pgx/v5"
+)
+
+// sessionUserID resolves the users row for the Firebase session that
+// verifySessionMiddleware attached to the request context.
+func sessionUserID(ctx context.Context) (uuid.UUID, error) {
+	token, ok := ctx.Value("user").(*auth.Token)
+	if !ok || token == nil {
+		return uuid.Nil, fmt.Errorf("user not found in context")
+	}
+
+	email, _ := token.Claims["email"].(string)
+	if email == "" {
+		return uuid.Nil, fmt.Errorf("session has no email claim")
+	}
+
+	var userID uuid.UUID
+	err := db.Pool.QueryRow(ctx, "SELECT id FROM users WHERE email = $1", email).Scan(&userID)
+	if err == pgx.ErrNoRows {
+		return uuid.Nil, fmt.Errorf("no user registered for %s", email)
+	} else if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to look up user: %v", err)
+	}
+	return userID, nil
+}
+
+// auditActor is the session user to attribute changes to in the audit log,
+// or uuid.Nil when the request carries no session.
+func auditActor(ctx context.Context) uuid.UUID {
+	userID, err := sessionUserID(ctx)
+	if err != nil {
+		return uuid.Nil
+	}
+	return userID
+}
+
+// nullableID stores uuid.Nil as NULL.
+func nullableID(id uuid.UUID) *uuid.UUID {
+	if id == uuid.Nil {
+		return nil
+	}
+	return &id
+}
+
+// isParty reports whether userID is one of the parties to a record: its
+// payer, a member or the reciever.
+func isParty(userID uuid.UUID, parties ...uuid.UUID) bool {
+	for _, party := range parties {
+		if party == userID {
+			return true
+		}
+	}
+	return false
+}
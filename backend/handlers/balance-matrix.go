@@ -0,0 +1,262 @@
+package handlers
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ishushreyas/expense-tracker/db"
+	"github.com/ishushreyas/expense-tracker/ledger"
+)
+
+type matrixMember struct {
+	ID       uuid.UUID `json:"id"`
+	Username string    `json:"username"`
+}
+
+// pairContribution is a ledger contribution with enough of the underlying
+// transaction or payment to show it to a person.
+type pairContribution struct {
+	ledger.Contribution
+	Remark      string    `json:"remark"`
+	TotalAmount float64   `json:"total_amount"`
+	CreatedAt   time.Time `json:"created_at"`
+	OccurredOn  time.Time `json:"occurred_on"`
+}
+
+// loadUsernames maps user IDs to their usernames.
+func loadUsernames(ctx context.Context) (map[uuid.UUID]string, error) {
+	rows, err := db.Pool.Query(ctx, "SELECT id, username FROM users")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := make(map[uuid.UUID]string)
+	for rows.Next() {
+		var (
+			id       uuid.UUID
+			username string
+		)
+		if err := rows.Scan(&id, &username); err != nil {
+			return nil, err
+		}
+		names[id] = username
+	}
+	return names, rows.Err()
+}
+
+// GetBalanceMatrix reports who owes whom for every pair of members, from
+// shared transactions minus the payments between them. With ?debtor_id= and
+// ?creditor_id= it drills down into the records behind one pair instead.
+// ?format=csv returns either view as a spreadsheet, written in the
+// caller's locale.
+func GetBalanceMatrix(w http.ResponseWriter, r *http.Request) {
+	// Create context with timeout
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	prefs, err := preferencesFor(ctx, r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts, err := balanceOptionsFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	l, err := loadLedger(ctx, opts)
+	if err != nil {
+		http.Error(w, "Failed to compute balances: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	names, err := loadUsernames(ctx)
+	if err != nil {
+		http.Error(w, "Failed to retrieve users: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	query := r.URL.Query()
+	asCSV := query.Get("format") == "csv"
+
+	if query.Get("debtor_id") != "" || query.Get("creditor_id") != "" {
+		debtorID, err := uuid.Parse(query.Get("debtor_id"))
+		if err != nil {
+			http.Error(w, "Invalid debtor UUID", http.StatusBadRequest)
+			return
+		}
+		creditorID, err := uuid.Parse(query.Get("creditor_id"))
+		if err != nil {
+			http.Error(w, "Invalid creditor UUID", http.StatusBadRequest)
+			return
+		}
+
+		contributions, err := describeContributions(ctx, l.Contributions(debtorID, creditorID), opts.AsOf)
+		if err != nil {
+			http.Error(w, "Failed to retrieve contributing records: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if asCSV {
+			writePairCSV(w, prefs, names[debtorID], names[creditorID], contributions)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"debtor":        matrixMember{ID: debtorID, Username: names[debtorID]},
+			"creditor":      matrixMember{ID: creditorID, Username: names[creditorID]},
+			"amount":        l.Owes(debtorID, creditorID),
+			"as_of":         opts.AsOf,
+			"contributions": contributions,
+		})
+		return
+	}
+
+	members := make([]matrixMember, 0)
+	for _, id := range l.Members() {
+		members = append(members, matrixMember{ID: id, Username: names[id]})
+	}
+
+	// matrix[debtor][creditor] is set only where debtor owes creditor
+	matrix := make(map[uuid.UUID]map[uuid.UUID]float64)
+	for _, pair := range l.Pairs() {
+		if matrix[pair.DebtorID] == nil {
+			matrix[pair.DebtorID] = make(map[uuid.UUID]float64)
+		}
+		matrix[pair.DebtorID][pair.CreditorID] = pair.Amount
+	}
+
+	if asCSV {
+		writeMatrixCSV(w, prefs, members, matrix)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"members":        members,
+		"matrix":         matrix,
+		"pairs":          l.Pairs(),
+		"confirmed_only": opts.ConfirmedOnly,
+		"as_of":          opts.AsOf,
+		"period": map[string]string{
+			"start_date": opts.StartDate,
+			"end_date":   opts.EndDate,
+		},
+	})
+}
+
+// describeContributions looks up the transactions and payments behind a
+// pair's contributions, as they stood at asOf if given.
+func describeContributions(ctx context.Context, contributions []ledger.Contribution, asOf *time.Time) ([]pairContribution, error) {
+	var expenseIDs, settlementIDs []uuid.UUID
+	for _, c := range contributions {
+		if c.Kind == ledger.KindExpense {
+			expenseIDs = append(expenseIDs, c.ID)
+		} else {
+			settlementIDs = append(settlementIDs, c.ID)
+		}
+	}
+
+	type details struct {
+		remark     string
+		amount     float64
+		createdAt  time.Time
+		occurredOn time.Time
+	}
+	found := make(map[uuid.UUID]details)
+	for _, lookup := range []struct {
+		query string
+		ids   []uuid.UUID
+	}{
+		{"SELECT id, remark, amount, created_at, occurred_on FROM " + db.TransactionsAsOf("$2") + " t WHERE id = ANY($1)", expenseIDs},
+		{"SELECT id, remark, amount, created_at, occurred_on FROM " + db.PaymentsAsOf("$2") + " p WHERE id = ANY($1)", settlementIDs},
+	} {
+		if len(lookup.ids) == 0 {
+			continue
+		}
+		rows, err := db.Pool.Query(ctx, lookup.query, lookup.ids, asOf)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var (
+				id uuid.UUID
+				d  details
+			)
+			if err := rows.Scan(&id, &d.remark, &d.amount, &d.createdAt, &d.occurredOn); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			found[id] = d
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	described := make([]pairContribution, 0, len(contributions))
+	for _, c := range contributions {
+		d := found[c.ID]
+		described = append(described, pairContribution{
+			Contribution: c,
+			Remark:       d.remark,
+			TotalAmount:  d.amount,
+			CreatedAt:    d.createdAt,
+			OccurredOn:   d.occurredOn,
+		})
+	}
+	return described, nil
+}
+
+// writeMatrixCSV writes a square sheet: row members owe column members.
+func writeMatrixCSV(w http.ResponseWriter, prefs requestPreferences, members []matrixMember, matrix map[uuid.UUID]map[uuid.UUID]float64) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", attachment("balance-matrix.csv"))
+
+	out := csv.NewWriter(w)
+	header := []string{"debtor \\ creditor"}
+	for _, m := range members {
+		header = append(header, m.Username)
+	}
+	out.Write(header)
+
+	for _, debtor := range members {
+		row := []string{debtor.Username}
+		for _, creditor := range members {
+			row = append(row, prefs.Locale.Amount(matrix[debtor.ID][creditor.ID]))
+		}
+		out.Write(row)
+	}
+	out.Flush()
+}
+
+// writePairCSV writes the records behind what debtor owes creditor.
+func writePairCSV(w http.ResponseWriter, prefs requestPreferences, debtor, creditor string, contributions []pairContribution) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", attachment("balance-pair.csv"))
+
+	out := csv.NewWriter(w)
+	out.Write([]string{"date", "kind", "id", "remark", "total_amount", debtor + " owes " + creditor})
+
+	var total float64
+	for _, c := range contributions {
+		total += c.Amount
+		out.Write([]string{
+			prefs.Locale.Date(c.OccurredOn),
+			c.Kind,
+			c.ID.String(),
+			c.Remark,
+			prefs.Locale.Amount(c.TotalAmount),
+			prefs.Locale.Amount(c.Amount),
+		})
+	}
+	out.Write([]string{"", "", "", "total", "", prefs.Locale.Amount(ledger.Round(total))})
+	out.Flush()
+}
@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ishushreyas/expense-tracker/db"
+	"github.com/ishushreyas/expense-tracker/ledger"
+)
+
+// balanceOptions picks which records feed the ledger. AsOf, when set,
+// reconstructs the records as they stood at that moment. Dates match the
+// day each record occurred on.
+type balanceOptions struct {
+	StartDate     string
+	EndDate       string
+	ConfirmedOnly bool
+	AsOf          *time.Time
+}
+
+func balanceOptionsFromRequest(r *http.Request) (balanceOptions, error) {
+	query := r.URL.Query()
+	asOf, err := parseAsOf(query.Get("as_of"))
+	if err != nil {
+		return balanceOptions{}, err
+	}
+	return balanceOptions{
+		StartDate:     query.Get("start_date"),
+		EndDate:       query.Get("end_date"),
+		ConfirmedOnly: query.Get("confirmed_only") == "true",
+		AsOf:          asOf,
+	}, nil
+}
+
+// parseAsOf accepts an RFC 3339 timestamp or a plain YYYY-MM-DD date, which
+// means the end of that day (UTC). An empty value means now.
+func parseAsOf(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return &t, nil
+	}
+	day, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return nil, errors.New("Invalid as_of, expected RFC 3339 timestamp or YYYY-MM-DD")
+	}
+	t := day.AddDate(0, 0, 1).Add(-time.Microsecond)
+	return &t, nil
+}
+
+// loadLedger nets every live expense and every confirmed payment in the
+// period. Rejected transactions never count; with ConfirmedOnly, neither do
+// transactions still awaiting member confirmation. With AsOf, every record
+// is taken as it stood at that moment. Records are added in the order they
+// occurred, so contributions always list in the same order.
+func loadLedger(ctx context.Context, opts balanceOptions) (*ledger.Ledger, error) {
+	l := ledger.New()
+
+	rows, err := db.Pool.Query(ctx, `
+		SELECT id, payer_id, amount, members
+		FROM `+db.TransactionsAsOf("$4")+` t
+		WHERE is_deleted = false
+		AND status <> 'rejected'
+		AND (NOT $3 OR status = 'confirmed')
+		AND ($1 = '' OR occurred_on >= $1::date)
+		AND ($2 = '' OR occurred_on <= $2::date)
+		ORDER BY occurred_on, id
+	`, opts.StartDate, opts.EndDate, opts.ConfirmedOnly, opts.AsOf)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var e ledger.Expense
+		if err := rows.Scan(&e.ID, &e.PayerID, &e.Amount, &e.Members); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		l.AddExpense(e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.Pool.Query(ctx, `
+		SELECT id, payer_id, reciever_id, amount
+		FROM `+db.PaymentsAsOf("$3")+` p
+		WHERE is_deleted = false
+		AND status = 'confirmed'
+		AND ($1 = '' OR occurred_on >= $1::date)
+		AND ($2 = '' OR occurred_on <= $2::date)
+		ORDER BY occurred_on, id
+	`, opts.StartDate, opts.EndDate, opts.AsOf)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s ledger.Settlement
+		if err := rows.Scan(&s.ID, &s.FromID, &s.ToID, &s.Amount); err != nil {
+			return nil, err
+		}
+		l.AddSettlement(s)
+	}
+	return l, rows.Err()
+}
+
+// currentLedger is loadLedger, except that balances over all time as of
+// now come from the running balances instead of replaying every record.
+// The result has no contributions.
+func currentLedger(ctx context.Context, opts balanceOptions) (*ledger.Ledger, error) {
+	if opts.StartDate != "" || opts.EndDate != "" || opts.ConfirmedOnly || opts.AsOf != nil {
+		return loadLedger(ctx, opts)
+	}
+	snapshot, err := db.LoadBalances(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return snapshot.Ledger(), nil
+}
+
+// GetBalances reports what every member owes or is owed once shared
+// expenses and confirmed settlement payments are netted together, both
+// overall and between each pair of members.
+func GetBalances(w http.ResponseWriter, r *http.Request) {
+	// Create context with timeout
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	opts, err := balanceOptionsFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	l, err := currentLedger(ctx, opts)
+	if err != nil {
+		http.Error(w, "Failed to compute balances: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"balances":       l.Balances(),
+		"pairs":          l.Pairs(),
+		"confirmed_only": opts.ConfirmedOnly,
+		"as_of":          opts.AsOf,
+		"period": map[string]string{
+			"start_date": opts.StartDate,
+			"end_date":   opts.EndDate,
+		},
+	}
+
+	// Narrow the pairs down to a single member if asked
+	if userIDStr := r.URL.Query().Get("user_id"); userIDStr != "" {
+		userID, err := uuid.Parse(userIDStr)
+		if err != nil {
+			http.Error(w, "Invalid user UUID", http.StatusBadRequest)
+			return
+		}
+		pairs := []ledger.PairBalance{}
+		for _, pair := range l.Pairs() {
+			if pair.DebtorID == userID || pair.CreditorID == userID {
+				pairs = append(pairs, pair)
+			}
+		}
+		response["user_id"] = userID
+		response["balance"] = l.Balance(userID)
+		response["pairs"] = pairs
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
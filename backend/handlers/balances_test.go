@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/ishushreyas/expense-tracker/db"
+)
+
+func TestRunningBalancesFollowWrites(t *testing.T) {
+	testDatabase(t)
+	seedTransactions(t, 500)
+	seedPayments(t, 300)
+	ctx := context.Background()
+
+	// Edit, soft-delete, restore and hard-delete some of the seeded rows,
+	// and confirm, reject and turn round some of the payments
+	for _, stmt := range []string{
+		`UPDATE transactions SET amount = amount + 1 WHERE id IN (SELECT id FROM transactions ORDER BY id LIMIT 50)`,
+		`UPDATE transactions SET members = members[2:] WHERE id IN (SELECT id FROM transactions ORDER BY id DESC LIMIT 50)`,
+		`UPDATE transactions SET is_deleted = true, deleted_at = now() WHERE id IN (SELECT id FROM transactions WHERE NOT is_deleted ORDER BY created_at LIMIT 50)`,
+		`UPDATE transactions SET is_deleted = false, deleted_at = NULL WHERE id IN (SELECT id FROM transactions WHERE is_deleted ORDER BY created_at LIMIT 10)`,
+		`UPDATE transactions SET status = 'rejected' WHERE id IN (SELECT id FROM transactions WHERE status = 'pending' LIMIT 20)`,
+		`DELETE FROM transactions WHERE id IN (SELECT id FROM transactions ORDER BY created_at DESC LIMIT 20)`,
+		`UPDATE payments SET status = 'confirmed', confirmed_at = now() WHERE id IN (SELECT id FROM payments WHERE status = 'pending' ORDER BY id LIMIT 30)`,
+		`UPDATE payments SET status = 'rejected' WHERE id IN (SELECT id FROM payments WHERE status = 'confirmed' ORDER BY id DESC LIMIT 20)`,
+		`UPDATE payments SET amount = amount + 1 WHERE id IN (SELECT id FROM payments ORDER BY id LIMIT 50)`,
+		`UPDATE payments SET payer_id = reciever_id, reciever_id = payer_id WHERE id IN (SELECT id FROM payments WHERE status = 'confirmed' ORDER BY created_at LIMIT 30)`,
+		`UPDATE payments SET is_deleted = true, deleted_at = now() WHERE id IN (SELECT id FROM payments WHERE NOT is_deleted ORDER BY created_at DESC LIMIT 40)`,
+		`UPDATE payments SET is_deleted = false, deleted_at = NULL WHERE id IN (SELECT id FROM payments WHERE is_deleted ORDER BY created_at LIMIT 10)`,
+		`DELETE FROM payments WHERE id IN (SELECT id FROM payments ORDER BY amount DESC LIMIT 20)`,
+	} {
+		if _, err := db.Pool.Exec(ctx, stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want, err := loadLedger(ctx, balanceOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := currentLedger(ctx, balanceOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, userID := range want.Members() {
+		if math.Abs(got.Balance(userID)-want.Balance(userID)) > 0.011 {
+			t.Errorf("balance of %s = %v, want %v", userID, got.Balance(userID), want.Balance(userID))
+		}
+	}
+	for _, pair := range want.Pairs() {
+		if owes := got.Owes(pair.DebtorID, pair.CreditorID); math.Abs(owes-pair.Amount) > 0.011 {
+			t.Errorf("%s owes %s %v, want %v", pair.DebtorID, pair.CreditorID, owes, pair.Amount)
+		}
+	}
+	if len(got.Pairs()) != len(want.Pairs()) {
+		t.Errorf("%d pairs, want %d", len(got.Pairs()), len(want.Pairs()))
+	}
+
+	// Rebuilding from scratch changes nothing
+	if err := db.RebuildBalances(ctx); err != nil {
+		t.Fatal(err)
+	}
+	rebuilt, err := currentLedger(ctx, balanceOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, userID := range want.Members() {
+		if rebuilt.Balance(userID) != got.Balance(userID) {
+			t.Errorf("rebuilt balance of %s = %v, want %v", userID, rebuilt.Balance(userID), got.Balance(userID))
+		}
+	}
+}
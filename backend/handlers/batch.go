@@ -0,0 +1,523 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ishushreyas/expense-tracker/db"
+	"github.com/jackc/pgx/v5"
+)
+
+// Batch modes. An atomic batch applies every operation or none of them; a
+// best-effort batch applies those that succeed and reports the rest.
+const (
+	BatchAtomic     = "atomic"
+	BatchBestEffort = "best_effort"
+)
+
+const maxBatchOperations = 500
+
+// batchOperation creates, updates or soft deletes one transaction or
+// payment. Data takes the same fields as creating the record over the
+// websocket; Version, if given, must match for updates and deletes.
+// occurred_on dates are checked against today in the caller's timezone
+// or the batch's ?tz=, as for single writes. The caller has to be a party
+// to every record they create, change or delete, before and after.
+type batchOperation struct {
+	Op      string          `json:"op"`
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Version *int            `json:"version,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// batchResult reports one operation with the HTTP status it would have
+// got on its own.
+type batchResult struct {
+	Index   int        `json:"index"`
+	Op      string     `json:"op"`
+	Type    string     `json:"type"`
+	Status  int        `json:"status"`
+	ID      *uuid.UUID `json:"id,omitempty"`
+	Version int        `json:"version,omitempty"`
+	Error   string     `json:"error,omitempty"`
+}
+
+// batchError is an operation failure with the status to report for it.
+type batchError struct {
+	status  int
+	message string
+}
+
+func (e *batchError) Error() string {
+	return e.message
+}
+
+func batchFailed(status int, format string, args ...interface{}) error {
+	return &batchError{status: status, message: fmt.Sprintf(format, args...)}
+}
+
+// BatchOperations applies a list of operations on transactions and payments
+// in one database transaction and reports each one's outcome.
+func BatchOperations(w http.ResponseWriter, r *http.Request) {
+	// Batches do many writes, so they get longer than single requests
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	var input struct {
+		Mode       string           `json:"mode"`
+		Operations []batchOperation `json:"operations"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+	if input.Mode == "" {
+		input.Mode = BatchAtomic
+	}
+	if input.Mode != BatchAtomic && input.Mode != BatchBestEffort {
+		http.Error(w, "Invalid mode, expected atomic or best_effort", http.StatusBadRequest)
+		return
+	}
+	if len(input.Operations) == 0 {
+		http.Error(w, "Operations cannot be empty", http.StatusBadRequest)
+		return
+	}
+	if len(input.Operations) > maxBatchOperations {
+		http.Error(w, fmt.Sprintf("At most %d operations are allowed per batch", maxBatchOperations), http.StatusBadRequest)
+		return
+	}
+
+	prefs, err := preferencesFor(ctx, r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	actorID := auditActor(ctx)
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		http.Error(w, "Failed to start batch: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+	if err := db.SetActor(ctx, tx, actorID); err != nil {
+		http.Error(w, "Failed to start batch: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var (
+		results   = make([]batchResult, 0, len(input.Operations))
+		events    []Event
+		failed    int
+		abandoned bool
+	)
+	for i, op := range input.Operations {
+		result := batchResult{Index: i, Op: op.Op, Type: op.Type}
+		if abandoned {
+			result.Status = http.StatusFailedDependency
+			result.Error = "not applied because an earlier operation failed"
+			results = append(results, result)
+			continue
+		}
+
+		// Each operation runs in a savepoint so a failure can be undone
+		// without losing the ones before it
+		var event *Event
+		err := pgx.BeginFunc(ctx, tx, func(sp pgx.Tx) error {
+			var err error
+			event, err = applyBatchOperation(ctx, sp, op, actorID, prefs.Location, &result)
+			return err
+		})
+		if err == nil {
+			events = append(events, *event)
+		} else {
+			var opErr *batchError
+			if errors.As(err, &opErr) {
+				result.Status = opErr.status
+				result.Error = opErr.message
+			} else if msg, ok := closedPeriod(err); ok {
+				result.Status = http.StatusConflict
+				result.Error = msg
+			} else {
+				result.Status = http.StatusInternalServerError
+				result.Error = err.Error()
+			}
+			result.ID, result.Version = nil, 0
+			failed++
+			abandoned = input.Mode == BatchAtomic
+		}
+		results = append(results, result)
+	}
+
+	applied := failed == 0 || input.Mode == BatchBestEffort
+	if !applied {
+		for i := range results {
+			if results[i].Error == "" {
+				results[i].Status = http.StatusFailedDependency
+				results[i].Error = "rolled back because another operation failed"
+				results[i].ID, results[i].Version = nil, 0
+			}
+		}
+	} else {
+		if err := tx.Commit(ctx); err != nil {
+			http.Error(w, "Failed to commit batch: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, event := range events {
+			publish(ctx, event)
+		}
+	}
+
+	status := http.StatusOK
+	if !applied {
+		status = http.StatusUnprocessableEntity
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"mode":      input.Mode,
+		"applied":   applied,
+		"succeeded": len(results) - failed,
+		"failed":    failed,
+		"results":   results,
+	})
+}
+
+// applyBatchOperation runs one operation in tx, filling in result and
+// returning the event to publish once the batch commits. Dates are
+// entered in loc.
+func applyBatchOperation(ctx context.Context, tx pgx.Tx, op batchOperation, actorID uuid.UUID, loc *time.Location, result *batchResult) (*Event, error) {
+	switch op.Type {
+	case "transaction":
+		switch op.Op {
+		case "create":
+			return batchCreateTransaction(ctx, tx, op, actorID, loc, result)
+		case "update":
+			return batchUpdateTransaction(ctx, tx, op, actorID, loc, result)
+		case "soft_delete":
+			return batchSoftDelete(ctx, tx, "transactions", op, actorID, result)
+		}
+	case "payment":
+		switch op.Op {
+		case "create":
+			return batchCreatePayment(ctx, tx, op, actorID, loc, result)
+		case "update":
+			return batchUpdatePayment(ctx, tx, op, actorID, loc, result)
+		case "soft_delete":
+			return batchSoftDelete(ctx, tx, "payments", op, actorID, result)
+		}
+	default:
+		return nil, batchFailed(http.StatusBadRequest, "unknown type %q, expected transaction or payment", op.Type)
+	}
+	return nil, batchFailed(http.StatusBadRequest, "unknown op %q, expected create, update or soft_delete", op.Op)
+}
+
+func decodeBatchData(op batchOperation, into interface{}) error {
+	if len(op.Data) == 0 {
+		return batchFailed(http.StatusBadRequest, "data is required")
+	}
+	if err := json.Unmarshal(op.Data, into); err != nil {
+		return batchFailed(http.StatusBadRequest, "invalid data: %v", err)
+	}
+	return nil
+}
+
+func batchTargetID(op batchOperation) (uuid.UUID, error) {
+	id, err := uuid.Parse(op.ID)
+	if err != nil {
+		return uuid.Nil, batchFailed(http.StatusBadRequest, "invalid id")
+	}
+	return id, nil
+}
+
+// batchParties locks the live record id in table and returns its parties:
+// the payer and the members or reciever.
+func batchParties(ctx context.Context, tx pgx.Tx, table string, id uuid.UUID) ([]uuid.UUID, error) {
+	parties := "array_prepend(payer_id, members)"
+	if table == "payments" {
+		parties = "ARRAY[payer_id, reciever_id]"
+	}
+	var ids []uuid.UUID
+	err := tx.QueryRow(ctx, "SELECT "+parties+" FROM "+table+" WHERE id = $1 AND is_deleted = false FOR UPDATE", id).Scan(&ids)
+	if err == pgx.ErrNoRows {
+		return nil, batchFailed(http.StatusNotFound, "not found or deleted")
+	}
+	return ids, err
+}
+
+// batchMissing explains why a guarded write to id in table matched no row.
+func batchMissing(ctx context.Context, tx pgx.Tx, table string, id uuid.UUID) error {
+	var version int
+	err := tx.QueryRow(ctx, "SELECT version FROM "+table+" WHERE id = $1 AND is_deleted = false", id).Scan(&version)
+	if err == pgx.ErrNoRows {
+		return batchFailed(http.StatusNotFound, "not found or deleted")
+	} else if err != nil {
+		return err
+	}
+	return batchFailed(http.StatusPreconditionFailed, "version is %d", version)
+}
+
+func batchCreateTransaction(ctx context.Context, tx pgx.Tx, op batchOperation, actorID uuid.UUID, loc *time.Location, result *batchResult) (*Event, error) {
+	var data CreateTransactionPayload
+	if err := decodeBatchData(op, &data); err != nil {
+		return nil, err
+	}
+	payerID, members, err := data.validate()
+	if err != nil {
+		return nil, batchFailed(http.StatusBadRequest, "%v", err)
+	}
+	if !isParty(actorID, append([]uuid.UUID{payerID}, members...)...) {
+		return nil, batchFailed(http.StatusForbidden, "only the payer or a member can record a transaction")
+	}
+	occurredOn, err := parseOccurredOn(data.OccurredOn, loc)
+	if err != nil {
+		return nil, batchFailed(http.StatusBadRequest, "%v", err)
+	}
+
+	transaction := db.Transaction{
+		ID:         uuid.New(),
+		PayerID:    payerID,
+		Amount:     data.Amount,
+		Members:    members,
+		Remark:     data.Remark,
+		Status:     db.DeriveTransactionStatus(payerID, members, nil),
+		OccurredOn: occurredOn,
+	}
+	err = tx.QueryRow(ctx, `
+		INSERT INTO transactions (id, payer_id, amount, members, created_at, remark, status, occurred_on)
+		VALUES ($1, $2, $3, $4, now(), $5, $6, $7)
+		RETURNING created_at, version
+	`, transaction.ID, transaction.PayerID, transaction.Amount, transaction.Members, transaction.Remark, transaction.Status, transaction.OccurredOn).
+		Scan(&transaction.CreatedAt, &result.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	result.Status = http.StatusCreated
+	result.ID = &transaction.ID
+	return &Event{
+		Topic:    TopicTransactions,
+		Type:     MessageTransactionCreated,
+		Data:     ExtendedTransaction{Transaction: transaction, Type: TransactionTypeSend},
+		Audience: append([]uuid.UUID{transaction.PayerID}, transaction.Members...),
+	}, nil
+}
+
+func batchUpdateTransaction(ctx context.Context, tx pgx.Tx, op batchOperation, actorID uuid.UUID, loc *time.Location, result *batchResult) (*Event, error) {
+	id, err := batchTargetID(op)
+	if err != nil {
+		return nil, err
+	}
+	var data CreateTransactionPayload
+	if err := decodeBatchData(op, &data); err != nil {
+		return nil, err
+	}
+	payerID, members, err := data.validate()
+	if err != nil {
+		return nil, batchFailed(http.StatusBadRequest, "%v", err)
+	}
+	occurredOn, err := batchOccurredOn(data.OccurredOn, loc)
+	if err != nil {
+		return nil, err
+	}
+	parties, err := batchParties(ctx, tx, "transactions", id)
+	if err != nil {
+		return nil, err
+	}
+	if !isParty(actorID, parties...) || !isParty(actorID, append([]uuid.UUID{payerID}, members...)...) {
+		return nil, batchFailed(http.StatusForbidden, "only the payer or a member can change a transaction, and must stay one")
+	}
+
+	// As with EditTransaction, members have to confirm the new figures
+	status := db.DeriveTransactionStatus(payerID, members, nil)
+	err = tx.QueryRow(ctx, `
+		UPDATE transactions
+		SET payer_id = $1, amount = $2, members = $3, remark = $4, status = $5,
+			occurred_on = COALESCE($8, occurred_on)
+		WHERE id = $6 AND is_deleted = false
+		AND ($7::int IS NULL OR version = $7)
+		RETURNING version
+	`, payerID, data.Amount, members, data.Remark, status, id, op.Version, occurredOn).Scan(&result.Version)
+	if err == pgx.ErrNoRows {
+		return nil, batchMissing(ctx, tx, "transactions", id)
+	} else if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM transaction_confirmations WHERE transaction_id = $1", id); err != nil {
+		return nil, err
+	}
+
+	result.Status = http.StatusOK
+	result.ID = &id
+	return &Event{
+		Topic:    TopicTransactions,
+		Type:     MessageTransactionUpdated,
+		Data:     map[string]interface{}{"id": id, "payer_id": payerID, "amount": data.Amount, "members": members, "remark": data.Remark, "status": status},
+		Audience: audienceOf(parties, []uuid.UUID{payerID}, members),
+	}, nil
+}
+
+func batchCreatePayment(ctx context.Context, tx pgx.Tx, op batchOperation, actorID uuid.UUID, loc *time.Location, result *batchResult) (*Event, error) {
+	var data CreatePaymentPayload
+	if err := decodeBatchData(op, &data); err != nil {
+		return nil, err
+	}
+	payerID, recieverID, err := data.validate()
+	if err != nil {
+		return nil, batchFailed(http.StatusBadRequest, "%v", err)
+	}
+	if !isParty(actorID, payerID, recieverID) {
+		return nil, batchFailed(http.StatusForbidden, "only the payer or the reciever can record a payment")
+	}
+	occurredOn, err := parseOccurredOn(data.OccurredOn, loc)
+	if err != nil {
+		return nil, batchFailed(http.StatusBadRequest, "%v", err)
+	}
+
+	payment := db.Payment{
+		ID:         uuid.New(),
+		PayerID:    payerID,
+		Amount:     data.Amount,
+		RecieverID: recieverID,
+		Remark:     data.Remark,
+		Status:     db.PaymentPending,
+		OccurredOn: occurredOn,
+	}
+	err = tx.QueryRow(ctx, `
+		INSERT INTO payments (id, payer_id, amount, reciever_id, created_at, remark, status, occurred_on)
+		VALUES ($1, $2, $3, $4, now(), $5, $6, $7)
+		RETURNING created_at, version
+	`, payment.ID, payment.PayerID, payment.Amount, payment.RecieverID, payment.Remark, payment.Status, payment.OccurredOn).
+		Scan(&payment.CreatedAt, &result.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	result.Status = http.StatusCreated
+	result.ID = &payment.ID
+	return &Event{
+		Topic:    TopicPayments,
+		Type:     MessagePaymentCreated,
+		Data:     payment,
+		Audience: []uuid.UUID{payment.PayerID, payment.RecieverID},
+	}, nil
+}
+
+func batchUpdatePayment(ctx context.Context, tx pgx.Tx, op batchOperation, actorID uuid.UUID, loc *time.Location, result *batchResult) (*Event, error) {
+	id, err := batchTargetID(op)
+	if err != nil {
+		return nil, err
+	}
+	var data CreatePaymentPayload
+	if err := decodeBatchData(op, &data); err != nil {
+		return nil, err
+	}
+	payerID, recieverID, err := data.validate()
+	if err != nil {
+		return nil, batchFailed(http.StatusBadRequest, "%v", err)
+	}
+	occurredOn, err := batchOccurredOn(data.OccurredOn, loc)
+	if err != nil {
+		return nil, err
+	}
+	parties, err := batchParties(ctx, tx, "payments", id)
+	if err != nil {
+		return nil, err
+	}
+	if !isParty(actorID, parties...) || !isParty(actorID, payerID, recieverID) {
+		return nil, batchFailed(http.StatusForbidden, "only the payer or the reciever can change a payment, and must stay one")
+	}
+
+	// As with EditPayment, the reciever has to confirm the new figures
+	err = tx.QueryRow(ctx, `
+		UPDATE payments
+		SET payer_id = $1, amount = $2, reciever_id = $3, remark = $4, status = $5, confirmed_at = NULL,
+			occurred_on = COALESCE($8, occurred_on)
+		WHERE id = $6 AND is_deleted = false
+		AND ($7::int IS NULL OR version = $7)
+		RETURNING version
+	`, payerID, data.Amount, recieverID, data.Remark, db.PaymentPending, id, op.Version, occurredOn).Scan(&result.Version)
+	if err == pgx.ErrNoRows {
+		return nil, batchMissing(ctx, tx, "payments", id)
+	} else if err != nil {
+		return nil, err
+	}
+
+	result.Status = http.StatusOK
+	result.ID = &id
+	return &Event{
+		Topic:    TopicPayments,
+		Type:     MessagePaymentUpdated,
+		Data:     map[string]interface{}{"id": id, "payer_id": payerID, "amount": data.Amount, "reciever_id": recieverID, "remark": data.Remark, "status": db.PaymentPending},
+		Audience: audienceOf(parties, []uuid.UUID{payerID, recieverID}),
+	}, nil
+}
+
+// batchOccurredOn parses the occurred_on of an update. Left out, the
+// record keeps its date.
+func batchOccurredOn(value string, loc *time.Location) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	date, err := parseOccurredOn(value, loc)
+	if err != nil {
+		return nil, batchFailed(http.StatusBadRequest, "%v", err)
+	}
+	return &date, nil
+}
+
+func batchSoftDelete(ctx context.Context, tx pgx.Tx, table string, op batchOperation, actorID uuid.UUID, result *batchResult) (*Event, error) {
+	id, err := batchTargetID(op)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := batchParties(ctx, tx, table, id)
+	if err != nil {
+		return nil, err
+	}
+	if !isParty(actorID, stored...) {
+		return nil, batchFailed(http.StatusForbidden, "only a party to the record can delete it")
+	}
+
+	var (
+		payerID uuid.UUID
+		parties []uuid.UUID
+	)
+	returning := "payer_id, members"
+	if table == "payments" {
+		returning = "payer_id, ARRAY[reciever_id]"
+	}
+	err = tx.QueryRow(ctx, `
+		UPDATE `+table+`
+		SET is_deleted = true,
+		    deleted_at = NOW(),
+		    deleted_by = $2
+		WHERE id = $1 AND is_deleted = false
+		AND ($3::int IS NULL OR version = $3)
+		RETURNING version, `+returning,
+		id, nullableID(actorID), op.Version).Scan(&result.Version, &payerID, &parties)
+	if err == pgx.ErrNoRows {
+		return nil, batchMissing(ctx, tx, table, id)
+	} else if err != nil {
+		return nil, err
+	}
+
+	result.Status = http.StatusOK
+	result.ID = &id
+	event := &Event{
+		Topic:    TopicTransactions,
+		Type:     MessageTransactionDeleted,
+		Data:     map[string]string{"id": id.String()},
+		Audience: append([]uuid.UUID{payerID}, parties...),
+	}
+	if table == "payments" {
+		event.Topic, event.Type = TopicPayments, MessagePaymentDeleted
+	}
+	return event, nil
+}
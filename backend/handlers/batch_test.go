@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/ishushreyas/expense-tracker/db"
+)
+
+func TestBatchModes(t *testing.T) {
+	testDatabase(t)
+	ctx := context.Background()
+
+	alice, bob, carol := uuid.New(), uuid.New(), uuid.New()
+	_, err := db.Pool.Exec(ctx, `
+		INSERT INTO users (id, username, email)
+		VALUES ($1, 'alice', 'alice@example.com'), ($2, 'bob', 'bob@example.com'), ($3, 'carol', 'carol@example.com')
+	`, alice, bob, carol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	existing, others := uuid.New(), uuid.New()
+	_, err = db.Pool.Exec(ctx, `
+		INSERT INTO transactions (id, payer_id, amount, members, remark)
+		VALUES ($1, $2, 10, $3, 'ours'), ($4, $5, 10, $6, 'theirs')
+	`, existing, alice, []uuid.UUID{bob}, others, bob, []uuid.UUID{carol})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	operations := fmt.Sprintf(`[
+		{"op": "create", "type": "transaction", "data": {"payer_id": %[1]q, "amount": 5, "members": [%[2]q]}},
+		{"op": "update", "type": "transaction", "id": %[3]q, "data": {"payer_id": %[1]q, "amount": 20, "members": [%[2]q]}},
+		{"op": "soft_delete", "type": "transaction", "id": %[4]q},
+		{"op": "create", "type": "payment", "data": {"payer_id": %[2]q, "amount": 5, "reciever_id": %[5]q}}
+	]`, alice, bob, existing, others, carol)
+
+	for _, tc := range []struct {
+		mode         string
+		status       int
+		applied      bool
+		results      []int
+		transactions int
+		amount       float64
+	}{
+		// The delete and the payment are someone else's, so nothing is applied
+		{BatchAtomic, http.StatusUnprocessableEntity, false,
+			[]int{http.StatusFailedDependency, http.StatusFailedDependency, http.StatusForbidden, http.StatusFailedDependency}, 2, 10},
+		{BatchBestEffort, http.StatusOK, true,
+			[]int{http.StatusCreated, http.StatusOK, http.StatusForbidden, http.StatusForbidden}, 3, 20},
+	} {
+		r := httptest.NewRequest("POST", "/batch", strings.NewReader(`{"mode": "`+tc.mode+`", "operations": `+operations+`}`))
+		w := httptest.NewRecorder()
+		BatchOperations(w, asUser(r, "alice@example.com"))
+		if w.Code != tc.status {
+			t.Fatalf("%s: status = %d, want %d: %s", tc.mode, w.Code, tc.status, w.Body.String())
+		}
+
+		var response struct {
+			Applied bool          `json:"applied"`
+			Results []batchResult `json:"results"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		if response.Applied != tc.applied {
+			t.Errorf("%s: applied = %v, want %v", tc.mode, response.Applied, tc.applied)
+		}
+		if len(response.Results) != len(tc.results) {
+			t.Fatalf("%s: %d results, want %d", tc.mode, len(response.Results), len(tc.results))
+		}
+		for i, want := range tc.results {
+			if got := response.Results[i].Status; got != want {
+				t.Errorf("%s: operation %d status = %d, want %d (%s)", tc.mode, i, got, want, response.Results[i].Error)
+			}
+		}
+
+		var (
+			transactions, payments int
+			amount                 float64
+			othersDeleted          bool
+		)
+		err := db.Pool.QueryRow(ctx, `
+			SELECT (SELECT COUNT(*) FROM transactions), (SELECT COUNT(*) FROM payments),
+				(SELECT amount FROM transactions WHERE id = $1), (SELECT is_deleted FROM transactions WHERE id = $2)
+		`, existing, others).Scan(&transactions, &payments, &amount, &othersDeleted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if transactions != tc.transactions || amount != tc.amount {
+			t.Errorf("%s: %d transactions with ours at %v, want %d at %v", tc.mode, transactions, amount, tc.transactions, tc.amount)
+		}
+		if payments != 0 || othersDeleted {
+			t.Errorf("%s: %d payments and theirs deleted %v, want neither", tc.mode, payments, othersDeleted)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Transactions and payments record the day they happened as occurred_on,
+// a plain calendar date in whoever entered them's timezone. It is what
+// date filters, trends and statements go by; created_at only says when
+// the record was entered.
+
+// today is the current date in loc, as midnight UTC like dates read from
+// the database.
+func today(loc *time.Location) time.Time {
+	now := time.Now().In(loc)
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// parseOccurredOn reads a YYYY-MM-DD occurred_on, which may not be later
+// than today in loc. An empty value means today.
+func parseOccurredOn(value string, loc *time.Location) (time.Time, error) {
+	if value == "" {
+		return today(loc), nil
+	}
+	date, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, errors.New("Invalid occurred_on, expected YYYY-MM-DD")
+	}
+	if date.After(today(loc)) {
+		return time.Time{}, errors.New("occurred_on cannot be in the future")
+	}
+	return date, nil
+}
+
+// occurredOnFor parses an occurred_on entered by userID, in their
+// timezone. Unknown users and timezones fall back to UTC.
+func occurredOnFor(ctx context.Context, userID uuid.UUID, value string) (time.Time, error) {
+	loc := time.UTC
+	if prefs, err := loadPreferences(ctx, userID); err == nil {
+		if userLoc, err := loadTimezone(prefs.Timezone); err == nil {
+			loc = userLoc
+		}
+	}
+	return parseOccurredOn(value, loc)
+}
@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ishushreyas/expense-tracker/db"
+	"github.com/jackc/pgx/v5"
+)
+
+// Transactions and payments carry a version number that goes up with every
+// change (see the keep_*_version triggers). It is served as the ETag of the
+// record, and writes sent with If-Match only apply to the versions listed.
+// If-Match is optional: writes without it apply to the current version, so
+// those clients get no protection against lost updates.
+
+func versionETag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// ifMatchVersions returns the versions an If-Match header allows, or nil
+// when any version will do because the header is absent or "*". Tags that
+// are not one of our versions can never match.
+func ifMatchVersions(r *http.Request) []int {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" || header == "*" {
+		return nil
+	}
+
+	versions := []int{}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		version, err := strconv.Atoi(strings.Trim(tag, `"`))
+		if err == nil {
+			versions = append(versions, version)
+		}
+	}
+	return versions
+}
+
+// writeVersionMismatch answers a write guarded by If-Match that matched no
+// row: 412 with the current ETag if the record is there at another version,
+// or 404 if it is not there at all. live limits the lookup to records that
+// are not soft deleted.
+func writeVersionMismatch(ctx context.Context, w http.ResponseWriter, table, id string, live bool, notFound string) {
+	query := "SELECT version FROM " + table + " WHERE id = $1"
+	if live {
+		query += " AND is_deleted = false"
+	}
+
+	var version int
+	err := db.Pool.QueryRow(ctx, query, id).Scan(&version)
+	if err == pgx.ErrNoRows {
+		http.Error(w, notFound, http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to retrieve current version: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("ETag", versionETag(version))
+	http.Error(w, "Precondition failed: record has changed since it was read", http.StatusPreconditionFailed)
+}
@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/ishushreyas/expense-tracker/db"
+)
+
+func TestIfMatchVersions(t *testing.T) {
+	for _, tc := range []struct {
+		header string
+		want   []int
+	}{
+		{"", nil},
+		{"*", nil},
+		{` * `, nil},
+		{`"3"`, []int{3}},
+		{`W/"3", "5"`, []int{3, 5}},
+		{`"abc"`, []int{}},
+	} {
+		r := httptest.NewRequest("PUT", "/transactions/x", nil)
+		if tc.header != "" {
+			r.Header.Set("If-Match", tc.header)
+		}
+		if got := ifMatchVersions(r); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("If-Match %q: %#v, want %#v", tc.header, got, tc.want)
+		}
+	}
+}
+
+func TestIfMatchGuardsWrites(t *testing.T) {
+	testDatabase(t)
+	ctx := context.Background()
+
+	alice, bob := uuid.New(), uuid.New()
+	_, err := db.Pool.Exec(ctx, `
+		INSERT INTO users (id, username, email)
+		VALUES ($1, 'alice', 'alice@example.com'), ($2, 'bob', 'bob@example.com')
+	`, alice, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, kind := range []struct {
+		name   string
+		insert string
+		body   string
+		edit   http.HandlerFunc
+		delete http.HandlerFunc
+	}{
+		{
+			"transaction",
+			`INSERT INTO transactions (id, payer_id, amount, members) VALUES ($1, $2, 10, ARRAY[$3::uuid])`,
+			`{"id": %q, "payer_id": %q, "amount": %d, "members": [%q]}`,
+			EditTransaction, DeleteTransaction,
+		},
+		{
+			"payment",
+			`INSERT INTO payments (id, payer_id, amount, reciever_id) VALUES ($1, $2, 10, $3)`,
+			`{"id": %q, "payer_id": %q, "amount": %d, "reciever_id": %q}`,
+			EditPayment, DeletePayment,
+		},
+	} {
+		id := uuid.New()
+		if _, err := db.Pool.Exec(ctx, kind.insert, id, alice, bob); err != nil {
+			t.Fatal(err)
+		}
+
+		// Each edit changes the amount, since an edit that changes nothing
+		// keeps the version
+		amount := 10
+		write := func(handler http.HandlerFunc, method, ifMatch string) *httptest.ResponseRecorder {
+			amount++
+			r := httptest.NewRequest(method, "/"+kind.name+"s/"+id.String(), strings.NewReader(fmt.Sprintf(kind.body, id, alice, amount, bob)))
+			if ifMatch != "" {
+				r.Header.Set("If-Match", ifMatch)
+			}
+			r = mux.SetURLVars(asUser(r, "alice@example.com"), map[string]string{"id": id.String()})
+			w := httptest.NewRecorder()
+			handler(w, r)
+			return w
+		}
+
+		for _, step := range []struct {
+			what    string
+			handler http.HandlerFunc
+			method  string
+			ifMatch string
+			status  int
+			etag    string
+		}{
+			{"stale edit", kind.edit, "PUT", `"7"`, http.StatusPreconditionFailed, `"1"`},
+			{"current edit", kind.edit, "PUT", `"1"`, http.StatusOK, `"2"`},
+			{"edit without If-Match", kind.edit, "PUT", "", http.StatusOK, `"3"`},
+			{"edit with *", kind.edit, "PUT", "*", http.StatusOK, `"4"`},
+			{"stale delete", kind.delete, "DELETE", `"1", "2"`, http.StatusPreconditionFailed, `"4"`},
+			{"delete with *", kind.delete, "DELETE", "*", http.StatusOK, ""},
+			{"edit of a missing record", kind.edit, "PUT", `"4"`, http.StatusNotFound, ""},
+			{"delete of a missing record", kind.delete, "DELETE", `"4"`, http.StatusNotFound, ""},
+		} {
+			w := write(step.handler, step.method, step.ifMatch)
+			if w.Code != step.status {
+				t.Errorf("%s %s: status = %d, want %d: %s", kind.name, step.what, w.Code, step.status, w.Body.String())
+			}
+			if etag := w.Header().Get("ETag"); etag != step.etag {
+				t.Errorf("%s %s: ETag = %s, want %s", kind.name, step.what, etag, step.etag)
+			}
+		}
+
+		// Without If-Match a delete applies to whatever version is current
+		other := uuid.New()
+		if _, err := db.Pool.Exec(ctx, kind.insert, other, alice, bob); err != nil {
+			t.Fatal(err)
+		}
+		r := mux.SetURLVars(httptest.NewRequest("DELETE", "/"+kind.name+"s/"+other.String(), nil), map[string]string{"id": other.String()})
+		w := httptest.NewRecorder()
+		kind.delete(w, asUser(r, "alice@example.com"))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s delete without If-Match: status = %d, want %d: %s", kind.name, w.Code, http.StatusOK, w.Body.String())
+		}
+	}
+}
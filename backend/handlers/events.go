@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ishushreyas/expense-tracker/db"
+)
+
+const (
+	sseHeartbeat   = 25 * time.Second
+	sseReplayBatch = 200
+)
+
+// EventRetention is how long events stay in the log for clients resuming
+// with Last-Event-ID. A client that was away longer only gets what is left.
+var EventRetention = 7 * 24 * time.Hour
+
+// sseClient is an /events stream registered with the realtime hub.
+type sseClient struct {
+	userID  uuid.UUID
+	topics  map[string]bool
+	send    chan Envelope
+	dropped chan struct{}
+	once    sync.Once
+}
+
+func (c *sseClient) wants(event Event) bool {
+	return c.topics[event.Topic] && event.canSee(c.userID)
+}
+
+func (c *sseClient) offer(env Envelope) bool {
+	select {
+	case c.send <- env:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *sseClient) drop() {
+	c.once.Do(func() { close(c.dropped) })
+}
+
+// writeSSE writes one event in text/event-stream framing.
+func writeSSE(w http.ResponseWriter, id int64, eventType string, data []byte) error {
+	var b strings.Builder
+	if id > 0 {
+		fmt.Fprintf(&b, "id: %d\n", id)
+	}
+	fmt.Fprintf(&b, "event: %s\n", eventType)
+	for _, line := range strings.Split(string(data), "\n") {
+		fmt.Fprintf(&b, "data: %s\n", line)
+	}
+	b.WriteString("\n")
+	_, err := w.Write([]byte(b.String()))
+	return err
+}
+
+// HandleEventStream serves the realtime events as Server-Sent Events for
+// clients that cannot hold a WebSocket open. Topics are chosen with
+// ?topics=transactions,payments and a reconnecting client resumes after the
+// Last-Event-ID header (or ?last_event_id=) from the persisted event log.
+func (s *WebSocketServer) HandleEventStream(w http.ResponseWriter, r *http.Request) {
+	userID, err := sessionUserID(r.Context())
+	if err != nil {
+		http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	topics := allTopics
+	if topicsParam := r.URL.Query().Get("topics"); topicsParam != "" {
+		topics = strings.Split(topicsParam, ",")
+		if err := (SubscribePayload{Topics: topics}).validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	var afterID int64
+	if lastEventID != "" {
+		afterID, err = strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil || afterID < 0 {
+			http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	client := &sseClient{
+		userID:  userID,
+		topics:  make(map[string]bool),
+		send:    make(chan Envelope, 64),
+		dropped: make(chan struct{}),
+	}
+	for _, topic := range topics {
+		client.topics[topic] = true
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// Stop nginx from buffering the stream behind the /api/ proxy
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 3000\n\n")
+	flusher.Flush()
+
+	ctx := r.Context()
+	// replay writes the logged events after afterID, a page at a time
+	replay := func() bool {
+		for {
+			events, err := db.EventsSince(ctx, afterID, userID, topics, sseReplayBatch)
+			if err != nil {
+				writeSSE(w, 0, string(MessageError), []byte(`{"code":"`+ErrCodeInternal+`","message":"Failed to replay events"}`))
+				flusher.Flush()
+				return false
+			}
+			for _, event := range events {
+				if err := writeSSE(w, event.ID, event.Type, event.Payload); err != nil {
+					return false
+				}
+				afterID = event.ID
+			}
+			flusher.Flush()
+			if len(events) < sseReplayBatch {
+				return true
+			}
+		}
+	}
+
+	// Catch up before registering, so a long replay can't fill the send
+	// buffer and get the client dropped as a slow consumer. Whatever was
+	// published meanwhile is replayed once registered; anything seen then
+	// is skipped when it also arrives live.
+	if afterID > 0 && !replay() {
+		return
+	}
+	s.register <- client
+	defer func() { s.unregister <- client }()
+	if afterID > 0 && !replay() {
+		return
+	}
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case env := <-client.send:
+			if env.EventID != 0 && env.EventID <= afterID {
+				continue
+			}
+			if err := writeSSE(w, env.EventID, string(env.Type), env.Payload); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-client.dropped:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// RunEventPurge deletes events older than retention from the log,
+// checking every interval.
+func RunEventPurge(ctx context.Context, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := db.PruneEvents(ctx, time.Now().Add(-retention)); err != nil {
+			log.Printf("Error purging events: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ishushreyas/expense-tracker/db"
+)
+
+// listFilter collects the conditions of a list query's WHERE clause with
+// their arguments, so values from the query string are always passed as
+// parameters.
+type listFilter struct {
+	conds []string
+	args  []interface{}
+}
+
+// add appends a condition, each ? in which stands for arg.
+func (f *listFilter) add(cond string, arg interface{}) {
+	f.args = append(f.args, arg)
+	f.conds = append(f.conds, strings.ReplaceAll(cond, "?", "$"+strconv.Itoa(len(f.args))))
+}
+
+// where renders the WHERE clause.
+func (f *listFilter) where() string {
+	if len(f.conds) == 0 {
+		return " WHERE true"
+	}
+	return " WHERE " + strings.Join(f.conds, " AND ")
+}
+
+// nextArg is the number of the next free placeholder.
+func (f *listFilter) nextArg() int {
+	return len(f.args) + 1
+}
+
+// ledgerSorts are the orders transaction and payment lists can be sorted in.
+var ledgerSorts = map[string]sortKey{
+	"date":    {Expr: "occurred_on", Type: "date"},
+	"created": {Expr: "created_at", Type: "timestamptz"},
+	"amount":  {Expr: "amount", Type: "double precision"},
+	"payer":   {Expr: "COALESCE((SELECT u.username FROM users u WHERE u.id = payer_id), '')", Type: "text"},
+}
+
+// ledgerStatuses are the statuses each ledger table's records can have.
+var ledgerStatuses = map[string][]string{
+	"transactions": {db.TransactionPending, db.TransactionConfirmed, db.TransactionDisputed, db.TransactionRejected},
+	"payments":     {db.PaymentPending, db.PaymentConfirmed, db.PaymentRejected},
+}
+
+// ledgerFilter reads the filters shared by the transaction and payment
+// lists: payer_id, member_id (anyone involved, as matched by memberCond),
+// tag (repeatable, all must be present on the record of kind t), status
+// (one of ledgerStatuses), start_date and end_date (YYYY-MM-DD, both
+// inclusive), min_amount and max_amount, remark (a case-insensitive
+// substring) and deleted (true, false or all; false by default). Dates
+// are matched against occurred_on.
+func ledgerFilter(query url.Values, memberCond string, t taggable) (*listFilter, error) {
+	f := &listFilter{}
+
+	switch deleted := query.Get("deleted"); deleted {
+	case "", "false":
+		f.add("is_deleted = ?", false)
+	case "true":
+		f.add("is_deleted = ?", true)
+	case "all":
+	default:
+		return nil, fmt.Errorf("Invalid deleted %q, expected true, false or all", deleted)
+	}
+
+	if err := f.addUUID(query, "payer_id", "payer_id = ?"); err != nil {
+		return nil, err
+	}
+	if err := f.addUUID(query, "member_id", memberCond); err != nil {
+		return nil, err
+	}
+
+	for _, tag := range query["tag"] {
+		name, err := normalizeTag(tag)
+		if err != nil {
+			return nil, err
+		}
+		f.add(t.tagsCond(), name)
+	}
+
+	if status := query.Get("status"); status != "" {
+		statuses := ledgerStatuses[t.Table]
+		if !contains(statuses, status) {
+			return nil, fmt.Errorf("Invalid status, expected one of %s", strings.Join(statuses, ", "))
+		}
+		f.add("status = ?", status)
+	}
+
+	if startDate := query.Get("start_date"); startDate != "" {
+		parsedDate, err := time.Parse("2006-01-02", startDate)
+		if err != nil {
+			return nil, errors.New("Invalid start_date, expected YYYY-MM-DD")
+		}
+		f.add("occurred_on >= ?", parsedDate)
+	}
+	if endDate := query.Get("end_date"); endDate != "" {
+		parsedDate, err := time.Parse("2006-01-02", endDate)
+		if err != nil {
+			return nil, errors.New("Invalid end_date, expected YYYY-MM-DD")
+		}
+		f.add("occurred_on <= ?", parsedDate)
+	}
+
+	if minAmount := query.Get("min_amount"); minAmount != "" {
+		amount, err := strconv.ParseFloat(minAmount, 64)
+		if err != nil {
+			return nil, errors.New("Invalid min_amount")
+		}
+		f.add("amount >= ?", amount)
+	}
+	if maxAmount := query.Get("max_amount"); maxAmount != "" {
+		amount, err := strconv.ParseFloat(maxAmount, 64)
+		if err != nil {
+			return nil, errors.New("Invalid max_amount")
+		}
+		f.add("amount <= ?", amount)
+	}
+
+	if remark := query.Get("remark"); remark != "" {
+		f.add("remark ILIKE ?", "%"+escapeLike(remark)+"%")
+	}
+
+	return f, nil
+}
+
+// addUUID filters on the ID in query parameter param, if there is one.
+func (f *listFilter) addUUID(query url.Values, param, cond string) error {
+	value := query.Get(param)
+	if value == "" {
+		return nil
+	}
+	id, err := uuid.Parse(value)
+	if err != nil {
+		return fmt.Errorf("Invalid %s", param)
+	}
+	f.add(cond, id)
+	return nil
+}
+
+// escapeLike makes s match literally in a LIKE pattern.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
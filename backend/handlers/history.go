@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/ishushreyas/expense-tracker/db"
+)
+
+// HistoryEntry is an audit log entry with the actor's name and the fields
+// the change touched.
+type HistoryEntry struct {
+	db.AuditEntry
+	ActorName string   `json:"actor_name,omitempty"`
+	Changed   []string `json:"changed"`
+}
+
+// changedFields lists the top-level fields that differ between two row
+// snapshots. Bookkeeping columns the database maintains itself are left out.
+func changedFields(before, after json.RawMessage) []string {
+	var prev, next map[string]json.RawMessage
+	json.Unmarshal(before, &prev)
+	json.Unmarshal(after, &next)
+
+	fields := []string{}
+	seen := make(map[string]bool)
+	for _, snapshot := range []map[string]json.RawMessage{prev, next} {
+		for field := range snapshot {
+			if seen[field] || field == "updated_at" {
+				continue
+			}
+			seen[field] = true
+			if !bytes.Equal(prev[field], next[field]) {
+				fields = append(fields, field)
+			}
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// entityHistory loads an entity's audit log with actor names filled in.
+func entityHistory(ctx context.Context, entityType, entityID string) ([]HistoryEntry, error) {
+	entries, err := db.EntityHistory(ctx, entityType, entityID)
+	if err != nil {
+		return nil, err
+	}
+	names, err := loadUsernames(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	history := make([]HistoryEntry, 0, len(entries))
+	for _, entry := range entries {
+		h := HistoryEntry{AuditEntry: entry, Changed: changedFields(entry.Before, entry.After)}
+		if entry.ActorID != nil {
+			h.ActorName = names[*entry.ActorID]
+		}
+		history = append(history, h)
+	}
+	return history, nil
+}
+
+// GetTransactionHistory lists every recorded change to a transaction, oldest
+// first, including its creation and any deletion.
+func GetTransactionHistory(w http.ResponseWriter, r *http.Request) {
+	// Create context with timeout
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	transactionID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid transaction ID format", http.StatusBadRequest)
+		return
+	}
+
+	history, err := entityHistory(ctx, "transaction", transactionID.String())
+	if err != nil {
+		http.Error(w, "Failed to retrieve history: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(history) == 0 {
+		http.Error(w, "No history for transaction", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":      transactionID,
+		"history": history,
+	})
+}
@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ishushreyas/expense-tracker/db"
+	"github.com/jackc/pgx/v5"
+)
+
+// IdempotencyRetention is how long a response is kept for replay to
+// requests repeating its Idempotency-Key.
+var IdempotencyRetention = 24 * time.Hour
+
+// maxIdempotentBody is the largest request body Idempotent reads to hash,
+// enough for a story upload.
+const maxIdempotentBody = 11 << 20
+
+// recordingWriter passes a response through while keeping a copy of it.
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// Idempotent lets clients retry a create safely. The first request carrying
+// an Idempotency-Key header runs as usual and its response is stored; a
+// retry with the same key and body gets that response again instead of
+// creating a second record, a retry with a different body is rejected, and
+// one arriving while the first is still running is told to try later.
+// Keys are per user, so two users can't see each other's responses;
+// anonymous requests share one scope. Requests without the header are
+// unaffected.
+func Idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentBody))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(body)
+		hash := hex.EncodeToString(sum[:])
+		scope := idempotencyScope(r, auditActor(r.Context()))
+
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		defer cancel()
+
+		// Claim the key, taking over one whose retention has run out or
+		// whose first request died without finishing
+		var claimed bool
+		err = db.Pool.QueryRow(ctx, `
+			INSERT INTO idempotency_keys (scope, key, request_hash)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (scope, key) DO UPDATE
+			SET request_hash = EXCLUDED.request_hash, status_code = NULL, headers = NULL,
+			    body = NULL, created_at = now(), completed_at = NULL
+			WHERE idempotency_keys.created_at < $4
+			OR (idempotency_keys.completed_at IS NULL AND idempotency_keys.created_at < now() - interval '1 minute')
+			RETURNING true
+		`, scope, key, hash, time.Now().Add(-IdempotencyRetention)).Scan(&claimed)
+		if err == pgx.ErrNoRows {
+			replayResponse(ctx, w, scope, key, hash)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to record idempotency key: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		recorder := &recordingWriter{ResponseWriter: w}
+		next(recorder, r)
+
+		// The handler may have used up the request's deadline, so save
+		// the outcome with a fresh one
+		saveCtx, saveCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer saveCancel()
+
+		// Server errors may be transient, so let the client try again
+		if recorder.status == 0 || recorder.status >= 500 {
+			if _, err := db.Pool.Exec(saveCtx, "DELETE FROM idempotency_keys WHERE scope = $1 AND key = $2", scope, key); err != nil {
+				log.Printf("Error releasing idempotency key %q: %v", key, err)
+			}
+			return
+		}
+
+		headers, _ := json.Marshal(recorder.Header())
+		_, err = db.Pool.Exec(saveCtx, `
+			UPDATE idempotency_keys
+			SET status_code = $3, headers = $4, body = $5, completed_at = now()
+			WHERE scope = $1 AND key = $2
+		`, scope, key, recorder.status, headers, recorder.body.Bytes())
+		if err != nil {
+			log.Printf("Error storing response for idempotency key %q: %v", key, err)
+		}
+	}
+}
+
+// idempotencyScope is what an Idempotency-Key is unique within: the
+// endpoint and the user calling it, uuid.Nil for anonymous callers.
+func idempotencyScope(r *http.Request, userID uuid.UUID) string {
+	return userID.String() + " " + r.Method + " " + r.URL.Path
+}
+
+// replayResponse answers a request whose Idempotency-Key is already taken.
+func replayResponse(ctx context.Context, w http.ResponseWriter, scope, key, hash string) {
+	var (
+		requestHash string
+		status      *int
+		headers     []byte
+		body        []byte
+	)
+	err := db.Pool.QueryRow(ctx, `
+		SELECT request_hash, status_code, headers, body
+		FROM idempotency_keys
+		WHERE scope = $1 AND key = $2
+	`, scope, key).Scan(&requestHash, &status, &headers, &body)
+	if err == pgx.ErrNoRows {
+		// Released by a failed first attempt between our claim and now
+		http.Error(w, "Request with this Idempotency-Key failed, retry it", http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to retrieve idempotency key: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if requestHash != hash {
+		http.Error(w, "Idempotency-Key was already used for a different request", http.StatusUnprocessableEntity)
+		return
+	}
+	if status == nil {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Request with this Idempotency-Key is still in progress", http.StatusConflict)
+		return
+	}
+
+	var stored http.Header
+	json.Unmarshal(headers, &stored)
+	for name, values := range stored {
+		w.Header()[name] = values
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(*status)
+	w.Write(body)
+}
+
+// RunIdempotencyKeyPurge deletes stored responses older than retention,
+// checking every interval.
+func RunIdempotencyKeyPurge(ctx context.Context, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		_, err := db.Pool.Exec(ctx, "DELETE FROM idempotency_keys WHERE created_at < $1", time.Now().Add(-retention))
+		if err != nil {
+			log.Printf("Error purging idempotency keys: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
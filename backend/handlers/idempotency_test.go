@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"firebase.google.com/go/auth"
+	"github.com/google/uuid"
+	"github.com/ishushreyas/expense-tracker/db"
+)
+
+// asUser attaches a session for email to r, as verifySessionMiddleware does.
+func asUser(r *http.Request, email string) *http.Request {
+	token := &auth.Token{Claims: map[string]interface{}{"email": email}}
+	return r.WithContext(context.WithValue(r.Context(), "user", token))
+}
+
+func TestIdempotencyScopeIsPerUser(t *testing.T) {
+	r := httptest.NewRequest("POST", "/transactions", nil)
+	if idempotencyScope(r, uuid.New()) == idempotencyScope(r, uuid.New()) {
+		t.Error("two users share an idempotency scope")
+	}
+}
+
+func TestIdempotentRejectsLargeBodies(t *testing.T) {
+	handler := Idempotent(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("handler ran for an oversized body")
+	})
+	r := httptest.NewRequest("POST", "/stories", strings.NewReader(strings.Repeat("x", maxIdempotentBody+1)))
+	r.Header.Set("Idempotency-Key", "big")
+	w := httptest.NewRecorder()
+	handler(w, r)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestIdempotencyKeysStayPerUser(t *testing.T) {
+	testDatabase(t)
+	ctx := context.Background()
+
+	alice, bob := uuid.New(), uuid.New()
+	_, err := db.Pool.Exec(ctx, `
+		INSERT INTO users (id, username, email)
+		VALUES ($1, 'alice', 'alice@example.com'), ($2, 'bob', 'bob@example.com')
+	`, alice, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	calls := 0
+	handler := Idempotent(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		userID, _ := sessionUserID(r.Context())
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(userID.String()))
+	})
+	send := func(email string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/transactions", strings.NewReader(`{"amount":10}`))
+		r.Header.Set("Idempotency-Key", "same-key")
+		w := httptest.NewRecorder()
+		handler(w, asUser(r, email))
+		return w
+	}
+
+	for _, tc := range []struct {
+		email    string
+		want     uuid.UUID
+		replayed bool
+	}{
+		{"alice@example.com", alice, false},
+		{"bob@example.com", bob, false},
+		{"alice@example.com", alice, true},
+		{"bob@example.com", bob, true},
+	} {
+		w := send(tc.email)
+		if w.Code != http.StatusCreated || w.Body.String() != tc.want.String() {
+			t.Errorf("%s got %d %q, want %d %q", tc.email, w.Code, w.Body.String(), http.StatusCreated, tc.want)
+		}
+		if replayed := w.Header().Get("Idempotent-Replayed") == "true"; replayed != tc.replayed {
+			t.Errorf("%s replayed = %v, want %v", tc.email, replayed, tc.replayed)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("handler ran %d times, want 2", calls)
+	}
+}
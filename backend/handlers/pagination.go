@@ -0,0 +1,247 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ishushreyas/expense-tracker/db"
+)
+
+// Lists are paged by keyset rather than offset, so pages stay put when new
+// rows arrive. A cursor names the row a page starts after (?after=) or ends
+// before (?before=) by its sort value and id; clients get them from
+// next_cursor/prev_cursor or the Link header and treat them as opaque.
+// ?sort= picks the order, newest first by default, with a leading "-" for
+// descending. ?include_total=true also counts every matching row.
+
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+)
+
+// sortKey is an expression a list can be ordered by and the SQL type its
+// text form is read back as in a cursor.
+type sortKey struct {
+	Expr string
+	Type string
+}
+
+type cursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    string `json:"id"`
+}
+
+func (c cursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(value string) (*cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, errors.New("Invalid cursor")
+	}
+	var c cursor
+	if err := json.Unmarshal(data, &c); err != nil || c.ID == "" {
+		return nil, errors.New("Invalid cursor")
+	}
+	return &c, nil
+}
+
+type pageRequest struct {
+	Limit        int
+	After        *cursor
+	Before       *cursor
+	IncludeTotal bool
+	Sort         string
+	Desc         bool
+	key          sortKey
+}
+
+// pageRequestFromQuery reads the paging and sort parameters of a list
+// ordered by one of sorts, defaultSort when none is asked for.
+func pageRequestFromQuery(query url.Values, sorts map[string]sortKey, defaultSort string) (pageRequest, error) {
+	page := pageRequest{Limit: defaultPageLimit, IncludeTotal: query.Get("include_total") == "true"}
+	if limitStr := query.Get("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 || limit > maxPageLimit {
+			return page, fmt.Errorf("Invalid limit, expected 1 to %d", maxPageLimit)
+		}
+		page.Limit = limit
+	}
+
+	page.Sort = query.Get("sort")
+	if page.Sort == "" {
+		page.Sort = defaultSort
+	}
+	name := strings.TrimPrefix(page.Sort, "-")
+	key, ok := sorts[name]
+	if !ok {
+		names := make([]string, 0, len(sorts))
+		for n := range sorts {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return page, fmt.Errorf("Invalid sort, expected one of %s, optionally prefixed with -", strings.Join(names, ", "))
+	}
+	page.key, page.Desc = key, name != page.Sort
+
+	var err error
+	if after := query.Get("after"); after != "" {
+		if page.After, err = decodeCursor(after); err != nil {
+			return page, err
+		}
+	}
+	if before := query.Get("before"); before != "" {
+		if page.Before, err = decodeCursor(before); err != nil {
+			return page, err
+		}
+	}
+	if page.After != nil && page.Before != nil {
+		return page, errors.New("Use either after or before, not both")
+	}
+	for _, c := range []*cursor{page.After, page.Before} {
+		if c != nil && c.Sort != page.Sort {
+			return page, errors.New("Cursor belongs to a different sort")
+		}
+	}
+	return page, nil
+}
+
+// sortColumn selects the sort value for building cursors, as sort_key.
+func (p pageRequest) sortColumn() string {
+	return "(" + p.key.Expr + ")::text AS sort_key"
+}
+
+// keyset appends the cursor condition and ordering to a WHERE clause,
+// numbering placeholders from argCount, with idColumn breaking ties. It
+// fetches one row more than the limit to tell whether another page
+// follows. idArg converts the cursor's ID for the query.
+func (p pageRequest) keyset(idColumn string, argCount int, idArg func(string) (interface{}, error)) (string, []interface{}, error) {
+	var (
+		sql  string
+		args []interface{}
+	)
+	// Paging backwards walks the list in reverse and pageOf flips it back
+	c, backward := p.After, false
+	if p.Before != nil {
+		c, backward = p.Before, true
+	}
+	op, order := ">", "ASC"
+	if p.Desc != backward {
+		op, order = "<", "DESC"
+	}
+	if c != nil {
+		id, err := idArg(c.ID)
+		if err != nil {
+			return "", nil, errors.New("Invalid cursor")
+		}
+		sql += fmt.Sprintf(" AND ((%s), %s) %s ($%d::%s, $%d)", p.key.Expr, idColumn, op, argCount, p.key.Type, argCount+1)
+		args = append(args, c.Value, id)
+		argCount += 2
+	}
+	sql += fmt.Sprintf(" ORDER BY (%s) %s, %s %s LIMIT $%d", p.key.Expr, order, idColumn, order, argCount)
+	args = append(args, p.Limit+1)
+	return sql, args, nil
+}
+
+func stringID(id string) (interface{}, error) {
+	return id, nil
+}
+
+func int64ID(id string) (interface{}, error) {
+	return strconv.ParseInt(id, 10, 64)
+}
+
+// countRows counts the rows of from, a table and its WHERE clause, for
+// ?include_total=true.
+func countRows(ctx context.Context, from string, args []interface{}) (*int, error) {
+	var total int
+	if err := db.Pool.QueryRow(ctx, "SELECT COUNT(*) FROM "+from, args...).Scan(&total); err != nil {
+		return nil, err
+	}
+	return &total, nil
+}
+
+// pageOf trims the extra row keyset fetched, restores the requested order
+// and works out the cursors for the neighbouring pages. key gives a row's
+// sort value and id.
+func pageOf[T any](items []T, p pageRequest, key func(T) (string, string)) (page []T, next, prev *cursor) {
+	more := len(items) > p.Limit
+	if more {
+		items = items[:p.Limit]
+	}
+	if p.Before != nil {
+		for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+			items[i], items[j] = items[j], items[i]
+		}
+	}
+	if len(items) == 0 {
+		return items, nil, nil
+	}
+
+	at := func(item T) *cursor {
+		value, id := key(item)
+		return &cursor{Sort: p.Sort, Value: value, ID: id}
+	}
+	first, last := at(items[0]), at(items[len(items)-1])
+	if p.Before != nil {
+		next = last
+		if more {
+			prev = first
+		}
+	} else {
+		if more {
+			next = last
+		}
+		if p.After != nil {
+			prev = first
+		}
+	}
+	return items, next, prev
+}
+
+// writePageLinks sets an RFC 5988 Link header pointing at the neighbouring
+// pages and returns the fields to add to the response body.
+func writePageLinks(w http.ResponseWriter, r *http.Request, p pageRequest, next, prev *cursor, total *int) map[string]interface{} {
+	fields := map[string]interface{}{
+		"limit":       p.Limit,
+		"next_cursor": nil,
+		"prev_cursor": nil,
+	}
+
+	var links []string
+	link := func(param string, c *cursor, rel string) {
+		query := r.URL.Query()
+		query.Del("after")
+		query.Del("before")
+		query.Set(param, c.encode())
+		links = append(links, fmt.Sprintf(`<%s?%s>; rel="%s"`, r.URL.Path, query.Encode(), rel))
+	}
+	if next != nil {
+		fields["next_cursor"] = next.encode()
+		link("after", next, "next")
+	}
+	if prev != nil {
+		fields["prev_cursor"] = prev.encode()
+		link("before", prev, "prev")
+	}
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+
+	if total != nil {
+		fields["total"] = *total
+		w.Header().Set("X-Total-Count", strconv.Itoa(*total))
+	}
+	return fields
+}
@@ -0,0 +1,422 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/ishushreyas/expense-tracker/db"
+	"github.com/jackc/pgx/v5"
+)
+
+const paymentRequestColumns = `id, requester_id, payee_id, amount, note, due_date, status, payment_id, created_at, responded_at`
+
+// CreatePaymentRequest asks another member to pay the session user
+func CreatePaymentRequest(w http.ResponseWriter, r *http.Request) {
+	type RequestInput struct {
+		PayeeID string  `json:"payee_id"`
+		Amount  float64 `json:"amount"`
+		Note    string  `json:"note"`
+		DueDate string  `json:"due_date"`
+	}
+
+	// Create context with timeout
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	requesterID, err := sessionUserID(ctx)
+	if err != nil {
+		http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var input RequestInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	payeeID, err := uuid.Parse(input.PayeeID)
+	if err != nil {
+		http.Error(w, "Invalid payee UUID", http.StatusBadRequest)
+		return
+	}
+	if payeeID == requesterID {
+		http.Error(w, "You cannot request money from yourself", http.StatusBadRequest)
+		return
+	}
+	if input.Amount <= 0 {
+		http.Error(w, "Amount must be greater than zero", http.StatusBadRequest)
+		return
+	}
+
+	var dueDate *time.Time
+	if input.DueDate != "" {
+		parsed, err := time.Parse("2006-01-02", input.DueDate)
+		if err != nil {
+			http.Error(w, "Invalid due_date, expected YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+		dueDate = &parsed
+	}
+
+	var request db.PaymentRequest
+	err = db.Pool.QueryRow(ctx, `
+		INSERT INTO payment_requests (id, requester_id, payee_id, amount, note, due_date)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING `+paymentRequestColumns,
+		uuid.New(), requesterID, payeeID, input.Amount, input.Note, dueDate,
+	).Scan(scanPaymentRequest(&request)...)
+	if err != nil {
+		http.Error(w, "Failed to create payment request: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	publish(ctx, Event{
+		Topic:    TopicPayments,
+		Type:     MessagePaymentRequestCreated,
+		Data:     request,
+		Audience: []uuid.UUID{request.RequesterID, request.PayeeID},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(request)
+}
+
+// paymentRequestStatuses are the values ?status= accepts on
+// /payment-requests.
+var paymentRequestStatuses = []string{db.RequestOpen, db.RequestAccepted, db.RequestDeclined, db.RequestCancelled, "all"}
+
+// GetPaymentRequests lists the payment requests the session user made or
+// was asked to pay, outstanding ones by default. Use ?status=all to include
+// answered requests.
+func GetPaymentRequests(w http.ResponseWriter, r *http.Request) {
+	// Create context with timeout
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	userID, err := sessionUserID(ctx)
+	if err != nil {
+		http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+		return
+	}
+
+	query := r.URL.Query()
+
+	sqlQuery := `SELECT ` + paymentRequestColumns + ` FROM payment_requests WHERE (requester_id = $1 OR payee_id = $1)`
+	args := []interface{}{userID}
+	argCount := 2
+
+	status := query.Get("status")
+	if status == "" {
+		status = db.RequestOpen
+	}
+	if !contains(paymentRequestStatuses, status) {
+		http.Error(w, "Invalid status, expected one of "+strings.Join(paymentRequestStatuses, ", "), http.StatusBadRequest)
+		return
+	}
+	if status != "all" {
+		sqlQuery += " AND status = $" + strconv.Itoa(argCount)
+		args = append(args, status)
+		argCount++
+	}
+
+	sqlQuery += " ORDER BY due_date NULLS LAST, created_at DESC"
+
+	rows, err := db.Pool.Query(ctx, sqlQuery, args...)
+	if err != nil {
+		http.Error(w, "Failed to retrieve payment requests: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	requests, err := pgx.CollectRows(rows, pgx.RowToStructByName[db.PaymentRequest])
+	if err != nil {
+		http.Error(w, "Failed to process payment requests: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"payment_requests": requests,
+	})
+}
+
+// GetPaymentRequestByID returns a single payment request to its requester
+// or payee
+func GetPaymentRequestByID(w http.ResponseWriter, r *http.Request) {
+	// Create context with timeout
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	userID, err := sessionUserID(ctx)
+	if err != nil {
+		http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+		return
+	}
+
+	requestID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid payment request ID format", http.StatusBadRequest)
+		return
+	}
+
+	var request db.PaymentRequest
+	err = db.Pool.QueryRow(ctx, `SELECT `+paymentRequestColumns+` FROM payment_requests WHERE id = $1`, requestID).
+		Scan(scanPaymentRequest(&request)...)
+	if err == pgx.ErrNoRows {
+		http.Error(w, "Payment request not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to retrieve payment request: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !isParty(userID, request.RequesterID, request.PayeeID) {
+		http.Error(w, "Only the requester or the payee can see a payment request", http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(request)
+}
+
+// AcceptPaymentRequest lets the payee agree to a request, which records the
+// matching payment. Like any payment it stays pending until the requester
+// confirms the money arrived.
+func AcceptPaymentRequest(w http.ResponseWriter, r *http.Request) {
+	// Create context with timeout
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	userID, err := sessionUserID(ctx)
+	if err != nil {
+		http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+		return
+	}
+
+	requestID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid payment request ID format", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		http.Error(w, "Failed to accept payment request: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+	if err := db.SetActor(ctx, tx, userID); err != nil {
+		http.Error(w, "Failed to accept payment request: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var request db.PaymentRequest
+	err = tx.QueryRow(ctx, `SELECT `+paymentRequestColumns+` FROM payment_requests WHERE id = $1 FOR UPDATE`, requestID).
+		Scan(scanPaymentRequest(&request)...)
+	if err == pgx.ErrNoRows {
+		http.Error(w, "Payment request not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to retrieve payment request: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if request.PayeeID != userID {
+		http.Error(w, "Only the payee can accept a payment request", http.StatusForbidden)
+		return
+	}
+	if request.Status != db.RequestOpen {
+		http.Error(w, "Payment request is already "+request.Status, http.StatusConflict)
+		return
+	}
+
+	// The payee pays today, in their own timezone
+	occurredOn, err := occurredOnFor(ctx, userID, "")
+	if err != nil {
+		http.Error(w, "Failed to add payment: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	payment := db.Payment{
+		ID:         uuid.New(),
+		PayerID:    request.PayeeID,
+		Amount:     request.Amount,
+		RecieverID: request.RequesterID,
+		Remark:     request.Note,
+		Status:     db.PaymentPending,
+		OccurredOn: occurredOn,
+	}
+	err = tx.QueryRow(ctx, `
+		INSERT INTO payments (id, payer_id, amount, reciever_id, created_at, remark, status, occurred_on)
+		VALUES ($1, $2, $3, $4, now(), $5, $6, $7)
+		RETURNING created_at
+	`, payment.ID, payment.PayerID, payment.Amount, payment.RecieverID, payment.Remark, payment.Status, payment.OccurredOn).Scan(&payment.CreatedAt)
+	if err != nil {
+		if writeClosedPeriod(w, err) {
+			return
+		}
+		http.Error(w, "Failed to add payment: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = tx.QueryRow(ctx, `
+		UPDATE payment_requests
+		SET status = $1, payment_id = $2, responded_at = NOW()
+		WHERE id = $3
+		RETURNING `+paymentRequestColumns,
+		db.RequestAccepted, payment.ID, requestID,
+	).Scan(scanPaymentRequest(&request)...)
+	if err != nil {
+		http.Error(w, "Failed to update payment request: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, "Failed to accept payment request: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	audience := []uuid.UUID{request.RequesterID, request.PayeeID}
+	publish(ctx, Event{Topic: TopicPayments, Type: MessagePaymentRequestAccepted, Data: request, Audience: audience})
+	publish(ctx, Event{Topic: TopicPayments, Type: MessagePaymentCreated, Data: payment, Audience: audience})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"payment_request": request,
+		"payment":         payment,
+	})
+}
+
+// DeclinePaymentRequest lets the payee turn a request down
+func DeclinePaymentRequest(w http.ResponseWriter, r *http.Request) {
+	closePaymentRequest(w, r, db.RequestDeclined)
+}
+
+// CancelPaymentRequest lets the requester withdraw a request
+func CancelPaymentRequest(w http.ResponseWriter, r *http.Request) {
+	closePaymentRequest(w, r, db.RequestCancelled)
+}
+
+// closePaymentRequest answers an open request without creating a payment.
+// Only the payee may decline and only the requester may cancel.
+func closePaymentRequest(w http.ResponseWriter, r *http.Request, status string) {
+	// Create context with timeout
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	userID, err := sessionUserID(ctx)
+	if err != nil {
+		http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+		return
+	}
+
+	requestID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid payment request ID format", http.StatusBadRequest)
+		return
+	}
+
+	actorColumn, msgType := "payee_id", MessagePaymentRequestDeclined
+	if status == db.RequestCancelled {
+		actorColumn, msgType = "requester_id", MessagePaymentRequestCancelled
+	}
+
+	var request db.PaymentRequest
+	err = db.Pool.QueryRow(ctx, `
+		UPDATE payment_requests
+		SET status = $1, responded_at = NOW()
+		WHERE id = $2 AND status = 'open' AND `+actorColumn+` = $3
+		RETURNING `+paymentRequestColumns,
+		status, requestID, userID,
+	).Scan(scanPaymentRequest(&request)...)
+	if err == pgx.ErrNoRows {
+		// Work out why so the client gets a useful answer
+		var current string
+		var requesterID, payeeID uuid.UUID
+		err = db.Pool.QueryRow(ctx, "SELECT status, requester_id, payee_id FROM payment_requests WHERE id = $1", requestID).
+			Scan(&current, &requesterID, &payeeID)
+		switch {
+		case err == pgx.ErrNoRows:
+			http.Error(w, "Payment request not found", http.StatusNotFound)
+		case err != nil:
+			http.Error(w, "Failed to retrieve payment request: "+err.Error(), http.StatusInternalServerError)
+		case current != db.RequestOpen:
+			http.Error(w, "Payment request is already "+current, http.StatusConflict)
+		default:
+			http.Error(w, "You are not allowed to mark this request "+status, http.StatusForbidden)
+		}
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to update payment request: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	publish(ctx, Event{
+		Topic:    TopicPayments,
+		Type:     msgType,
+		Data:     request,
+		Audience: []uuid.UUID{request.RequesterID, request.PayeeID},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(request)
+}
+
+// outstandingRequests totals open payment requests per user: how much they
+// have asked others for and how much others have asked of them.
+func outstandingRequests(ctx context.Context, asOf *time.Time) (map[uuid.UUID]map[string]float64, error) {
+	// At an earlier moment, a request was open if it had been made and not
+	// yet answered
+	rows, err := db.Pool.Query(ctx, `
+		SELECT requester_id, payee_id, amount
+		FROM payment_requests
+		WHERE ($1::timestamptz IS NULL AND status = 'open')
+		OR (created_at <= $1 AND (responded_at IS NULL OR responded_at > $1))
+	`, asOf)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	totals := make(map[uuid.UUID]map[string]float64)
+	entry := func(userID uuid.UUID) map[string]float64 {
+		if totals[userID] == nil {
+			totals[userID] = map[string]float64{"requested": 0, "owing": 0}
+		}
+		return totals[userID]
+	}
+	for rows.Next() {
+		var (
+			requesterID, payeeID uuid.UUID
+			amount               float64
+		)
+		if err := rows.Scan(&requesterID, &payeeID, &amount); err != nil {
+			return nil, err
+		}
+		entry(requesterID)["requested"] += amount
+		entry(payeeID)["owing"] += amount
+	}
+	return totals, rows.Err()
+}
+
+func scanPaymentRequest(request *db.PaymentRequest) []interface{} {
+	return []interface{}{
+		&request.ID,
+		&request.RequesterID,
+		&request.PayeeID,
+		&request.Amount,
+		&request.Note,
+		&request.DueDate,
+		&request.Status,
+		&request.PaymentID,
+		&request.CreatedAt,
+		&request.RespondedAt,
+	}
+}
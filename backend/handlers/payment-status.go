@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/ishushreyas/expense-tracker/db"
+	"github.com/jackc/pgx/v5"
+)
+
+type paymentReminder struct {
+	ID         uuid.UUID `json:"id"`
+	PayerID    uuid.UUID `json:"payer_id"`
+	RecieverID uuid.UUID `json:"reciever_id"`
+	Amount     float64   `json:"amount"`
+	Remark     string    `json:"remark"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// ConfirmPayment lets the reciever acknowledge that the money arrived
+func ConfirmPayment(w http.ResponseWriter, r *http.Request) {
+	settlePayment(w, r, db.PaymentConfirmed)
+}
+
+// RejectPayment lets the reciever say the money never arrived
+func RejectPayment(w http.ResponseWriter, r *http.Request) {
+	settlePayment(w, r, db.PaymentRejected)
+}
+
+// settlePayment moves a pending payment to status on behalf of its reciever.
+func settlePayment(w http.ResponseWriter, r *http.Request, status string) {
+	// Create context with timeout
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	userID, err := sessionUserID(ctx)
+	if err != nil {
+		http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+		return
+	}
+
+	paymentID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid payment ID format", http.StatusBadRequest)
+		return
+	}
+
+	var (
+		payerID    uuid.UUID
+		recieverID uuid.UUID
+		previous   string
+	)
+	err = db.Pool.QueryRow(ctx, `
+		SELECT payer_id, reciever_id, status
+		FROM payments
+		WHERE id = $1 AND is_deleted = false
+	`, paymentID).Scan(&payerID, &recieverID, &previous)
+	if err == pgx.ErrNoRows {
+		http.Error(w, "Payment not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to retrieve payment: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if userID != recieverID {
+		http.Error(w, "Only the reciever can confirm or reject a payment", http.StatusForbidden)
+		return
+	}
+
+	// Guard on status so two racing responses can't both win
+	var confirmedAt *time.Time
+	err = db.WithActor(ctx, db.Pool, userID, func(tx pgx.Tx) error {
+		return tx.QueryRow(ctx, `
+			UPDATE payments
+			SET status = $1,
+			    confirmed_at = CASE WHEN $1 = 'confirmed' THEN NOW() ELSE NULL END
+			WHERE id = $2 AND status = 'pending'
+			RETURNING confirmed_at
+		`, status, paymentID).Scan(&confirmedAt)
+	})
+	if err == pgx.ErrNoRows {
+		http.Error(w, "Payment is already "+previous, http.StatusConflict)
+		return
+	} else if err != nil {
+		if writeClosedPeriod(w, err) {
+			return
+		}
+		http.Error(w, "Failed to update payment: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"id":              paymentID,
+		"status":          status,
+		"previous_status": previous,
+		"confirmed_at":    confirmedAt,
+	}
+	publish(ctx, Event{
+		Topic:    TopicPayments,
+		Type:     MessagePaymentStatusChanged,
+		Data:     response,
+		Audience: []uuid.UUID{payerID, recieverID},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// RunPaymentReminders nudges recievers about payments that have been waiting
+// for confirmation longer than after, checking every interval. A payment is
+// reminded about at most once per after period.
+func RunPaymentReminders(ctx context.Context, after, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := sendPaymentReminders(ctx, after); err != nil {
+			log.Printf("Error sending payment reminders: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func sendPaymentReminders(ctx context.Context, after time.Duration) error {
+	cutoff := time.Now().Add(-after)
+	rows, err := db.Pool.Query(ctx, `
+		UPDATE payments
+		SET reminded_at = NOW()
+		WHERE is_deleted = false
+		AND status = 'pending'
+		AND created_at <= $1
+		AND (reminded_at IS NULL OR reminded_at <= $1)
+		RETURNING id, payer_id, reciever_id, amount, remark, created_at
+	`, cutoff)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var reminders []paymentReminder
+	for rows.Next() {
+		var reminder paymentReminder
+		if err := rows.Scan(&reminder.ID, &reminder.PayerID, &reminder.RecieverID, &reminder.Amount, &reminder.Remark, &reminder.CreatedAt); err != nil {
+			return err
+		}
+		reminders = append(reminders, reminder)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, reminder := range reminders {
+		publish(ctx, Event{
+			Topic:    TopicPayments,
+			Type:     MessagePaymentReminder,
+			Data:     reminder,
+			Audience: []uuid.UUID{reminder.RecieverID},
+		})
+	}
+	return nil
+}
@@ -5,12 +5,12 @@ import (
     "encoding/json"
     "fmt"
     "net/http"
-    "strconv"
     "time"
 
     "github.com/google/uuid"
     "github.com/gorilla/mux"
     "github.com/ishushreyas/expense-tracker/db"
+    "github.com/ishushreyas/expense-tracker/ledger"
     "github.com/jackc/pgx/v5"
 )
 
@@ -18,9 +18,12 @@ type Payment struct {
     ID         uuid.UUID   `json:"id" db:"id"`
     PayerID    uuid.UUID   `json:"payer_id" db:"payer_id"`
     Amount     float64     `json:"amount" db:"amount"`
-    RecieverID uuid.UUID `json:"members" db:"reciever_id"`
+    RecieverID uuid.UUID `json:"reciever_id" db:"reciever_id"`
     Remark     string      `json:"remark" db:"remark"`
+    Status     string      `json:"status" db:"status"`
+    ConfirmedAt *time.Time `json:"confirmed_at,omitempty" db:"confirmed_at"`
     CreatedAt  time.Time   `json:"created_at" db:"created_at"`
+    OccurredOn time.Time   `json:"occurred_on" db:"occurred_on"`
     IsDeleted  bool        `json:"is_deleted" db:"is_deleted"`
     DeletedAt  *time.Time  `json:"deleted_at,omitempty" db:"deleted_at"`
 }
@@ -31,6 +34,7 @@ func AddPayment(w http.ResponseWriter, r *http.Request) {
         Amount  float64  `json:"amount"`
         RecieverID string   `json:"reciever_id"`
         Remark  string   `json:"remark"`
+        OccurredOn string `json:"occurred_on"`
     }
 
     var input TransactionInput
@@ -39,22 +43,71 @@ func AddPayment(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    // Convert members strings to uuid.UUID
+    // Backdated payments say when they happened; otherwise it was today
+    prefs, err := preferencesFor(r.Context(), r.URL.Query())
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    occurredOn, err := parseOccurredOn(input.OccurredOn, prefs.Location)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    // Convert payer and reciever strings to uuid.UUID
+    payerUUID, err := uuid.Parse(input.PayerID)
+    if err != nil {
+        http.Error(w, "Invalid payer UUID", http.StatusBadRequest)
+        return
+    }
     recieverUUID, err := uuid.Parse(input.RecieverID)
+    if err != nil {
+        http.Error(w, "Invalid reciever UUID", http.StatusBadRequest)
+        return
+    }
 
-    // Create transaction and insert into DB
-    transactionID := uuid.New().String()
-    query := "INSERT INTO transactions (id, payer_id, amount, reciever_id, created_at, remark) VALUES ($1, $2, $3, $4, now(), $5)"
+    // Create payment and insert into DB
+    payment := db.Payment{
+        ID:         uuid.New(),
+        PayerID:    payerUUID,
+        Amount:     input.Amount,
+        RecieverID: recieverUUID,
+        Remark:     input.Remark,
+        Status:     db.PaymentPending,
+        OccurredOn: occurredOn,
+    }
+    query := "INSERT INTO payments (id, payer_id, amount, reciever_id, created_at, remark, status, occurred_on) VALUES ($1, $2, $3, $4, now(), $5, $6, $7) RETURNING created_at"
 
-    _, err = db.Pool.Exec(r.Context(), query, transactionID, input.PayerID, input.Amount, recieverUUID, input.Remark)
+    err = db.WithActor(r.Context(), db.Pool, auditActor(r.Context()), func(tx pgx.Tx) error {
+        return tx.QueryRow(r.Context(), query, payment.ID, payment.PayerID, payment.Amount, payment.RecieverID, payment.Remark, payment.Status, payment.OccurredOn).Scan(&payment.CreatedAt)
+    })
     if err != nil {
+        if writeClosedPeriod(w, err) {
+            return
+        }
         http.Error(w, "Failed to add transaction: "+err.Error(), http.StatusInternalServerError)
         return
     }
 
+    publish(r.Context(), Event{
+        Topic:    TopicPayments,
+        Type:     MessagePaymentCreated,
+        Data:     payment,
+        Audience: []uuid.UUID{payment.PayerID, payment.RecieverID},
+    })
+
     w.Header().Set("Content-Type", "application/json")
     w.WriteHeader(http.StatusCreated)
-    json.NewEncoder(w).Encode(map[string]string{"id": transactionID})
+    json.NewEncoder(w).Encode(map[string]string{"id": payment.ID.String()})
+}
+
+// sortedPayment is a listed payment with its tags and the value it was
+// sorted by.
+type sortedPayment struct {
+	Payment
+	Tags    []string `json:"tags" db:"tags"`
+	SortKey string `json:"-" db:"sort_key"`
 }
 
 func GetPayments(w http.ResponseWriter, r *http.Request) {
@@ -64,68 +117,46 @@ func GetPayments(w http.ResponseWriter, r *http.Request) {
 
 	// Parse query parameters
 	query := r.URL.Query()
-	
-	// Default pagination
-	page := 1
-	limit := 20
-	
-	if pageStr := query.Get("page"); pageStr != "" {
-		if p, err := strconv.Atoi(pageStr); err == nil && p > 0 {
-			page = p
-		}
-	}
-	
-	if limitStr := query.Get("limit"); limitStr != "" {
-		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 && l <= 100 {
-			limit = l
-		}
-	}
 
-	// Calculate offset
-	offset := (page - 1) * limit
+	page, err := pageRequestFromQuery(query, ledgerSorts, "-date")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	// Build base query with flexible filtering
-	sqlQuery := `
-    SELECT id, payer_id, amount, reciever_id, created_at, remark, is_deleted, deleted_at
-    FROM payments
-    WHERE is_deleted = false
-`
-	
-	// Optional filters
-	var args []interface{}
-	argCount := 1
-
-	// Filter by payer ID if provided
-	if payerID := query.Get("payer_id"); payerID != "" {
-		sqlQuery += " AND payer_id = $" + strconv.Itoa(argCount)
-		args = append(args, payerID)
-		argCount++
+	// Build filters shared with the transaction list
+	filter, err := ledgerFilter(query, "(payer_id = ? OR reciever_id = ?)", taggablePayment)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	// Filter by date range if provided
-	if startDate := query.Get("start_date"); startDate != "" {
-		if parsedDate, err := time.Parse("2006-01-02", startDate); err == nil {
-			sqlQuery += " AND timestamp >= $" + strconv.Itoa(argCount)
-			args = append(args, parsedDate)
-			argCount++
-		}
+	// Filter by reciever ID if provided
+	if err := filter.addUUID(query, "reciever_id", "reciever_id = ?"); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	if endDate := query.Get("end_date"); endDate != "" {
-		if parsedDate, err := time.Parse("2006-01-02", endDate); err == nil {
-			sqlQuery += " AND timestamp <= $" + strconv.Itoa(argCount)
-			args = append(args, parsedDate)
-			argCount++
+	var total *int
+	if page.IncludeTotal {
+		if total, err = countRows(ctx, "payments"+filter.where(), filter.args); err != nil {
+			http.Error(w, "Failed to count payments: "+err.Error(), http.StatusInternalServerError)
+			return
 		}
 	}
 
 	// Add pagination
-	sqlQuery += " ORDER BY timestamp DESC LIMIT $" + strconv.Itoa(argCount) + 
-				" OFFSET $" + strconv.Itoa(argCount+1)
-	args = append(args, limit, offset)
+	keyset, keysetArgs, err := page.keyset("id", filter.nextArg(), stringID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sqlQuery := `
+    SELECT id, payer_id, amount, reciever_id, created_at, occurred_on, remark, status, confirmed_at, is_deleted, deleted_at, ` + taggablePayment.tagsColumn() + `, ` + page.sortColumn() + `
+    FROM payments` + filter.where() + keyset
 
 	// Execute query
-	rows, err := db.Pool.Query(ctx, sqlQuery, args...)
+	rows, err := db.Pool.Query(ctx, sqlQuery, append(filter.args, keysetArgs...)...)
 	if err != nil {
 		http.Error(w, "Failed to retrieve payments: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -133,24 +164,19 @@ func GetPayments(w http.ResponseWriter, r *http.Request) {
 	defer rows.Close()
 
 	// Collect rows
-	transactions, err := pgx.CollectRows(rows, pgx.RowToStructByName[Transaction])
+	payments, err := pgx.CollectRows(rows, pgx.RowToStructByName[sortedPayment])
 	if err != nil {
 		http.Error(w, "Failed to process payments: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Handle empty result
-	if len(transactions) == 0 {
-		w.WriteHeader(http.StatusNoContent)
-		return
-	}
+	payments, next, prev := pageOf(payments, page, func(row sortedPayment) (string, string) {
+		return row.SortKey, row.ID.String()
+	})
 
 	// Prepare response with pagination info
-	response := map[string]interface{}{
-		"payments": transactions,
-		"page":         page,
-		"limit":        limit,
-	}
+	response := writePageLinks(w, r, page, next, prev, total)
+	response["payments"] = payments
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
@@ -172,33 +198,46 @@ func GetPaymentByID(w http.ResponseWriter, r *http.Request) {
 
     // Prepare query
     query := `
-    SELECT id, payer_id, amount, reciever_id, created_at, remark, is_deleted, deleted_at
+    SELECT id, payer_id, amount, reciever_id, created_at, occurred_on, remark, status, confirmed_at, is_deleted, deleted_at, version
     FROM payments
     WHERE id = $1
     `
 
     // Execute query
-    var transaction Payment
+    var (
+        transaction Payment
+        version     int
+    )
     err = db.Pool.QueryRow(ctx, query, transactionID).Scan(
         &transaction.ID,
         &transaction.PayerID,
         &transaction.Amount,
         &transaction.RecieverID,
         &transaction.CreatedAt,
+        &transaction.OccurredOn,
         &transaction.Remark,
+        &transaction.Status,
+        &transaction.ConfirmedAt,
+        &transaction.IsDeleted,
+        &transaction.DeletedAt,
+        &version,
     )
 
     if err == pgx.ErrNoRows {
-        http.Error(w, "Transaction not found", http.StatusNotFound)
+        http.Error(w, "Payment not found", http.StatusNotFound)
         return
     } else if err != nil {
         http.Error(w, "Failed to retrieve transaction: "+err.Error(), http.StatusInternalServerError)
         return
     }
 
+    w.Header().Set("ETag", versionETag(version))
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(transaction)
 }
+
+// DeletePayment removes a payment for good. If-Match is optional; without
+// it the delete applies to whatever version is current.
 func DeletePayment(w http.ResponseWriter, r *http.Request) {
 	// Create context with timeout
 	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
@@ -218,23 +257,40 @@ func DeletePayment(w http.ResponseWriter, r *http.Request) {
 	query := `
 		DELETE FROM payments
 		WHERE id = $1
-		RETURNING id
+		AND ($2::int[] IS NULL OR version = ANY($2))
+		RETURNING id, payer_id, reciever_id
 	`
 
 	// Execute delete operation
-	var deletedID string
-	err := db.Pool.QueryRow(ctx, query, transactionID).Scan(&deletedID)
+	var (
+		deletedID  string
+		payerID    uuid.UUID
+		recieverID uuid.UUID
+	)
+	err := db.WithActor(ctx, db.Pool, auditActor(ctx), func(tx pgx.Tx) error {
+		return tx.QueryRow(ctx, query, transactionID, ifMatchVersions(r)).Scan(&deletedID, &payerID, &recieverID)
+	})
 
 	if err == pgx.ErrNoRows {
-		// No transaction found with given ID
-		http.Error(w, "Transaction not found", http.StatusNotFound)
+		// No payment found with given ID, or not at the expected version
+		writeVersionMismatch(ctx, w, "payments", transactionID, false, "Payment not found")
 		return
 	} else if err != nil {
 		// Other database error
+		if writeClosedPeriod(w, err) {
+			return
+		}
 		http.Error(w, "Failed to delete transaction: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	publish(ctx, Event{
+		Topic:    TopicPayments,
+		Type:     MessagePaymentDeleted,
+		Data:     map[string]string{"id": deletedID},
+		Audience: []uuid.UUID{payerID, recieverID},
+	})
+
 	// Prepare response
 	response := map[string]string{
 		"message": "Payment deleted successfully",
@@ -246,6 +302,8 @@ func DeletePayment(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+// SoftDeletePayment moves a payment to the trash. If-Match is optional;
+// without it the delete applies to whatever version is current.
 func SoftDeletePayment(w http.ResponseWriter, r *http.Request) {
 	// Create context with timeout
 	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
@@ -265,25 +323,44 @@ func SoftDeletePayment(w http.ResponseWriter, r *http.Request) {
 	query := `
 		UPDATE payments
 		SET is_deleted = true,
-		    deleted_at = NOW()
+		    deleted_at = NOW(),
+		    deleted_by = $2
 		WHERE id = $1 AND is_deleted = false
-		RETURNING id
+		AND ($3::int[] IS NULL OR version = ANY($3))
+		RETURNING id, payer_id, reciever_id
 	`
 
 	// Execute soft delete operation
-	var deletedID string
-	err := db.Pool.QueryRow(ctx, query, transactionID).Scan(&deletedID)
+	var (
+		deletedID  string
+		payerID    uuid.UUID
+		recieverID uuid.UUID
+	)
+	actorID := auditActor(ctx)
+	err := db.WithActor(ctx, db.Pool, actorID, func(tx pgx.Tx) error {
+		return tx.QueryRow(ctx, query, transactionID, nullableID(actorID), ifMatchVersions(r)).Scan(&deletedID, &payerID, &recieverID)
+	})
 
 	if err == pgx.ErrNoRows {
-		// No transaction found or already deleted
-		http.Error(w, "Transaction not found or already deleted", http.StatusNotFound)
+		// No payment found, already deleted, or not at the expected version
+		writeVersionMismatch(ctx, w, "payments", transactionID, true, "Payment not found or already deleted")
 		return
 	} else if err != nil {
 		// Other database error
+		if writeClosedPeriod(w, err) {
+			return
+		}
 		http.Error(w, "Failed to soft delete transaction: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	publish(ctx, Event{
+		Topic:    TopicPayments,
+		Type:     MessagePaymentDeleted,
+		Data:     map[string]string{"id": deletedID},
+		Audience: []uuid.UUID{payerID, recieverID},
+	})
+
 	// Prepare response
 	response := map[string]string{
 		"message": "Transaction soft deleted successfully",
@@ -300,13 +377,22 @@ func GeneratePaymentSummary(w http.ResponseWriter, r *http.Request) {
 	// Create context with timeout
 	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
+
+	// Optionally reconstruct the summary as it stood at an earlier moment
+	asOf, err := parseAsOf(r.URL.Query().Get("as_of"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	sqlQuery := `
-    SELECT id, payer_id, amount, reciever_id, created_at, remark, is_deleted, deleted_at
-    FROM payments
+    SELECT id, payer_id, amount, reciever_id, created_at, occurred_on, remark, status, confirmed_at, is_deleted, deleted_at
+    FROM ` + db.PaymentsAsOf("$1") + ` p
     WHERE is_deleted = false
+    AND status <> 'rejected'
 `
 	// Execute query
-	rows, err := db.Pool.Query(ctx, sqlQuery)
+	rows, err := db.Pool.Query(ctx, sqlQuery, asOf)
 	if err != nil {
 		http.Error(w, "Failed to retrieve transactions: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -325,31 +411,52 @@ func GeneratePaymentSummary(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNoContent)
 		return
 	}
-	balances := make(map[uuid.UUID]float64)
+	balances := ledger.New()
 	user_expense := make(map[uuid.UUID]float64)
 	totalExpense := 0.00
 
+	// Unconfirmed payments are reported on their own and don't settle anything yet
+	pendingPayments := []Payment{}
+	pendingIncoming := make(map[uuid.UUID]float64)
+	pendingOutgoing := make(map[uuid.UUID]float64)
+	pendingTotal := 0.00
+
 	for _, expense := range expenses {
+		if expense.Status == db.PaymentPending {
+			pendingPayments = append(pendingPayments, expense)
+			pendingIncoming[expense.RecieverID] += expense.Amount
+			pendingOutgoing[expense.PayerID] += expense.Amount
+			pendingTotal += expense.Amount
+			continue
+		}
+
 		user_expense[expense.PayerID] += expense.Amount
-		// Calculate each member's share
-		share := expense.Amount / 2
 		totalExpense += expense.Amount
 
-		// Deduct shares from members and add the full amount to the payer
-		balances[expense.RecieverID] += share
-		balances[expense.PayerID] -= share
+		// A payment settles debt from the payer to the reciever
+		balances.AddSettlement(ledger.Settlement{ID: expense.ID, FromID: expense.PayerID, ToID: expense.RecieverID, Amount: expense.Amount})
 	}
 
 	// Prepare response with pagination info
 	response := map[string]interface{}{
 		"total_expenses": totalExpense,
 		"user_expenses":  user_expense,
-		"user_balances":      balances,
+		"user_balances":      balances.Balances(),
+		"as_of":          asOf,
+		"pending": map[string]interface{}{
+			"payments": pendingPayments,
+			"total":    pendingTotal,
+			"incoming": pendingIncoming,
+			"outgoing": pendingOutgoing,
+		},
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
+// EditPayment replaces a payment's figures. If-Match is optional, but a
+// client that leaves it out overwrites whatever version is current, so a
+// change made since it read the payment is lost.
 func EditPayment(w http.ResponseWriter, r *http.Request) {
     type TransactionInput struct {
 	ID      uuid.UUID `json:"id"`
@@ -357,18 +464,20 @@ func EditPayment(w http.ResponseWriter, r *http.Request) {
         Amount  float64   `json:"amount"`
         RecieverID string `json:"reciever_id"`
         Remark  string    `json:"remark"`
+        // Left out, the date is kept
+        OccurredOn string `json:"occurred_on,omitempty"`
     }
 
-    // Get transaction ID from URL
+    // Get payment ID from URL
     vars := mux.Vars(r)
     transactionIDStr := vars["id"]
     transactionID, err := uuid.Parse(transactionIDStr)
     if err != nil {
-        http.Error(w, "Invalid transaction ID format", http.StatusBadRequest)
+        http.Error(w, "Invalid payment ID format", http.StatusBadRequest)
         return
     }
 
-    // Parse the request body to get updated transaction data
+    // Parse the request body to get updated payment data
     var updatedTransaction TransactionInput
     err = json.NewDecoder(r.Body).Decode(&updatedTransaction)
     if err != nil {
@@ -376,24 +485,81 @@ func EditPayment(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    // Make sure the transaction ID in the URL matches the one in the payload
+    // Make sure the payment ID in the URL matches the one in the payload
     if updatedTransaction.ID != transactionID {
-        http.Error(w, "Transaction ID mismatch", http.StatusBadRequest)
+        http.Error(w, "Payment ID mismatch", http.StatusBadRequest)
         return
     }
 
-    // Update the transaction in the database
-    query := `
-        UPDATE transactions
-        SET payer_id = $1, amount = $2, reciever_id = $3, remark = $4
-        WHERE id = $5`
-    _, err = db.Pool.Exec(r.Context(), query, updatedTransaction.PayerID, updatedTransaction.Amount, updatedTransaction.RecieverID, updatedTransaction.Remark, transactionID)
+    payerUUID, err := uuid.Parse(updatedTransaction.PayerID)
     if err != nil {
-        http.Error(w, fmt.Sprintf("Failed to update transaction: %v", err), http.StatusInternalServerError)
+        http.Error(w, "Invalid payer UUID", http.StatusBadRequest)
+        return
+    }
+    recieverUUID, err := uuid.Parse(updatedTransaction.RecieverID)
+    if err != nil {
+        http.Error(w, "Invalid reciever UUID", http.StatusBadRequest)
+        return
+    }
+    var occurredOn *time.Time
+    if updatedTransaction.OccurredOn != "" {
+        prefs, err := preferencesFor(r.Context(), r.URL.Query())
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        date, err := parseOccurredOn(updatedTransaction.OccurredOn, prefs.Location)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        occurredOn = &date
+    }
+
+    // Update the payment in the database, unless someone else changed it
+    // since the version named in If-Match. A confirmation was given for
+    // different figures, so the reciever has to confirm again.
+    query := `
+        UPDATE payments
+        SET payer_id = $1, amount = $2, reciever_id = $3, remark = $4, status = $5, confirmed_at = NULL,
+            occurred_on = COALESCE($8, occurred_on)
+        WHERE id = $6 AND is_deleted = false
+        AND ($7::int[] IS NULL OR version = ANY($7))
+        RETURNING version`
+    var (
+        version  int
+        previous []uuid.UUID
+    )
+    err = db.WithActor(r.Context(), db.Pool, auditActor(r.Context()), func(tx pgx.Tx) error {
+        // Whoever the edit drops has to hear of it too
+        err := tx.QueryRow(r.Context(), `
+            SELECT ARRAY[payer_id, reciever_id] FROM payments WHERE id = $1 AND is_deleted = false FOR UPDATE
+        `, transactionID).Scan(&previous)
+        if err != nil {
+            return err
+        }
+        return tx.QueryRow(r.Context(), query, payerUUID, updatedTransaction.Amount, recieverUUID, updatedTransaction.Remark, db.PaymentPending, transactionID, ifMatchVersions(r), occurredOn).Scan(&version)
+    })
+    if err == pgx.ErrNoRows {
+        writeVersionMismatch(r.Context(), w, "payments", transactionID.String(), true, "Payment not found")
+        return
+    } else if err != nil {
+        if writeClosedPeriod(w, err) {
+            return
+        }
+        http.Error(w, fmt.Sprintf("Failed to update payment: %v", err), http.StatusInternalServerError)
         return
     }
 
-    // Respond with the updated transaction
+    publish(r.Context(), Event{
+        Topic:    TopicPayments,
+        Type:     MessagePaymentUpdated,
+        Data:     updatedTransaction,
+        Audience: audienceOf(previous, []uuid.UUID{payerUUID, recieverUUID}),
+    })
+
+    // Respond with the updated payment
+    w.Header().Set("ETag", versionETag(version))
     w.Header().Set("Content-Type", "application/json")
     w.WriteHeader(http.StatusOK)
     json.NewEncoder(w).Encode(updatedTransaction)
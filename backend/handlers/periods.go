@@ -0,0 +1,265 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/ishushreyas/expense-tracker/db"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Once the members settle up for a stretch of days, it can be closed.
+// Expenses and payments that occurred in a closed period can no longer be
+// added, edited, deleted, restored or confirmed, so the balances stay what
+// was paid. The database enforces this for every write path; the user
+// named as reopener when the period was closed can reopen it. Only a party
+// to every record in the period (its payer, a member or the reciever) can
+// close it, so nobody locks records that aren't theirs.
+
+// closedPeriodCode is the SQLSTATE the database raises when a change would
+// touch a closed period.
+const closedPeriodCode = "EP001"
+
+// ClosedPeriod is a range of days, both inclusive, that can't be changed.
+type ClosedPeriod struct {
+	ID         int64      `json:"id" db:"id"`
+	StartDate  time.Time  `json:"start_date" db:"start_date"`
+	EndDate    time.Time  `json:"end_date" db:"end_date"`
+	Note       string     `json:"note" db:"note"`
+	ClosedBy   uuid.UUID  `json:"closed_by" db:"closed_by"`
+	ClosedAt   time.Time  `json:"closed_at" db:"closed_at"`
+	ReopenerID uuid.UUID  `json:"reopener_id" db:"reopener_id"`
+	ReopenedBy *uuid.UUID `json:"reopened_by,omitempty" db:"reopened_by"`
+	ReopenedAt *time.Time `json:"reopened_at,omitempty" db:"reopened_at"`
+}
+
+const closedPeriodColumns = `id, start_date, end_date, note, closed_by, closed_at, reopener_id, reopened_by, reopened_at`
+
+// closedPeriod reports whether err is the database refusing a change
+// inside a closed period, and if so the message to show for it.
+func closedPeriod(err error) (string, bool) {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == closedPeriodCode {
+		return pgErr.Message, true
+	}
+	return "", false
+}
+
+// writeClosedPeriod answers 409 if err is the database refusing a change
+// inside a closed period, reporting whether it did.
+func writeClosedPeriod(w http.ResponseWriter, err error) bool {
+	msg, ok := closedPeriod(err)
+	if ok {
+		http.Error(w, msg, http.StatusConflict)
+	}
+	return ok
+}
+
+// GetClosedPeriods lists every period that was closed, latest first,
+// including those since reopened. ?open=true leaves those out.
+func GetClosedPeriods(w http.ResponseWriter, r *http.Request) {
+	// Create context with timeout
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	rows, err := db.Pool.Query(ctx, `
+		SELECT `+closedPeriodColumns+`
+		FROM closed_periods
+		WHERE NOT $1 OR reopened_at IS NULL
+		ORDER BY start_date DESC, id DESC
+	`, r.URL.Query().Get("open") == "true")
+	if err != nil {
+		http.Error(w, "Failed to retrieve closed periods: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	periods, err := pgx.CollectRows(rows, pgx.RowToStructByName[ClosedPeriod])
+	if err != nil {
+		http.Error(w, "Failed to retrieve closed periods: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if periods == nil {
+		periods = []ClosedPeriod{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(periods)
+}
+
+// ClosePeriod closes start_date to end_date (YYYY-MM-DD, both inclusive).
+// reopener_id names who may reopen it; the caller by default. The caller
+// has to be a party to every live record in the period.
+func ClosePeriod(w http.ResponseWriter, r *http.Request) {
+	type PeriodInput struct {
+		StartDate  string `json:"start_date"`
+		EndDate    string `json:"end_date"`
+		Note       string `json:"note"`
+		ReopenerID string `json:"reopener_id"`
+	}
+
+	// Create context with timeout
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	userID, err := sessionUserID(ctx)
+	if err != nil {
+		http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var input PeriodInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	startDate, err := time.Parse("2006-01-02", input.StartDate)
+	if err != nil {
+		http.Error(w, "Invalid start_date, expected YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+	endDate, err := time.Parse("2006-01-02", input.EndDate)
+	if err != nil {
+		http.Error(w, "Invalid end_date, expected YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+	if endDate.Before(startDate) {
+		http.Error(w, "end_date cannot be before start_date", http.StatusBadRequest)
+		return
+	}
+
+	reopenerID := userID
+	if input.ReopenerID != "" {
+		if reopenerID, err = uuid.Parse(input.ReopenerID); err != nil {
+			http.Error(w, "Invalid reopener UUID", http.StatusBadRequest)
+			return
+		}
+		var exists bool
+		if err := db.Pool.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)", reopenerID).Scan(&exists); err != nil {
+			http.Error(w, "Failed to retrieve user: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, "Reopener not found", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var (
+		period   ClosedPeriod
+		outsider bool
+	)
+	err = db.WithActor(ctx, db.Pool, userID, func(tx pgx.Tx) error {
+		err := tx.QueryRow(ctx, `
+			SELECT EXISTS (
+				SELECT 1 FROM transactions
+				WHERE NOT is_deleted AND occurred_on BETWEEN $1 AND $2
+				AND payer_id <> $3 AND NOT $3 = ANY(members)
+			) OR EXISTS (
+				SELECT 1 FROM payments
+				WHERE NOT is_deleted AND occurred_on BETWEEN $1 AND $2
+				AND $3 NOT IN (payer_id, reciever_id)
+			)
+		`, startDate, endDate, userID).Scan(&outsider)
+		if err != nil || outsider {
+			return err
+		}
+
+		rows, err := tx.Query(ctx, `
+			INSERT INTO closed_periods (start_date, end_date, note, closed_by, reopener_id)
+			VALUES ($1, $2, $3, $4, $5)
+			RETURNING `+closedPeriodColumns,
+			startDate, endDate, input.Note, userID, reopenerID)
+		if err != nil {
+			return err
+		}
+		period, err = pgx.CollectOneRow(rows, pgx.RowToStructByName[ClosedPeriod])
+		return err
+	})
+	if err != nil {
+		http.Error(w, "Failed to close period: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if outsider {
+		http.Error(w, "Only a party to every record in the period can close it", http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(period)
+}
+
+// ReopenPeriod lets the period's designated reopener unlock it again,
+// recording who reopened it and when.
+func ReopenPeriod(w http.ResponseWriter, r *http.Request) {
+	// Create context with timeout
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	userID, err := sessionUserID(ctx)
+	if err != nil {
+		http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+		return
+	}
+
+	periodID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid period ID format", http.StatusBadRequest)
+		return
+	}
+
+	var (
+		period  ClosedPeriod
+		status  int
+		refusal string
+	)
+	err = db.WithActor(ctx, db.Pool, userID, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, `SELECT `+closedPeriodColumns+` FROM closed_periods WHERE id = $1 FOR UPDATE`, periodID)
+		if err != nil {
+			return err
+		}
+		if period, err = pgx.CollectOneRow(rows, pgx.RowToStructByName[ClosedPeriod]); err != nil {
+			return err
+		}
+		if period.ReopenedAt != nil {
+			status, refusal = http.StatusConflict, "Period is already reopened"
+			return nil
+		}
+		if period.ReopenerID != userID {
+			status, refusal = http.StatusForbidden, "Only the designated reopener can reopen this period"
+			return nil
+		}
+
+		rows, err = tx.Query(ctx, `
+			UPDATE closed_periods
+			SET reopened_by = $2, reopened_at = now()
+			WHERE id = $1
+			RETURNING `+closedPeriodColumns,
+			periodID, userID)
+		if err != nil {
+			return err
+		}
+		period, err = pgx.CollectOneRow(rows, pgx.RowToStructByName[ClosedPeriod])
+		return err
+	})
+	if err == pgx.ErrNoRows {
+		http.Error(w, "Closed period not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to reopen period: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if refusal != "" {
+		http.Error(w, refusal, status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(period)
+}
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/ishushreyas/expense-tracker/db"
+)
+
+func TestClosedPeriodRefusesChanges(t *testing.T) {
+	testDatabase(t)
+	seedTransactions(t, 500)
+	ctx := context.Background()
+
+	var periodID int64
+	err := db.Pool.QueryRow(ctx, `
+		INSERT INTO closed_periods (start_date, end_date, closed_by, reopener_id)
+		VALUES ('2023-01-01', '2023-03-31', $1, $1)
+		RETURNING id
+	`, uuid.New()).Scan(&periodID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inside := `(SELECT id FROM transactions WHERE NOT is_deleted AND occurred_on BETWEEN '2023-01-01' AND '2023-03-31' LIMIT 1)`
+	outside := `(SELECT id FROM transactions WHERE NOT is_deleted AND occurred_on > '2023-03-31' LIMIT 1)`
+	trashed := `(SELECT id FROM transactions WHERE is_deleted AND occurred_on BETWEEN '2023-01-01' AND '2023-03-31' LIMIT 1)`
+
+	for _, tc := range []struct {
+		stmt    string
+		refused bool
+	}{
+		{`UPDATE transactions SET amount = amount + 1 WHERE id = ` + inside, true},
+		{`UPDATE transactions SET is_deleted = true WHERE id = ` + inside, true},
+		{`DELETE FROM transactions WHERE id = ` + inside, true},
+		{`UPDATE transactions SET occurred_on = '2023-02-01' WHERE id = ` + outside, true},
+		{`INSERT INTO transactions (id, payer_id, amount, occurred_on) VALUES (gen_random_uuid(), gen_random_uuid(), 10, '2023-02-01')`, true},
+		{`UPDATE transactions SET amount = amount + 1 WHERE id = ` + outside, false},
+		{`UPDATE transactions SET deleted_at = now() WHERE id = ` + inside, false},
+		{`DELETE FROM transactions WHERE id = ` + trashed, false},
+	} {
+		_, err := db.Pool.Exec(ctx, tc.stmt)
+		if _, refused := closedPeriod(err); refused != tc.refused {
+			t.Errorf("%s: err = %v, want refused %v", tc.stmt, err, tc.refused)
+		}
+	}
+
+	if _, err := db.Pool.Exec(ctx, `UPDATE closed_periods SET reopened_at = now() WHERE id = $1`, periodID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Pool.Exec(ctx, `UPDATE transactions SET amount = amount + 1 WHERE id = `+inside); err != nil {
+		t.Errorf("after reopening: %v", err)
+	}
+}
+
+func TestClosePeriodNeedsEveryParty(t *testing.T) {
+	testDatabase(t)
+	seedTransactions(t, 500)
+
+	for _, tc := range []struct {
+		body string
+		want int
+	}{
+		// Other users' expenses fall in the first quarter of 2023
+		{`{"start_date": "2023-01-01", "end_date": "2023-03-31"}`, http.StatusForbidden},
+		{`{"start_date": "2021-01-01", "end_date": "2021-01-31"}`, http.StatusCreated},
+	} {
+		r := httptest.NewRequest("POST", "/periods", strings.NewReader(tc.body))
+		w := httptest.NewRecorder()
+		ClosePeriod(w, asUser(r, "user0@example.com"))
+		if w.Code != tc.want {
+			t.Errorf("%s: status = %d, want %d: %s", tc.body, w.Code, tc.want, w.Body.String())
+		}
+	}
+}
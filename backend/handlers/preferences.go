@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ishushreyas/expense-tracker/db"
+	"github.com/ishushreyas/expense-tracker/report"
+	"github.com/jackc/pgx/v5"
+)
+
+// Every user has a timezone and a locale. The timezone decides what
+// "today" is, both for the occurred_on of records they enter and for the
+// end of open-ended trends, so an expense at 23:30 in Asia/Kolkata lands
+// on that day rather than the UTC one; exports write amounts and dates
+// the way their locale does. Anonymous callers get UTC and plain
+// formatting. ?tz= and ?locale= override both for a single request.
+
+// Preferences are a user's timezone and locale.
+type Preferences struct {
+	Timezone string `json:"timezone" db:"timezone"`
+	Locale   string `json:"locale" db:"locale"`
+}
+
+// requestPreferences is what a request's dates and exports follow.
+type requestPreferences struct {
+	Timezone string
+	Location *time.Location
+	Locale   report.Locale
+}
+
+// preferencesFor resolves the caller's preferences, then applies any ?tz=
+// or ?locale= in query.
+func preferencesFor(ctx context.Context, query url.Values) (requestPreferences, error) {
+	prefs := Preferences{Timezone: "UTC"}
+	if userID, err := sessionUserID(ctx); err == nil {
+		if prefs, err = loadPreferences(ctx, userID); err != nil {
+			return requestPreferences{}, fmt.Errorf("Failed to retrieve preferences: %v", err)
+		}
+	}
+	if tz := query.Get("tz"); tz != "" {
+		prefs.Timezone = tz
+	}
+	if locale := query.Get("locale"); locale != "" {
+		prefs.Locale = locale
+	}
+
+	loc, err := loadTimezone(prefs.Timezone)
+	if err != nil {
+		return requestPreferences{}, err
+	}
+	locale, ok := report.LookupLocale(prefs.Locale)
+	if !ok {
+		return requestPreferences{}, fmt.Errorf("Unsupported locale %q", prefs.Locale)
+	}
+	return requestPreferences{Timezone: prefs.Timezone, Location: loc, Locale: locale}, nil
+}
+
+// loadPreferences reads a user's preferences. Unknown users get the
+// defaults.
+func loadPreferences(ctx context.Context, userID uuid.UUID) (Preferences, error) {
+	prefs := Preferences{Timezone: "UTC"}
+	err := db.Pool.QueryRow(ctx, "SELECT timezone, locale FROM users WHERE id = $1", userID).Scan(&prefs.Timezone, &prefs.Locale)
+	if err != nil && err != pgx.ErrNoRows {
+		return Preferences{}, err
+	}
+	return prefs, nil
+}
+
+// loadTimezone loads an IANA timezone. "" and "Local" are refused rather
+// than quietly meaning UTC or the server's zone.
+func loadTimezone(name string) (*time.Location, error) {
+	loc, err := time.LoadLocation(name)
+	if err != nil || name == "" || name == "Local" {
+		return nil, fmt.Errorf("Invalid timezone %q, expected an IANA timezone like Asia/Kolkata", name)
+	}
+	return loc, nil
+}
+
+// GetPreferences returns the caller's timezone and locale.
+func GetPreferences(w http.ResponseWriter, r *http.Request) {
+	// Create context with timeout
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	userID, err := sessionUserID(ctx)
+	if err != nil {
+		http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+		return
+	}
+
+	prefs, err := loadPreferences(ctx, userID)
+	if err != nil {
+		http.Error(w, "Failed to retrieve preferences: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prefs)
+}
+
+// UpdatePreferences changes the caller's timezone (an IANA name) and/or
+// locale (a BCP 47 tag like en-IN, or "" for plain formatting).
+func UpdatePreferences(w http.ResponseWriter, r *http.Request) {
+	type PreferencesInput struct {
+		Timezone *string `json:"timezone"`
+		Locale   *string `json:"locale"`
+	}
+
+	// Create context with timeout
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	userID, err := sessionUserID(ctx)
+	if err != nil {
+		http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var input PreferencesInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if input.Timezone != nil {
+		if _, err := loadTimezone(*input.Timezone); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if input.Locale != nil {
+		locale, ok := report.LookupLocale(*input.Locale)
+		if !ok {
+			http.Error(w, "Unsupported locale "+*input.Locale, http.StatusBadRequest)
+			return
+		}
+		input.Locale = &locale.Tag
+	}
+
+	var prefs Preferences
+	err = db.WithActor(ctx, db.Pool, userID, func(tx pgx.Tx) error {
+		return tx.QueryRow(ctx, `
+			UPDATE users
+			SET timezone = COALESCE($2, timezone), locale = COALESCE($3, locale)
+			WHERE id = $1
+			RETURNING timezone, locale
+		`, userID, input.Timezone, input.Locale).Scan(&prefs.Timezone, &prefs.Locale)
+	})
+	if err != nil {
+		http.Error(w, "Failed to update preferences: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prefs)
+}
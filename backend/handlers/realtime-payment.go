@@ -1,11 +1,15 @@
 package handlers
 
 import (
+	"context"
+	"encoding/json"
 	"log"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 	"github.com/ishushreyas/expense-tracker/db"
 )
@@ -21,24 +25,171 @@ type ExtendedTransaction struct {
 	db.Transaction
 	Type       TransactionType `json:"type"`
 	SenderName string          `json:"sender_name"`
-	Status     string          `json:"status"`
+}
+
+const (
+	writeWait  = 10 * time.Second
+	pongWait   = 60 * time.Second
+	pingPeriod = (pongWait * 9) / 10
+)
+
+// Event is something that happened which subscribers of Topic may see.
+// Audience limits delivery to the listed users; nil means everyone. ID is
+// assigned when the event is written to the event log.
+type Event struct {
+	ID       int64
+	Topic    string
+	Type     MessageType
+	Data     interface{}
+	Audience []uuid.UUID
+}
+
+// Realtime is the hub that HTTP handlers publish their events through. It is
+// set by main once the server is created.
+var Realtime *WebSocketServer
+
+// publish hands event to the realtime hub, if one is running.
+func publish(ctx context.Context, event Event) {
+	if Realtime != nil {
+		Realtime.Publish(ctx, event)
+	}
+}
+
+// canSee reports whether userID is in the event's audience.
+func (e Event) canSee(userID uuid.UUID) bool {
+	if len(e.Audience) == 0 {
+		return true
+	}
+	for _, id := range e.Audience {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// audienceOf merges groups of parties into one audience, each user once.
+func audienceOf(groups ...[]uuid.UUID) []uuid.UUID {
+	seen := make(map[uuid.UUID]bool)
+	var audience []uuid.UUID
+	for _, group := range groups {
+		for _, id := range group {
+			if !seen[id] {
+				seen[id] = true
+				audience = append(audience, id)
+			}
+		}
+	}
+	return audience
+}
+
+func (e Event) envelope() Envelope {
+	env := newEnvelope(e.Type, "", e.Data)
+	env.EventID = e.ID
+	return env
+}
+
+// subscriber is a live connection (WebSocket or SSE) fed by the hub.
+type subscriber interface {
+	wants(event Event) bool
+	// offer queues env without blocking, reporting false if the subscriber
+	// cannot keep up.
+	offer(env Envelope) bool
+	drop()
+}
+
+type wsClient struct {
+	conn   *websocket.Conn
+	userID uuid.UUID
+	send   chan Envelope
+	done   chan struct{}
+	// stopped is closed once writePump exits and nothing drains send
+	stopped chan struct{}
+
+	mu     sync.Mutex
+	topics map[string]bool
+}
+
+// reply queues an envelope for this client unless its writer has stopped.
+func (c *wsClient) reply(env Envelope) {
+	select {
+	case c.send <- env:
+	case <-c.stopped:
+	}
+}
+
+func (c *wsClient) setTopics(topics []string, subscribed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, topic := range topics {
+		if subscribed {
+			c.topics[topic] = true
+		} else {
+			delete(c.topics, topic)
+		}
+	}
+}
+
+func (c *wsClient) wants(event Event) bool {
+	c.mu.Lock()
+	subscribed := c.topics[event.Topic]
+	c.mu.Unlock()
+	return subscribed && event.canSee(c.userID)
+}
+
+func (c *wsClient) offer(env Envelope) bool {
+	select {
+	case c.send <- env:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *wsClient) drop() {
+	c.conn.Close()
+}
+
+func (c *wsClient) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	defer close(c.stopped)
+
+	for {
+		select {
+		case env := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteJSON(env); err != nil {
+				c.conn.Close()
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				c.conn.Close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
 }
 
 type WebSocketServer struct {
-	clients     map[*websocket.Conn]bool
-	broadcast   chan ExtendedTransaction
-	register    chan *websocket.Conn
-	unregister  chan *websocket.Conn
-	repository  *db.TransactionRepository
+	clients    map[subscriber]bool
+	broadcast  chan Event
+	register   chan subscriber
+	unregister chan subscriber
+	repository *db.TransactionRepository
 }
 
 func NewWebSocketServer(repo *db.TransactionRepository) *WebSocketServer {
 	return &WebSocketServer{
-		clients:     make(map[*websocket.Conn]bool),
-		broadcast:   make(chan ExtendedTransaction),
-		register:    make(chan *websocket.Conn),
-		unregister:  make(chan *websocket.Conn),
-		repository:  repo,
+		clients:    make(map[subscriber]bool),
+		broadcast:  make(chan Event),
+		register:   make(chan subscriber),
+		unregister: make(chan subscriber),
+		repository: repo,
 	}
 }
 
@@ -48,23 +199,54 @@ func (s *WebSocketServer) Run() {
 		case client := <-s.register:
 			s.clients[client] = true
 		case client := <-s.unregister:
-			if _, ok := s.clients[client]; ok {
-				delete(s.clients, client)
-				client.Close()
-			}
-		case transaction := <-s.broadcast:
+			delete(s.clients, client)
+		case event := <-s.broadcast:
+			env := event.envelope()
 			for client := range s.clients {
-				err := client.WriteJSON(transaction)
-				if err != nil {
-					client.Close()
+				if !client.wants(event) {
+					continue
+				}
+				if !client.offer(env) {
+					// Slow consumer; drop it rather than stall every other client
 					delete(s.clients, client)
+					client.drop()
 				}
 			}
 		}
 	}
 }
 
+// Publish records an event in the event log and fans it out to every
+// subscribed client allowed to see it.
+func (s *WebSocketServer) Publish(ctx context.Context, event Event) {
+	payload, err := json.Marshal(event.Data)
+	if err != nil {
+		log.Printf("Error encoding %s event: %v", event.Type, err)
+		return
+	}
+
+	logged := db.Event{
+		Topic:    event.Topic,
+		Type:     string(event.Type),
+		Payload:  payload,
+		Audience: event.Audience,
+	}
+	if err := db.AppendEvent(ctx, &logged); err != nil {
+		// Live subscribers still get it; only resumption will miss it
+		log.Printf("Error logging %s event: %v", event.Type, err)
+	}
+	event.ID = logged.ID
+
+	s.broadcast <- event
+}
+
 func (s *WebSocketServer) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
+	userID, err := sessionUserID(r.Context())
+	if err != nil {
+		http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+		return
+	}
+
 	upgrader := websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool {
 			return true
@@ -76,33 +258,167 @@ func (s *WebSocketServer) HandleWebSocket(w http.ResponseWriter, r *http.Request
 		log.Println(err)
 		return
 	}
-	defer conn.Close()
 
-	s.register <- conn
+	client := &wsClient{
+		conn:    conn,
+		userID:  userID,
+		send:    make(chan Envelope, 64),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		topics:  map[string]bool{TopicTransactions: true},
+	}
+	s.register <- client
+	go client.writePump()
+
+	defer func() {
+		s.unregister <- client
+		close(client.done)
+		conn.Close()
+	}()
+
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
 
 	for {
-		var transaction db.Transaction
-		err := conn.ReadJSON(&transaction)
+		_, data, err := conn.ReadMessage()
 		if err != nil {
-			s.unregister <- conn
 			break
 		}
 
-		transaction.ID = uuid.New()
-		transaction.CreatedAt = time.Now()
+		var env Envelope
+		if err := json.Unmarshal(data, &env); err != nil {
+			client.reply(errorEnvelope("", ErrCodeInvalidMessage, "Invalid JSON envelope"))
+			continue
+		}
+		s.handleMessage(client, env)
+	}
+}
+
+// handleMessage dispatches a single client command and answers it with an
+// ack, pong or error carrying the same ID.
+func (s *WebSocketServer) handleMessage(client *wsClient, env Envelope) {
+	switch env.Type {
+	case MessagePing:
+		client.reply(newEnvelope(MessagePong, env.ID, nil))
 
-		err = s.repository.CreateTransaction(&transaction)
+	case MessageSubscribe, MessageUnsubscribe:
+		var payload SubscribePayload
+		if err := json.Unmarshal(env.Payload, &payload); err != nil {
+			client.reply(errorEnvelope(env.ID, ErrCodeInvalidMessage, "Invalid subscribe payload"))
+			return
+		}
+		if err := payload.validate(); err != nil {
+			client.reply(errorEnvelope(env.ID, ErrCodeValidationFailed, err.Error()))
+			return
+		}
+		client.setTopics(payload.Topics, env.Type == MessageSubscribe)
+		client.reply(ackEnvelope(env.ID, payload))
+
+	case MessageCreateTransaction:
+		var payload CreateTransactionPayload
+		if err := json.Unmarshal(env.Payload, &payload); err != nil {
+			client.reply(errorEnvelope(env.ID, ErrCodeInvalidMessage, "Invalid transaction payload"))
+			return
+		}
+		payerID, members, err := payload.validate()
+		if err != nil {
+			client.reply(errorEnvelope(env.ID, ErrCodeValidationFailed, err.Error()))
+			return
+		}
+		if !isParty(client.userID, append([]uuid.UUID{payerID}, members...)...) {
+			client.reply(errorEnvelope(env.ID, ErrCodeForbidden, "Only the payer or a member can record a transaction"))
+			return
+		}
+		occurredOn, err := occurredOnFor(context.Background(), client.userID, payload.OccurredOn)
 		if err != nil {
+			client.reply(errorEnvelope(env.ID, ErrCodeValidationFailed, err.Error()))
+			return
+		}
+
+		transaction := db.Transaction{
+			ID:         uuid.New(),
+			PayerID:    payerID,
+			Amount:     payload.Amount,
+			Members:    members,
+			Remark:     payload.Remark,
+			CreatedAt:  time.Now(),
+			OccurredOn: occurredOn,
+		}
+		if err := s.repository.CreateTransaction(client.userID, &transaction); err != nil {
+			if msg, ok := closedPeriod(err); ok {
+				client.reply(errorEnvelope(env.ID, ErrCodePeriodClosed, msg))
+				return
+			}
 			log.Printf("Error saving transaction: %v", err)
-			continue
+			client.reply(errorEnvelope(env.ID, ErrCodeInternal, "Failed to save transaction"))
+			return
 		}
 
 		extendedTxn := ExtendedTransaction{
 			Transaction: transaction,
 			Type:        TransactionTypeSend,
-			Status:      "PENDING",
 		}
-		s.broadcast <- extendedTxn
+		client.reply(ackEnvelope(env.ID, extendedTxn))
+		s.Publish(context.Background(), Event{
+			Topic:    TopicTransactions,
+			Type:     MessageTransactionCreated,
+			Data:     extendedTxn,
+			Audience: append([]uuid.UUID{transaction.PayerID}, transaction.Members...),
+		})
+
+	case MessageCreatePayment:
+		var payload CreatePaymentPayload
+		if err := json.Unmarshal(env.Payload, &payload); err != nil {
+			client.reply(errorEnvelope(env.ID, ErrCodeInvalidMessage, "Invalid payment payload"))
+			return
+		}
+		payerID, recieverID, err := payload.validate()
+		if err != nil {
+			client.reply(errorEnvelope(env.ID, ErrCodeValidationFailed, err.Error()))
+			return
+		}
+		if !isParty(client.userID, payerID, recieverID) {
+			client.reply(errorEnvelope(env.ID, ErrCodeForbidden, "Only the payer or the reciever can record a payment"))
+			return
+		}
+		occurredOn, err := occurredOnFor(context.Background(), client.userID, payload.OccurredOn)
+		if err != nil {
+			client.reply(errorEnvelope(env.ID, ErrCodeValidationFailed, err.Error()))
+			return
+		}
+
+		payment := db.Payment{
+			ID:         uuid.New(),
+			PayerID:    payerID,
+			Amount:     payload.Amount,
+			RecieverID: recieverID,
+			Remark:     payload.Remark,
+			CreatedAt:  time.Now(),
+			OccurredOn: occurredOn,
+		}
+		if err := s.repository.CreatePayment(client.userID, &payment); err != nil {
+			if msg, ok := closedPeriod(err); ok {
+				client.reply(errorEnvelope(env.ID, ErrCodePeriodClosed, msg))
+				return
+			}
+			log.Printf("Error saving payment: %v", err)
+			client.reply(errorEnvelope(env.ID, ErrCodeInternal, "Failed to save payment"))
+			return
+		}
+
+		client.reply(ackEnvelope(env.ID, payment))
+		s.Publish(context.Background(), Event{
+			Topic:    TopicPayments,
+			Type:     MessagePaymentCreated,
+			Data:     payment,
+			Audience: []uuid.UUID{payment.PayerID, payment.RecieverID},
+		})
+
+	default:
+		client.reply(errorEnvelope(env.ID, ErrCodeUnknownType, "Unknown message type: "+string(env.Type)))
 	}
 }
 
@@ -118,6 +434,9 @@ func NewTransactionController(repo *db.TransactionRepository, ws *WebSocketServe
 	}
 }
 
-func (c *TransactionController) Routes() {
-	http.HandleFunc("/ws/transactions", c.wsServer.HandleWebSocket)
+// Routes registers the realtime endpoints; authenticate wraps handlers that
+// need a verified session.
+func (c *TransactionController) Routes(r *mux.Router, authenticate func(http.HandlerFunc) http.HandlerFunc) {
+	r.HandleFunc("/ws/transactions", authenticate(c.wsServer.HandleWebSocket)).Methods("GET")
+	r.HandleFunc("/events", authenticate(c.wsServer.HandleEventStream)).Methods("GET")
 }
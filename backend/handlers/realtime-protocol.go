@@ -0,0 +1,178 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// MessageType identifies the kind of envelope exchanged over the WebSocket.
+type MessageType string
+
+const (
+	// Client -> server commands
+	MessageCreateTransaction MessageType = "create_transaction"
+	MessageCreatePayment     MessageType = "create_payment"
+	MessageSubscribe         MessageType = "subscribe"
+	MessageUnsubscribe       MessageType = "unsubscribe"
+	MessagePing              MessageType = "ping"
+
+	// Server -> client replies
+	MessageAck   MessageType = "ack"
+	MessageError MessageType = "error"
+	MessagePong  MessageType = "pong"
+
+	// Server -> client events
+	MessageTransactionCreated       MessageType = "transaction.created"
+	MessageTransactionUpdated       MessageType = "transaction.updated"
+	MessageTransactionDeleted       MessageType = "transaction.deleted"
+	MessageTransactionStatusChanged MessageType = "transaction.status_changed"
+	MessageTransactionRestored      MessageType = "transaction.restored"
+	MessageTransactionTagsChanged   MessageType = "transaction.tags_changed"
+	MessagePaymentCreated           MessageType = "payment.created"
+	MessagePaymentUpdated           MessageType = "payment.updated"
+	MessagePaymentDeleted           MessageType = "payment.deleted"
+	MessagePaymentStatusChanged     MessageType = "payment.status_changed"
+	MessagePaymentReminder          MessageType = "payment.reminder"
+	MessagePaymentRestored          MessageType = "payment.restored"
+	MessagePaymentTagsChanged       MessageType = "payment.tags_changed"
+	MessagePaymentRequestCreated    MessageType = "payment_request.created"
+	MessagePaymentRequestAccepted   MessageType = "payment_request.accepted"
+	MessagePaymentRequestDeclined   MessageType = "payment_request.declined"
+	MessagePaymentRequestCancelled  MessageType = "payment_request.cancelled"
+	MessageStoryCreated             MessageType = "story.created"
+	MessageStoryDeleted             MessageType = "story.deleted"
+)
+
+// Topics a connection can subscribe to.
+const (
+	TopicTransactions = "transactions"
+	TopicPayments     = "payments"
+	TopicStories      = "stories"
+)
+
+var allTopics = []string{TopicTransactions, TopicPayments, TopicStories}
+
+var validTopics = map[string]bool{
+	TopicTransactions: true,
+	TopicPayments:     true,
+	TopicStories:      true,
+}
+
+// Error codes carried in error replies.
+const (
+	ErrCodeInvalidMessage   = "invalid_message"
+	ErrCodeUnknownType      = "unknown_type"
+	ErrCodeValidationFailed = "validation_failed"
+	ErrCodeForbidden        = "forbidden"
+	ErrCodePeriodClosed     = "period_closed"
+	ErrCodeInternal         = "internal_error"
+)
+
+// Envelope is the frame format for every WebSocket message. ID is chosen by
+// the client and echoed back on the ack or error that answers it; EventID is
+// the event log position of server events.
+type Envelope struct {
+	Type    MessageType     `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	EventID int64           `json:"event_id,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+type ErrorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type SubscribePayload struct {
+	Topics []string `json:"topics"`
+}
+
+type CreateTransactionPayload struct {
+	PayerID    string   `json:"payer_id"`
+	Amount     float64  `json:"amount"`
+	Members    []string `json:"members"`
+	Remark     string   `json:"remark"`
+	OccurredOn string   `json:"occurred_on,omitempty"`
+}
+
+type CreatePaymentPayload struct {
+	PayerID    string  `json:"payer_id"`
+	Amount     float64 `json:"amount"`
+	RecieverID string  `json:"reciever_id"`
+	Remark     string  `json:"remark"`
+	OccurredOn string  `json:"occurred_on,omitempty"`
+}
+
+// newEnvelope marshals payload into an envelope of the given type.
+func newEnvelope(msgType MessageType, id string, payload interface{}) Envelope {
+	env := Envelope{Type: msgType, ID: id}
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err == nil {
+			env.Payload = data
+		}
+	}
+	return env
+}
+
+func ackEnvelope(id string, payload interface{}) Envelope {
+	return newEnvelope(MessageAck, id, payload)
+}
+
+func errorEnvelope(id, code, message string) Envelope {
+	return newEnvelope(MessageError, id, ErrorPayload{Code: code, Message: message})
+}
+
+func (p CreateTransactionPayload) validate() (payerID uuid.UUID, members []uuid.UUID, err error) {
+	payerID, err = uuid.Parse(p.PayerID)
+	if err != nil {
+		return uuid.Nil, nil, fmt.Errorf("invalid payer_id")
+	}
+	if p.Amount <= 0 {
+		return uuid.Nil, nil, fmt.Errorf("amount must be greater than zero")
+	}
+	if len(p.Members) == 0 {
+		return uuid.Nil, nil, fmt.Errorf("members cannot be empty")
+	}
+	for _, member := range p.Members {
+		memberID, err := uuid.Parse(member)
+		if err != nil {
+			return uuid.Nil, nil, fmt.Errorf("invalid member id %q", member)
+		}
+		members = append(members, memberID)
+	}
+	return payerID, members, nil
+}
+
+func (p CreatePaymentPayload) validate() (payerID, recieverID uuid.UUID, err error) {
+	payerID, err = uuid.Parse(p.PayerID)
+	if err != nil {
+		return uuid.Nil, uuid.Nil, fmt.Errorf("invalid payer_id")
+	}
+	recieverID, err = uuid.Parse(p.RecieverID)
+	if err != nil {
+		return uuid.Nil, uuid.Nil, fmt.Errorf("invalid reciever_id")
+	}
+	if payerID == recieverID {
+		return uuid.Nil, uuid.Nil, fmt.Errorf("payer and reciever must differ")
+	}
+	if p.Amount <= 0 {
+		return uuid.Nil, uuid.Nil, fmt.Errorf("amount must be greater than zero")
+	}
+	return payerID, recieverID, nil
+}
+
+func (p SubscribePayload) validate() error {
+	if len(p.Topics) == 0 {
+		return fmt.Errorf("topics cannot be empty")
+	}
+	for _, topic := range p.Topics {
+		if !validTopics[topic] {
+			return fmt.Errorf("unknown topic %q (expected one of %s)", topic, strings.Join(allTopics, ", "))
+		}
+	}
+	return nil
+}
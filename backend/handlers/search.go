@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ishushreyas/expense-tracker/db"
+	"github.com/jackc/pgx/v5"
+)
+
+// SearchResult is one match from /search. Snippet is HTML-escaped text with
+// the matched words wrapped in <mark>.
+type SearchResult struct {
+	Type      string    `json:"type" db:"type"`
+	ID        string    `json:"id" db:"id"`
+	Snippet   string    `json:"snippet" db:"snippet"`
+	Amount    *float64  `json:"amount,omitempty" db:"amount"`
+	Rank      float32   `json:"rank" db:"rank"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+// Markers ts_headline puts around matches, swapped for <mark> once the
+// snippet has been escaped.
+const (
+	searchStartSel = "\x01"
+	searchStopSel  = "\x02"
+)
+
+// searchSources are the queries /search can run, by result type. Each
+// matches the search terms against the same expression its GIN index in
+// the schema is built on, and only returns what the caller may see.
+var searchSources = map[string]string{
+	"transaction": `
+		SELECT 'transaction' AS type, id::text AS id,
+			ts_headline('english', COALESCE(remark, ''), q, search.headline) AS snippet, amount::double precision AS amount,
+			ts_rank(to_tsvector('english', COALESCE(remark, '')), q) AS rank, created_at
+		FROM transactions, search, websearch_to_tsquery('english', search.terms) q
+		WHERE to_tsvector('english', COALESCE(remark, '')) @@ q
+		AND is_deleted = false
+		AND (payer_id = search.caller OR search.caller = ANY(members))`,
+	"payment": `
+		SELECT 'payment' AS type, id::text AS id,
+			ts_headline('english', COALESCE(remark, ''), q, search.headline) AS snippet, amount::double precision AS amount,
+			ts_rank(to_tsvector('english', COALESCE(remark, '')), q) AS rank, created_at
+		FROM payments, search, websearch_to_tsquery('english', search.terms) q
+		WHERE to_tsvector('english', COALESCE(remark, '')) @@ q
+		AND is_deleted = false
+		AND (payer_id = search.caller OR reciever_id = search.caller)`,
+	"story": `
+		SELECT 'story' AS type, id::text AS id,
+			ts_headline('english', COALESCE(content, ''), q, search.headline) AS snippet, NULL::double precision AS amount,
+			ts_rank(to_tsvector('english', COALESCE(content, '')), q) AS rank, timestamp AS created_at
+		FROM stories, search, websearch_to_tsquery('english', search.terms) q
+		WHERE to_tsvector('english', COALESCE(content, '')) @@ q`,
+	"user": `
+		SELECT 'user' AS type, id::text AS id,
+			ts_headline('simple', COALESCE(username, '') || ' ' || COALESCE(name, ''), q, search.headline) AS snippet, NULL::double precision AS amount,
+			ts_rank(to_tsvector('simple', COALESCE(username, '') || ' ' || COALESCE(name, '')), q) AS rank, created_at
+		FROM users, search, websearch_to_tsquery('simple', search.terms) q
+		WHERE to_tsvector('simple', COALESCE(username, '') || ' ' || COALESCE(name, '')) @@ q`,
+}
+
+var searchTypes = []string{"transaction", "payment", "story", "user"}
+
+// Search runs a full-text search over transaction and payment remarks,
+// story content and user names, best matches first. ?q= takes web search
+// syntax ("quoted phrases", or, -excluded); ?type= narrows it to a comma
+// separated list of result types. Transactions and payments the caller is
+// not part of are left out.
+func Search(w http.ResponseWriter, r *http.Request) {
+	// Create context with timeout
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	userID, err := sessionUserID(ctx)
+	if err != nil {
+		http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+		return
+	}
+
+	query := r.URL.Query()
+	q := strings.TrimSpace(query.Get("q"))
+	if q == "" {
+		http.Error(w, "Search query q is required", http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultPageLimit
+	if limitStr := query.Get("limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 || limit > maxPageLimit {
+			http.Error(w, fmt.Sprintf("Invalid limit, expected 1 to %d", maxPageLimit), http.StatusBadRequest)
+			return
+		}
+	}
+
+	types := searchTypes
+	if typeParam := query.Get("type"); typeParam != "" {
+		types = strings.Split(typeParam, ",")
+	}
+	var sources []string
+	for _, t := range types {
+		source, ok := searchSources[strings.TrimSpace(t)]
+		if !ok {
+			http.Error(w, "Invalid type "+t+", expected "+strings.Join(searchTypes, ", "), http.StatusBadRequest)
+			return
+		}
+		sources = append(sources, source)
+	}
+
+	headline := fmt.Sprintf("StartSel=%s, StopSel=%s, MaxFragments=2, MaxWords=20, MinWords=5", searchStartSel, searchStopSel)
+	sqlQuery := `
+		WITH search AS (SELECT $1::text AS terms, $2::uuid AS caller, $4::text AS headline)
+		SELECT * FROM (` + strings.Join(sources, " UNION ALL ") + `) results
+		ORDER BY rank DESC, created_at DESC LIMIT $3`
+
+	rows, err := db.Pool.Query(ctx, sqlQuery, q, userID, limit, headline)
+	if err != nil {
+		http.Error(w, "Failed to search: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	results, err := pgx.CollectRows(rows, pgx.RowToStructByName[SearchResult])
+	if err != nil {
+		http.Error(w, "Failed to process search results: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for i := range results {
+		results[i].Snippet = highlight(results[i].Snippet)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"query":   q,
+		"results": results,
+	})
+}
+
+// highlight escapes a ts_headline snippet for HTML and marks its matches.
+func highlight(snippet string) string {
+	return strings.NewReplacer(searchStartSel, "<mark>", searchStopSel, "</mark>").Replace(html.EscapeString(snippet))
+}
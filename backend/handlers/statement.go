@@ -0,0 +1,343 @@
+package handlers
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/ishushreyas/expense-tracker/db"
+	"github.com/ishushreyas/expense-tracker/ledger"
+	"github.com/ishushreyas/expense-tracker/report"
+	"github.com/jackc/pgx/v5"
+)
+
+// StatementEntry is one line of a member's statement. Paid is what the
+// member put in, Share what the record cost them, and Effect the change to
+// their balance (Paid - Share for expenses, +/- the amount for payments).
+// Date is the day the record occurred on.
+type StatementEntry struct {
+	Date      time.Time `json:"date"`
+	CreatedAt time.Time `json:"created_at"`
+	Kind      string    `json:"kind"`
+	ID        uuid.UUID `json:"id"`
+	Remark    string    `json:"remark"`
+	Amount    float64   `json:"amount"`
+	Paid      float64   `json:"paid"`
+	Share     float64   `json:"share"`
+	Received  float64   `json:"received"`
+	Effect    float64   `json:"effect"`
+	Balance   float64   `json:"balance"`
+}
+
+// loadStatement returns every expense and confirmed payment affecting
+// userID that occurred on or before until, oldest first, with running
+// balances. These are the same records the ledger counts.
+func loadStatement(ctx context.Context, userID uuid.UUID, until *time.Time) ([]StatementEntry, error) {
+	var entries []StatementEntry
+
+	rows, err := db.Pool.Query(ctx, `
+		SELECT id, payer_id, amount, members, remark, occurred_on, created_at
+		FROM transactions
+		WHERE is_deleted = false
+		AND status <> 'rejected'
+		AND (payer_id = $1 OR $1 = ANY(members))
+		AND ($2::date IS NULL OR occurred_on <= $2)
+	`, userID, until)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var (
+			e                     ledger.Expense
+			remark                string
+			occurredOn, createdAt time.Time
+		)
+		if err := rows.Scan(&e.ID, &e.PayerID, &e.Amount, &e.Members, &remark, &occurredOn, &createdAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		shares := ledger.Shares(e)
+		if shares == nil {
+			continue
+		}
+		entry := StatementEntry{Date: occurredOn, CreatedAt: createdAt, Kind: ledger.KindExpense, ID: e.ID, Remark: remark, Amount: e.Amount, Share: shares[userID]}
+		if e.PayerID == userID {
+			entry.Paid = e.Amount
+		}
+		entry.Effect = entry.Paid - entry.Share
+		entries = append(entries, entry)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.Pool.Query(ctx, `
+		SELECT id, payer_id, reciever_id, amount, remark, occurred_on, created_at
+		FROM payments
+		WHERE is_deleted = false
+		AND status = 'confirmed'
+		AND (payer_id = $1 OR reciever_id = $1)
+		AND payer_id <> reciever_id
+		AND ($2::date IS NULL OR occurred_on <= $2)
+	`, userID, until)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			entry               StatementEntry
+			payerID, recieverID uuid.UUID
+		)
+		if err := rows.Scan(&entry.ID, &payerID, &recieverID, &entry.Amount, &entry.Remark, &entry.Date, &entry.CreatedAt); err != nil {
+			return nil, err
+		}
+		entry.Kind = ledger.KindSettlement
+		if payerID == userID {
+			entry.Paid = entry.Amount
+			entry.Effect = entry.Amount
+		} else {
+			entry.Received = entry.Amount
+			entry.Effect = -entry.Amount
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Records from the same day run in the order they were entered
+	sort.SliceStable(entries, func(i, j int) bool {
+		if !entries[i].Date.Equal(entries[j].Date) {
+			return entries[i].Date.Before(entries[j].Date)
+		}
+		return entries[i].CreatedAt.Before(entries[j].CreatedAt)
+	})
+
+	var balance float64
+	for i := range entries {
+		balance += entries[i].Effect
+		entries[i].Balance = ledger.Round(balance)
+		entries[i].Share = ledger.Round(entries[i].Share)
+		entries[i].Effect = ledger.Round(entries[i].Effect)
+	}
+	return entries, nil
+}
+
+// GetUserStatement lists everything a member paid or took part in between
+// start_date and end_date (inclusive), with their share of each and a
+// running balance carried forward from before the period. Pages with
+// ?page=&limit=; ?format=csv or ?format=pdf downloads the whole period in
+// the caller's locale.
+func GetUserStatement(w http.ResponseWriter, r *http.Request) {
+	// Create context with timeout
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	userID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID format", http.StatusBadRequest)
+		return
+	}
+
+	var username string
+	err = db.Pool.QueryRow(ctx, "SELECT username FROM users WHERE id = $1", userID).Scan(&username)
+	if err == pgx.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to retrieve user: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	query := r.URL.Query()
+
+	prefs, err := preferencesFor(ctx, query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The period covers the days records occurred on
+	var start, until *time.Time
+	if startDate := query.Get("start_date"); startDate != "" {
+		parsed, err := time.Parse("2006-01-02", startDate)
+		if err != nil {
+			http.Error(w, "Invalid start_date, expected YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+		start = &parsed
+	}
+	if endDate := query.Get("end_date"); endDate != "" {
+		parsed, err := time.Parse("2006-01-02", endDate)
+		if err != nil {
+			http.Error(w, "Invalid end_date, expected YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+		until = &parsed
+	}
+
+	all, err := loadStatement(ctx, userID, until)
+	if err != nil {
+		http.Error(w, "Failed to build statement: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Everything before the period only contributes to the opening balance
+	var opening float64
+	entries := all
+	if start != nil {
+		i := sort.Search(len(all), func(i int) bool { return !all[i].Date.Before(*start) })
+		if i > 0 {
+			opening = all[i-1].Balance
+		}
+		entries = all[i:]
+	}
+	closing := opening
+	if len(entries) > 0 {
+		closing = entries[len(entries)-1].Balance
+	}
+
+	period := map[string]string{
+		"start_date": query.Get("start_date"),
+		"end_date":   query.Get("end_date"),
+	}
+
+	switch query.Get("format") {
+	case "csv":
+		writeStatementCSV(w, prefs, username, opening, closing, entries)
+		return
+	case "pdf":
+		writeStatementPDF(w, prefs, username, period, opening, closing, entries)
+		return
+	}
+
+	// Default pagination
+	page := 1
+	limit := 50
+	if pageStr := query.Get("page"); pageStr != "" {
+		if p, err := strconv.Atoi(pageStr); err == nil && p > 0 {
+			page = p
+		}
+	}
+	if limitStr := query.Get("limit"); limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 && l <= 500 {
+			limit = l
+		}
+	}
+
+	total := len(entries)
+	from := (page - 1) * limit
+	if from > total {
+		from = total
+	}
+	to := from + limit
+	if to > total {
+		to = total
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user":            map[string]interface{}{"id": userID, "username": username},
+		"period":          period,
+		"opening_balance": opening,
+		"closing_balance": closing,
+		"entries":         entries[from:to],
+		"page":            page,
+		"limit":           limit,
+		"total":           total,
+		"total_pages":     (total + limit - 1) / limit,
+	})
+}
+
+func statementDescription(e StatementEntry) string {
+	if e.Kind == ledger.KindSettlement {
+		if e.Paid > 0 {
+			return "Payment sent"
+		}
+		return "Payment received"
+	}
+	if e.Remark == "" {
+		return "Expense"
+	}
+	return e.Remark
+}
+
+// attachment is the Content-Disposition for downloading filename, quoted
+// or RFC 2231 encoded as its characters need.
+func attachment(filename string) string {
+	if disposition := mime.FormatMediaType("attachment", map[string]string{"filename": filename}); disposition != "" {
+		return disposition
+	}
+	return "attachment"
+}
+
+func writeStatementCSV(w http.ResponseWriter, prefs requestPreferences, username string, opening, closing float64, entries []StatementEntry) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", attachment("statement-"+username+".csv"))
+
+	out := csv.NewWriter(w)
+	out.Write([]string{"date", "kind", "id", "description", "amount", "paid", "share", "received", "effect", "balance"})
+	out.Write([]string{"", "", "", "Opening balance", "", "", "", "", "", prefs.Locale.Amount(opening)})
+	for _, e := range entries {
+		out.Write([]string{
+			prefs.Locale.Date(e.Date),
+			e.Kind,
+			e.ID.String(),
+			statementDescription(e),
+			prefs.Locale.Amount(e.Amount),
+			prefs.Locale.Amount(e.Paid),
+			prefs.Locale.Amount(e.Share),
+			prefs.Locale.Amount(e.Received),
+			prefs.Locale.Amount(e.Effect),
+			prefs.Locale.Amount(e.Balance),
+		})
+	}
+	out.Write([]string{"", "", "", "Closing balance", "", "", "", "", "", prefs.Locale.Amount(closing)})
+	out.Flush()
+}
+
+func writeStatementPDF(w http.ResponseWriter, prefs requestPreferences, username string, period map[string]string, opening, closing float64, entries []StatementEntry) {
+	from, to := period["start_date"], period["end_date"]
+	if from == "" {
+		from = "beginning"
+	}
+	if to == "" {
+		to = "today"
+	}
+
+	row := "%-10s  %-34.34s  %10s  %10s  %10s  %11s"
+	lines := []string{
+		"Statement for " + username,
+		fmt.Sprintf("Period: %s to %s", from, to),
+		"",
+		fmt.Sprintf(row, "Date", "Description", "Paid", "Share", "Received", "Balance"),
+		fmt.Sprintf(row, "", "Opening balance", "", "", "", prefs.Locale.Amount(opening)),
+	}
+	for _, e := range entries {
+		lines = append(lines, fmt.Sprintf(row,
+			prefs.Locale.Date(e.Date),
+			statementDescription(e),
+			prefs.Locale.Amount(e.Paid),
+			prefs.Locale.Amount(e.Share),
+			prefs.Locale.Amount(e.Received),
+			prefs.Locale.Amount(e.Balance),
+		))
+	}
+	lines = append(lines, fmt.Sprintf(row, "", "Closing balance", "", "", "", prefs.Locale.Amount(closing)))
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", attachment("statement-"+username+".pdf"))
+	if err := report.WritePDF(w, "Statement for "+username, lines); err != nil {
+		http.Error(w, "Failed to write PDF: "+err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,21 @@
+package handlers
+
+import (
+	"mime"
+	"testing"
+)
+
+func TestAttachmentEscapesFilename(t *testing.T) {
+	for _, username := range []string{"ann", `a"b\c`, "jöns", "x\r\nSet-Cookie: y=z", "a; filename=evil.exe"} {
+		filename := "statement-" + username + ".pdf"
+		disposition := attachment(filename)
+		kind, params, err := mime.ParseMediaType(disposition)
+		if err != nil {
+			t.Errorf("%q: %q does not parse: %v", username, disposition, err)
+			continue
+		}
+		if kind != "attachment" || params["filename"] != filename {
+			t.Errorf("%q: %q parses as %s %q", username, disposition, kind, params["filename"])
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package handlers
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ishushreyas/expense-tracker/db"
+	"github.com/ishushreyas/expense-tracker/ledger"
+	"github.com/jackc/pgx/v5"
+)
+
+// summaryOptions select the transactions a summary covers. Dates match,
+// and days are bucketed by, the day each transaction occurred on.
+type summaryOptions struct {
+	StartDate     string
+	EndDate       string
+	ConfirmedOnly bool
+	AsOf          *time.Time
+}
+
+func (o summaryOptions) args() []interface{} {
+	return []interface{}{o.StartDate, o.EndDate, o.ConfirmedOnly, o.AsOf}
+}
+
+// allTime reports whether the summary covers every live transaction as it
+// stands now.
+func (o summaryOptions) allTime() bool {
+	return o.StartDate == "" && o.EndDate == "" && !o.ConfirmedOnly && o.AsOf == nil
+}
+
+// summarySource is the CTE every summary query aggregates over.
+func summarySource() string {
+	return `
+		WITH filtered AS (
+			SELECT t.id, t.payer_id, t.amount, t.members, t.occurred_on
+			FROM ` + db.TransactionsAsOf("$4") + ` t
+			WHERE t.is_deleted = false
+			AND t.status <> 'rejected'
+			AND (NOT $3 OR t.status = 'confirmed')
+			AND ($1 = '' OR t.occurred_on >= $1::date)
+			AND ($2 = '' OR t.occurred_on <= $2::date)
+		)`
+}
+
+type summaryUser struct {
+	ID       uuid.UUID `json:"id"`
+	Username string    `json:"username"`
+	Email    string    `json:"email"`
+}
+
+type dailyTrend struct {
+	Date      string  `json:"date"`
+	Total     float64 `json:"total"`
+	Count     int     `json:"count"`
+	MaxAmount float64 `json:"max_amount"`
+	AvgAmount float64 `json:"avg_amount"`
+}
+
+// transactionSummary is what GenerateSummary reports about spending.
+type transactionSummary struct {
+	TotalExpense       float64
+	TransactionCount   int
+	AverageTransaction float64
+	LargestTransaction float64
+	ActiveUsers        int
+	UserExpenses       map[uuid.UUID]float64
+	UserBalances       map[uuid.UUID]float64
+	TagExpenses        map[string]float64
+	DailyTrends        []dailyTrend
+	Users              []summaryUser
+}
+
+// summarizeTransactions aggregates the summary in the database, in one
+// round trip. Balances follow the ledger package: each expense with
+// members credits its payer in full and debits every distinct member an
+// equal share. Unfiltered summaries read them from the running balances.
+// Either way, members whose balance rounds to zero are left out.
+func summarizeTransactions(ctx context.Context, opts summaryOptions) (*transactionSummary, error) {
+	source := summarySource()
+	args := opts.args()
+
+	batch := &pgx.Batch{}
+	batch.Queue(source+`
+		SELECT COUNT(*), COALESCE(SUM(amount), 0), COALESCE(MAX(amount), 0), COUNT(DISTINCT payer_id)
+		FROM filtered`, args...)
+	batch.Queue(source+`
+		SELECT f.payer_id, SUM(f.amount), COALESCE(u.username, ''), COALESCE(u.email, '')
+		FROM filtered f
+		LEFT JOIN users u ON u.id = f.payer_id
+		GROUP BY f.payer_id, u.username, u.email`, args...)
+	if opts.allTime() {
+		// Everything, as of now, is what the running balances hold
+		batch.Queue(`SELECT user_id, expense_net::float8 FROM member_balances`)
+	} else {
+		batch.Queue(source+`, shares AS (
+				SELECT m.member, f.amount / COUNT(*) OVER (PARTITION BY f.id) AS share
+				FROM filtered f, LATERAL (SELECT DISTINCT unnest(f.members) AS member) m
+			)
+			SELECT user_id, SUM(delta) FROM (
+				SELECT payer_id AS user_id, amount AS delta FROM filtered WHERE cardinality(members) > 0
+				UNION ALL
+				SELECT member, -share FROM shares
+			) changes
+			GROUP BY user_id`, args...)
+	}
+	batch.Queue(source+`
+		SELECT to_char(occurred_on, 'YYYY-MM-DD'), COUNT(*), SUM(amount), MAX(amount)
+		FROM filtered
+		GROUP BY occurred_on
+		ORDER BY occurred_on`, args...)
+	batch.Queue(source+`
+		SELECT tags.name, SUM(f.amount)
+		FROM filtered f
+		JOIN transaction_tags link ON link.transaction_id = f.id
+		JOIN tags ON tags.id = link.tag_id
+		GROUP BY tags.name`, args...)
+
+	results := db.Pool.SendBatch(ctx, batch)
+	defer results.Close()
+
+	summary := &transactionSummary{
+		UserExpenses: make(map[uuid.UUID]float64),
+		UserBalances: make(map[uuid.UUID]float64),
+		TagExpenses:  make(map[string]float64),
+		Users:        []summaryUser{},
+	}
+
+	err := results.QueryRow().Scan(&summary.TransactionCount, &summary.TotalExpense, &summary.LargestTransaction, &summary.ActiveUsers)
+	if err != nil {
+		return nil, err
+	}
+	if summary.TransactionCount > 0 {
+		summary.AverageTransaction = summary.TotalExpense / float64(summary.TransactionCount)
+	}
+
+	rows, err := results.Query()
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var (
+			user  summaryUser
+			total float64
+		)
+		if err := rows.Scan(&user.ID, &total, &user.Username, &user.Email); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		summary.UserExpenses[user.ID] = total
+		summary.Users = append(summary.Users, user)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = results.Query()
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var (
+			userID uuid.UUID
+			net    float64
+		)
+		if err := rows.Scan(&userID, &net); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if net := ledger.Round(net); net != 0 {
+			summary.UserBalances[userID] = net
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = results.Query()
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var day dailyTrend
+		if err := rows.Scan(&day.Date, &day.Count, &day.Total, &day.MaxAmount); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		day.AvgAmount = day.Total / float64(day.Count)
+		summary.DailyTrends = append(summary.DailyTrends, day)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = results.Query()
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var (
+			name  string
+			total float64
+		)
+		if err := rows.Scan(&name, &total); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		summary.TagExpenses[name] = total
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return summary, nil
+}
@@ -0,0 +1,395 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ishushreyas/expense-tracker/db"
+	"github.com/ishushreyas/expense-tracker/ledger"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// These run against a real Postgres named by TEST_DATABASE_URL, in a
+// throwaway schema, and are skipped without one. CI provides one (see
+// .github/workflows/backend.yml).
+
+// baseSchema stands in for the tables the migrations build on.
+var baseSchema = []string{
+	`CREATE TABLE users (
+		id UUID PRIMARY KEY,
+		username TEXT,
+		name TEXT,
+		email TEXT
+	)`,
+	`CREATE TABLE transactions (
+		id UUID PRIMARY KEY,
+		payer_id UUID NOT NULL,
+		amount DOUBLE PRECISION NOT NULL,
+		members UUID[] NOT NULL DEFAULT '{}',
+		remark TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		is_deleted BOOLEAN NOT NULL DEFAULT false,
+		deleted_at TIMESTAMPTZ
+	)`,
+	`CREATE TABLE payments (
+		id UUID PRIMARY KEY,
+		payer_id UUID NOT NULL,
+		reciever_id UUID NOT NULL,
+		amount DOUBLE PRECISION NOT NULL,
+		remark TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		is_deleted BOOLEAN NOT NULL DEFAULT false,
+		deleted_at TIMESTAMPTZ
+	)`,
+	`CREATE TABLE stories (
+		id BIGSERIAL PRIMARY KEY,
+		username TEXT,
+		content TEXT,
+		image_url TEXT,
+		timestamp TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+}
+
+// testDatabase points db.Pool at a fresh, migrated schema for the test.
+func testDatabase(tb testing.TB) {
+	tb.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		tb.Skip("TEST_DATABASE_URL not set")
+	}
+	ctx := context.Background()
+	schema := fmt.Sprintf("summary_test_%d", time.Now().UnixNano())
+
+	conn, err := pgx.Connect(ctx, url)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer conn.Close(ctx)
+	if _, err := conn.Exec(ctx, "CREATE SCHEMA "+schema); err != nil {
+		tb.Fatal(err)
+	}
+
+	config, err := pgxpool.ParseConfig(url)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	config.ConnConfig.RuntimeParams["search_path"] = schema
+	config.ConnConfig.RuntimeParams["timezone"] = "UTC"
+	pool, err := pgxpool.NewWithConfig(ctx, config)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	previous := db.Pool
+	db.Pool = pool
+	tb.Cleanup(func() {
+		db.Pool = previous
+		pool.Close()
+		conn, err := pgx.Connect(context.Background(), url)
+		if err != nil {
+			tb.Error(err)
+			return
+		}
+		defer conn.Close(context.Background())
+		if _, err := conn.Exec(context.Background(), "DROP SCHEMA "+schema+" CASCADE"); err != nil {
+			tb.Error(err)
+		}
+	})
+
+	for _, stmt := range baseSchema {
+		if _, err := pool.Exec(ctx, stmt); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	if err := db.Migrate(ctx); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// seedTransactions fills the test schema with n transactions between a few
+// dozen users over three years, some deleted, rejected or tagged.
+func seedTransactions(tb testing.TB, n int) {
+	tb.Helper()
+	ctx := context.Background()
+	random := rand.New(rand.NewSource(1))
+
+	users := make([]uuid.UUID, 25)
+	var userRows [][]interface{}
+	for i := range users {
+		users[i] = uuid.New()
+		userRows = append(userRows, []interface{}{users[i], fmt.Sprintf("user%d", i), fmt.Sprintf("user%d@example.com", i)})
+	}
+	if _, err := db.Pool.CopyFrom(ctx, pgx.Identifier{"users"}, []string{"id", "username", "email"}, pgx.CopyFromRows(userRows)); err != nil {
+		tb.Fatal(err)
+	}
+
+	statuses := []string{"pending", "confirmed", "confirmed", "disputed", "rejected"}
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	var transactionRows, tagRows [][]interface{}
+	for i := 0; i < n; i++ {
+		id := uuid.New()
+		members := make([]uuid.UUID, random.Intn(5))
+		for j := range members {
+			members[j] = users[random.Intn(len(users))]
+		}
+		createdAt := start.Add(time.Duration(random.Int63n(int64(3 * 365 * 24 * time.Hour))))
+		// Some expenses are entered a few days after they happened
+		occurredOn := createdAt.AddDate(0, 0, -random.Intn(7)).Truncate(24 * time.Hour)
+		deleted := random.Intn(20) == 0
+		var deletedAt *time.Time
+		if deleted {
+			deletedAt = &createdAt
+		}
+		transactionRows = append(transactionRows, []interface{}{
+			id, users[random.Intn(len(users))], float64(random.Intn(100000)) / 100, members,
+			"expense", statuses[random.Intn(len(statuses))], createdAt, occurredOn, deleted, deletedAt,
+		})
+		if random.Intn(3) == 0 {
+			tagRows = append(tagRows, []interface{}{id, int64(random.Intn(5) + 1)})
+		}
+	}
+	_, err := db.Pool.CopyFrom(ctx, pgx.Identifier{"transactions"},
+		[]string{"id", "payer_id", "amount", "members", "remark", "status", "created_at", "occurred_on", "is_deleted", "deleted_at"},
+		pgx.CopyFromRows(transactionRows))
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	if _, err := db.Pool.Exec(ctx, `INSERT INTO tags (name) SELECT 'tag-' || i FROM generate_series(1, 5) i`); err != nil {
+		tb.Fatal(err)
+	}
+	if _, err := db.Pool.CopyFrom(ctx, pgx.Identifier{"transaction_tags"}, []string{"transaction_id", "tag_id"}, pgx.CopyFromRows(tagRows)); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// seedPayments adds n settlements between random pairs of the seeded
+// users, both ways round and with mixed statuses.
+func seedPayments(tb testing.TB, n int) {
+	tb.Helper()
+	_, err := db.Pool.Exec(context.Background(), `
+		INSERT INTO payments (id, payer_id, reciever_id, amount, remark, status, created_at)
+		SELECT gen_random_uuid(), a.id, b.id, round((random() * 500)::numeric, 2), 'settlement',
+			(ARRAY['pending', 'confirmed', 'confirmed', 'rejected'])[1 + floor(random() * 4)::int],
+			now() - random() * interval '3 years'
+		FROM users a CROSS JOIN users b
+		WHERE a.id <> b.id
+		ORDER BY random() LIMIT $1
+	`, n)
+	if err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// summarizeInMemory is how GenerateSummary used to work: load every
+// transaction and aggregate in Go. It is kept as the reference the SQL
+// aggregation is checked and benchmarked against.
+func summarizeInMemory(ctx context.Context, opts summaryOptions) (*transactionSummary, error) {
+	rows, err := db.Pool.Query(ctx, `
+		SELECT t.id, t.payer_id, t.amount, t.members, t.occurred_on, u.username, u.email
+		FROM `+db.TransactionsAsOf("$4")+` t
+		LEFT JOIN users u ON t.payer_id = u.id
+		WHERE t.is_deleted = false
+		AND t.status <> 'rejected'
+		AND (NOT $3 OR t.status = 'confirmed')
+		AND ($1 = '' OR t.occurred_on >= $1::date)
+		AND ($2 = '' OR t.occurred_on <= $2::date)
+	`, opts.args()...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	summary := &transactionSummary{
+		UserExpenses: make(map[uuid.UUID]float64),
+		UserBalances: make(map[uuid.UUID]float64),
+		TagExpenses:  make(map[string]float64),
+	}
+	balances := ledger.New()
+	users := make(map[uuid.UUID]summaryUser)
+	daily := make(map[string]*dailyTrend)
+	var (
+		ids     []uuid.UUID
+		amounts []float64
+	)
+	for rows.Next() {
+		var (
+			t    Transaction
+			user summaryUser
+		)
+		if err := rows.Scan(&t.ID, &t.PayerID, &t.Amount, &t.Members, &t.OccurredOn, &user.Username, &user.Email); err != nil {
+			return nil, err
+		}
+		user.ID = t.PayerID
+		users[t.PayerID] = user
+
+		summary.TransactionCount++
+		summary.TotalExpense += t.Amount
+		summary.UserExpenses[t.PayerID] += t.Amount
+		summary.LargestTransaction = math.Max(summary.LargestTransaction, t.Amount)
+		balances.AddExpense(ledger.Expense{ID: t.ID, PayerID: t.PayerID, Amount: t.Amount, Members: t.Members})
+
+		date := t.OccurredOn.Format("2006-01-02")
+		if daily[date] == nil {
+			daily[date] = &dailyTrend{Date: date}
+		}
+		daily[date].Count++
+		daily[date].Total += t.Amount
+		daily[date].MaxAmount = math.Max(daily[date].MaxAmount, t.Amount)
+
+		ids = append(ids, t.ID)
+		amounts = append(amounts, t.Amount)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if summary.TransactionCount > 0 {
+		summary.AverageTransaction = summary.TotalExpense / float64(summary.TransactionCount)
+	}
+	summary.ActiveUsers = len(summary.UserExpenses)
+	for userID, net := range balances.Balances() {
+		if net != 0 {
+			summary.UserBalances[userID] = net
+		}
+	}
+	for _, user := range users {
+		summary.Users = append(summary.Users, user)
+	}
+	for _, day := range daily {
+		day.AvgAmount = day.Total / float64(day.Count)
+		summary.DailyTrends = append(summary.DailyTrends, *day)
+	}
+	sort.Slice(summary.DailyTrends, func(i, j int) bool {
+		return summary.DailyTrends[i].Date < summary.DailyTrends[j].Date
+	})
+
+	tagRows, err := db.Pool.Query(ctx, `
+		SELECT tags.name, SUM(t.amount)
+		FROM unnest($1::uuid[], $2::float8[]) AS t(id, amount)
+		JOIN transaction_tags link ON link.transaction_id = t.id
+		JOIN tags ON tags.id = link.tag_id
+		GROUP BY tags.name
+	`, ids, amounts)
+	if err != nil {
+		return nil, err
+	}
+	defer tagRows.Close()
+	for tagRows.Next() {
+		var (
+			name  string
+			total float64
+		)
+		if err := tagRows.Scan(&name, &total); err != nil {
+			return nil, err
+		}
+		summary.TagExpenses[name] = total
+	}
+	return summary, tagRows.Err()
+}
+
+func approxEqual(a, b, tolerance float64) bool {
+	return math.Abs(a-b) <= tolerance*math.Max(1, math.Abs(a))
+}
+
+func TestSummarizeTransactionsMatchesInMemory(t *testing.T) {
+	testDatabase(t)
+	seedTransactions(t, 2000)
+	ctx := context.Background()
+
+	for _, opts := range []summaryOptions{
+		{},
+		{ConfirmedOnly: true},
+		{StartDate: "2023-01-01", EndDate: "2023-06-30"},
+		{StartDate: "2023-03-15", EndDate: "2023-03-15"},
+	} {
+		want, err := summarizeInMemory(ctx, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := summarizeTransactions(ctx, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got.TransactionCount != want.TransactionCount || got.ActiveUsers != want.ActiveUsers {
+			t.Errorf("%+v: count %d, active %d, want %d, %d", opts, got.TransactionCount, got.ActiveUsers, want.TransactionCount, want.ActiveUsers)
+		}
+		for name, pair := range map[string][2]float64{
+			"total":   {got.TotalExpense, want.TotalExpense},
+			"average": {got.AverageTransaction, want.AverageTransaction},
+			"largest": {got.LargestTransaction, want.LargestTransaction},
+		} {
+			if !approxEqual(pair[0], pair[1], 1e-9) {
+				t.Errorf("%+v: %s = %v, want %v", opts, name, pair[0], pair[1])
+			}
+		}
+
+		if len(got.UserExpenses) != len(want.UserExpenses) || len(got.Users) != len(want.Users) {
+			t.Errorf("%+v: %d payers, want %d", opts, len(got.UserExpenses), len(want.UserExpenses))
+		}
+		for userID, amount := range want.UserExpenses {
+			if !approxEqual(got.UserExpenses[userID], amount, 1e-9) {
+				t.Errorf("%+v: expenses of %s = %v, want %v", opts, userID, got.UserExpenses[userID], amount)
+			}
+		}
+
+		// Both sides round to cents after summing in a different order
+		if len(got.UserBalances) != len(want.UserBalances) {
+			t.Errorf("%+v: %d balances, want %d", opts, len(got.UserBalances), len(want.UserBalances))
+		}
+		for userID, amount := range want.UserBalances {
+			if math.Abs(got.UserBalances[userID]-amount) > 0.011 {
+				t.Errorf("%+v: balance of %s = %v, want %v", opts, userID, got.UserBalances[userID], amount)
+			}
+		}
+
+		if len(got.DailyTrends) != len(want.DailyTrends) {
+			t.Fatalf("%+v: %d days, want %d", opts, len(got.DailyTrends), len(want.DailyTrends))
+		}
+		for i, day := range want.DailyTrends {
+			g := got.DailyTrends[i]
+			if g.Date != day.Date || g.Count != day.Count || !approxEqual(g.Total, day.Total, 1e-9) || g.MaxAmount != day.MaxAmount {
+				t.Errorf("%+v: day %+v, want %+v", opts, g, day)
+			}
+		}
+
+		if len(got.TagExpenses) != len(want.TagExpenses) {
+			t.Errorf("%+v: %d tags, want %d", opts, len(got.TagExpenses), len(want.TagExpenses))
+		}
+		for name, amount := range want.TagExpenses {
+			if !approxEqual(got.TagExpenses[name], amount, 1e-9) {
+				t.Errorf("%+v: tag %s = %v, want %v", opts, name, got.TagExpenses[name], amount)
+			}
+		}
+	}
+}
+
+// BenchmarkSummary compares the old in-memory summary with the SQL one on
+// a large synthetic history.
+func BenchmarkSummary(b *testing.B) {
+	testDatabase(b)
+	seedTransactions(b, 100000)
+	ctx := context.Background()
+
+	for name, summarize := range map[string]func(context.Context, summaryOptions) (*transactionSummary, error){
+		"in_memory": summarizeInMemory,
+		"sql":       summarizeTransactions,
+	} {
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := summarize(ctx, summaryOptions{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
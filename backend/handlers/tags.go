@@ -0,0 +1,354 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/ishushreyas/expense-tracker/db"
+	"github.com/jackc/pgx/v5"
+)
+
+// Tags are short lowercase labels like goa-trip or reimbursable that any
+// number of transactions and payments can carry. A tag exists while
+// something is tagged with it; the drop_unused_tag trigger deletes it when
+// its last link goes, whether untagged or deleted with its record.
+
+var tagPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,39}$`)
+
+// normalizeTag lowercases a tag and joins its words with hyphens.
+func normalizeTag(tag string) (string, error) {
+	name := strings.Join(strings.Fields(strings.ToLower(tag)), "-")
+	if !tagPattern.MatchString(name) {
+		return "", fmt.Errorf("Invalid tag %q, expected up to 40 letters, digits, - or _", tag)
+	}
+	return name, nil
+}
+
+// taggable describes a kind of record tags can be attached to.
+type taggable struct {
+	Name       string
+	Label      string
+	Table      string
+	LinkTable  string
+	LinkColumn string
+	// Audience selects the live record's participants by id
+	Audience string
+	Topic    string
+	Message  MessageType
+}
+
+var (
+	taggableTransaction = taggable{
+		Name:       "transaction",
+		Label:      "Transaction",
+		Table:      "transactions",
+		LinkTable:  "transaction_tags",
+		LinkColumn: "transaction_id",
+		Audience:   "SELECT array_prepend(payer_id, members) FROM transactions WHERE id = $1 AND is_deleted = false",
+		Topic:      TopicTransactions,
+		Message:    MessageTransactionTagsChanged,
+	}
+	taggablePayment = taggable{
+		Name:       "payment",
+		Label:      "Payment",
+		Table:      "payments",
+		LinkTable:  "payment_tags",
+		LinkColumn: "payment_id",
+		Audience:   "SELECT ARRAY[payer_id, reciever_id] FROM payments WHERE id = $1 AND is_deleted = false",
+		Topic:      TopicPayments,
+		Message:    MessagePaymentTagsChanged,
+	}
+)
+
+// tagsCond is a list filter condition matching records of t tagged with
+// the tag bound to ?.
+func (t taggable) tagsCond() string {
+	return fmt.Sprintf(`EXISTS (
+		SELECT 1 FROM %[1]s link JOIN tags ON tags.id = link.tag_id
+		WHERE link.%[2]s = %[3]s.id AND tags.name = ?
+	)`, t.LinkTable, t.LinkColumn, t.Table)
+}
+
+// tagsColumn selects a record's tags in a list query, as tags.
+func (t taggable) tagsColumn() string {
+	return fmt.Sprintf(`ARRAY(
+		SELECT tags.name FROM %[1]s link JOIN tags ON tags.id = link.tag_id
+		WHERE link.%[2]s = %[3]s.id ORDER BY tags.name
+	) AS tags`, t.LinkTable, t.LinkColumn, t.Table)
+}
+
+// tagsOf returns the tags on a record.
+func (t taggable) tagsOf(ctx context.Context, q interface {
+	Query(context.Context, string, ...any) (pgx.Rows, error)
+}, id uuid.UUID) ([]string, error) {
+	rows, err := q.Query(ctx, fmt.Sprintf(`
+		SELECT tags.name FROM %s link JOIN tags ON tags.id = link.tag_id
+		WHERE link.%s = $1
+		ORDER BY tags.name
+	`, t.LinkTable, t.LinkColumn), id)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+// TagsChange is the payload of the *.tags_changed events.
+type TagsChange struct {
+	ID   uuid.UUID `json:"id"`
+	Tags []string  `json:"tags"`
+}
+
+// GetTags suggests existing tags starting with ?prefix=, most used first.
+func GetTags(w http.ResponseWriter, r *http.Request) {
+	// Create context with timeout
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	prefix := strings.Join(strings.Fields(strings.ToLower(r.URL.Query().Get("prefix"))), "-")
+	limit := 10
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		l, err := strconv.Atoi(limitStr)
+		if err != nil || l <= 0 || l > maxPageLimit {
+			http.Error(w, fmt.Sprintf("Invalid limit, expected 1 to %d", maxPageLimit), http.StatusBadRequest)
+			return
+		}
+		limit = l
+	}
+
+	type TagUsage struct {
+		Name  string `json:"name" db:"name"`
+		Count int    `json:"count" db:"count"`
+	}
+	rows, err := db.Pool.Query(ctx, `
+		SELECT tags.name,
+			(SELECT COUNT(*) FROM transaction_tags WHERE tag_id = tags.id)
+			+ (SELECT COUNT(*) FROM payment_tags WHERE tag_id = tags.id) AS count
+		FROM tags
+		WHERE tags.name LIKE $1
+		ORDER BY count DESC, tags.name
+		LIMIT $2
+	`, escapeLike(prefix)+"%", limit)
+	if err != nil {
+		http.Error(w, "Failed to retrieve tags: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tags, err := pgx.CollectRows(rows, pgx.RowToStructByName[TagUsage])
+	if err != nil {
+		http.Error(w, "Failed to process tags: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tags)
+}
+
+// GetTransactionTags lists the tags on a transaction.
+func GetTransactionTags(w http.ResponseWriter, r *http.Request) {
+	getTags(w, r, taggableTransaction)
+}
+
+// AddTransactionTags tags a transaction with {"tags": [...]}.
+func AddTransactionTags(w http.ResponseWriter, r *http.Request) {
+	addTags(w, r, taggableTransaction)
+}
+
+// RemoveTransactionTag takes a tag off a transaction.
+func RemoveTransactionTag(w http.ResponseWriter, r *http.Request) {
+	removeTag(w, r, taggableTransaction)
+}
+
+// GetPaymentTags lists the tags on a payment.
+func GetPaymentTags(w http.ResponseWriter, r *http.Request) {
+	getTags(w, r, taggablePayment)
+}
+
+// AddPaymentTags tags a payment with {"tags": [...]}.
+func AddPaymentTags(w http.ResponseWriter, r *http.Request) {
+	addTags(w, r, taggablePayment)
+}
+
+// RemovePaymentTag takes a tag off a payment.
+func RemovePaymentTag(w http.ResponseWriter, r *http.Request) {
+	removeTag(w, r, taggablePayment)
+}
+
+func getTags(w http.ResponseWriter, r *http.Request, t taggable) {
+	// Create context with timeout
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	id, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid "+t.Name+" ID format", http.StatusBadRequest)
+		return
+	}
+
+	tags, err := t.tagsOf(ctx, db.Pool, id)
+	if err != nil {
+		http.Error(w, "Failed to retrieve tags: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TagsChange{ID: id, Tags: tags})
+}
+
+// addTags and removeTag change the tags on a live record of kind t. Only
+// its parties (payer, members or reciever) may.
+func addTags(w http.ResponseWriter, r *http.Request, t taggable) {
+	// Create context with timeout
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	id, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid "+t.Name+" ID format", http.StatusBadRequest)
+		return
+	}
+
+	var input struct {
+		Tags []string `json:"tags"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if len(input.Tags) == 0 {
+		http.Error(w, "At least one tag is required", http.StatusBadRequest)
+		return
+	}
+	names := make([]string, len(input.Tags))
+	for i, tag := range input.Tags {
+		if names[i], err = normalizeTag(tag); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	userID, err := sessionUserID(ctx)
+	if err != nil {
+		http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var (
+		audience []uuid.UUID
+		tags     []string
+		outsider bool
+	)
+	err = db.WithActor(ctx, db.Pool, userID, func(tx pgx.Tx) error {
+		if err := tx.QueryRow(ctx, t.Audience, id).Scan(&audience); err != nil {
+			return err
+		}
+		if outsider = !isParty(userID, audience...); outsider {
+			return nil
+		}
+		if _, err := tx.Exec(ctx, `
+			INSERT INTO tags (name) SELECT unnest($1::text[])
+			ON CONFLICT (name) DO NOTHING
+		`, names); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, fmt.Sprintf(`
+			INSERT INTO %s (%s, tag_id) SELECT $1, id FROM tags WHERE name = ANY($2)
+			ON CONFLICT DO NOTHING
+		`, t.LinkTable, t.LinkColumn), id, names); err != nil {
+			return err
+		}
+		tags, err = t.tagsOf(ctx, tx, id)
+		return err
+	})
+	if err == pgx.ErrNoRows {
+		http.Error(w, t.Label+" not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to add tags: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if outsider {
+		http.Error(w, "Only a party to the "+t.Name+" can change its tags", http.StatusForbidden)
+		return
+	}
+
+	change := TagsChange{ID: id, Tags: tags}
+	publish(ctx, Event{Topic: t.Topic, Type: t.Message, Data: change, Audience: audience})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(change)
+}
+
+func removeTag(w http.ResponseWriter, r *http.Request, t taggable) {
+	// Create context with timeout
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	vars := mux.Vars(r)
+	id, err := uuid.Parse(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid "+t.Name+" ID format", http.StatusBadRequest)
+		return
+	}
+	name, err := normalizeTag(vars["tag"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	userID, err := sessionUserID(ctx)
+	if err != nil {
+		http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var (
+		audience []uuid.UUID
+		tags     []string
+		outsider bool
+	)
+	err = db.WithActor(ctx, db.Pool, userID, func(tx pgx.Tx) error {
+		if err := tx.QueryRow(ctx, t.Audience, id).Scan(&audience); err != nil {
+			return err
+		}
+		if outsider = !isParty(userID, audience...); outsider {
+			return nil
+		}
+		// The drop_unused_tag trigger removes the tag once nothing carries it
+		removed, err := tx.Exec(ctx, fmt.Sprintf(`
+			DELETE FROM %s link USING tags
+			WHERE link.tag_id = tags.id AND link.%s = $1 AND tags.name = $2
+		`, t.LinkTable, t.LinkColumn), id, name)
+		if err != nil {
+			return err
+		}
+		if removed.RowsAffected() == 0 {
+			return pgx.ErrNoRows
+		}
+		tags, err = t.tagsOf(ctx, tx, id)
+		return err
+	})
+	if err == pgx.ErrNoRows {
+		http.Error(w, t.Label+" or tag not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to remove tag: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if outsider {
+		http.Error(w, "Only a party to the "+t.Name+" can change its tags", http.StatusForbidden)
+		return
+	}
+
+	change := TagsChange{ID: id, Tags: tags}
+	publish(ctx, Event{Topic: t.Topic, Type: t.Message, Data: change, Audience: audience})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(change)
+}
@@ -0,0 +1,308 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/ishushreyas/expense-tracker/db"
+	"github.com/jackc/pgx/v5"
+)
+
+type TransactionConfirmation struct {
+	UserID    uuid.UUID `json:"user_id" db:"user_id"`
+	Status    string    `json:"status" db:"status"`
+	Note      string    `json:"note" db:"note"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+}
+
+type statusChange struct {
+	ID       uuid.UUID `json:"id"`
+	Status   string    `json:"status"`
+	Previous string    `json:"previous_status"`
+	ActorID  uuid.UUID `json:"actor_id"`
+}
+
+// ConfirmTransaction lets a member confirm an expense they were added to
+func ConfirmTransaction(w http.ResponseWriter, r *http.Request) {
+	respondToTransaction(w, r, db.TransactionConfirmed)
+}
+
+// DisputeTransaction lets a member dispute an expense they were added to
+func DisputeTransaction(w http.ResponseWriter, r *http.Request) {
+	respondToTransaction(w, r, db.TransactionDisputed)
+}
+
+// respondToTransaction records the session user's response to a transaction
+// and recomputes the transaction status from all member responses.
+func respondToTransaction(w http.ResponseWriter, r *http.Request, response string) {
+	// Create context with timeout
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	userID, err := sessionUserID(ctx)
+	if err != nil {
+		http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+		return
+	}
+
+	transactionID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid transaction ID format", http.StatusBadRequest)
+		return
+	}
+
+	// The note is optional, so an empty body is fine
+	var input struct {
+		Note string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil && err != io.EOF {
+		http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		http.Error(w, "Failed to update transaction: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+	if err := db.SetActor(ctx, tx, userID); err != nil {
+		http.Error(w, "Failed to update transaction: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var (
+		payerID  uuid.UUID
+		members  []uuid.UUID
+		previous string
+	)
+	err = tx.QueryRow(ctx, `
+		SELECT payer_id, members, status
+		FROM transactions
+		WHERE id = $1 AND is_deleted = false
+		FOR UPDATE
+	`, transactionID).Scan(&payerID, &members, &previous)
+	if err == pgx.ErrNoRows {
+		http.Error(w, "Transaction not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to retrieve transaction: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if previous == db.TransactionRejected {
+		http.Error(w, "Transaction has been rejected", http.StatusConflict)
+		return
+	}
+	if userID == payerID {
+		http.Error(w, "The payer does not need to confirm their own transaction", http.StatusBadRequest)
+		return
+	}
+	isMember := false
+	for _, member := range members {
+		if member == userID {
+			isMember = true
+			break
+		}
+	}
+	if !isMember {
+		http.Error(w, "Only members of the transaction can respond to it", http.StatusForbidden)
+		return
+	}
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO transaction_confirmations (transaction_id, user_id, status, note, updated_at)
+		VALUES ($1, $2, $3, $4, now())
+		ON CONFLICT (transaction_id, user_id)
+		DO UPDATE SET status = EXCLUDED.status, note = EXCLUDED.note, updated_at = EXCLUDED.updated_at
+	`, transactionID, userID, response, input.Note)
+	if err != nil {
+		http.Error(w, "Failed to record response: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := tx.Query(ctx, "SELECT user_id, status FROM transaction_confirmations WHERE transaction_id = $1", transactionID)
+	if err != nil {
+		http.Error(w, "Failed to retrieve confirmations: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	responses := make(map[uuid.UUID]string)
+	for rows.Next() {
+		var (
+			memberID uuid.UUID
+			status   string
+		)
+		if err := rows.Scan(&memberID, &status); err != nil {
+			rows.Close()
+			http.Error(w, "Failed to scan confirmation: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		responses[memberID] = status
+	}
+	rows.Close()
+
+	status := db.DeriveTransactionStatus(payerID, members, responses)
+	if status != previous {
+		if _, err := tx.Exec(ctx, "UPDATE transactions SET status = $1 WHERE id = $2", status, transactionID); err != nil {
+			if writeClosedPeriod(w, err) {
+				return
+			}
+			http.Error(w, "Failed to update transaction status: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, "Failed to update transaction: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	change := statusChange{ID: transactionID, Status: status, Previous: previous, ActorID: userID}
+	if status != previous {
+		publish(ctx, Event{
+			Topic:    TopicTransactions,
+			Type:     MessageTransactionStatusChanged,
+			Data:     change,
+			Audience: append([]uuid.UUID{payerID}, members...),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(change)
+}
+
+// RejectTransaction lets the payer withdraw a transaction, typically after
+// a dispute. Rejected transactions no longer count towards balances.
+func RejectTransaction(w http.ResponseWriter, r *http.Request) {
+	// Create context with timeout
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	userID, err := sessionUserID(ctx)
+	if err != nil {
+		http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+		return
+	}
+
+	transactionID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid transaction ID format", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		http.Error(w, "Failed to update transaction: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+	if err := db.SetActor(ctx, tx, userID); err != nil {
+		http.Error(w, "Failed to update transaction: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Lock the row so a racing confirmation can't slip in between
+	var (
+		payerID  uuid.UUID
+		members  []uuid.UUID
+		previous string
+	)
+	err = tx.QueryRow(ctx, `
+		SELECT payer_id, members, status
+		FROM transactions
+		WHERE id = $1 AND is_deleted = false
+		FOR UPDATE
+	`, transactionID).Scan(&payerID, &members, &previous)
+	if err == pgx.ErrNoRows {
+		http.Error(w, "Transaction not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to retrieve transaction: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if userID != payerID {
+		http.Error(w, "Only the payer can reject a transaction", http.StatusForbidden)
+		return
+	}
+	if previous == db.TransactionRejected {
+		http.Error(w, "Transaction is already rejected", http.StatusConflict)
+		return
+	}
+
+	if _, err := tx.Exec(ctx, "UPDATE transactions SET status = $1 WHERE id = $2", db.TransactionRejected, transactionID); err != nil {
+		if writeClosedPeriod(w, err) {
+			return
+		}
+		http.Error(w, "Failed to update transaction status: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, "Failed to update transaction: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	change := statusChange{ID: transactionID, Status: db.TransactionRejected, Previous: previous, ActorID: userID}
+	publish(ctx, Event{
+		Topic:    TopicTransactions,
+		Type:     MessageTransactionStatusChanged,
+		Data:     change,
+		Audience: append([]uuid.UUID{payerID}, members...),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(change)
+}
+
+// GetTransactionConfirmations lists each member's response to a transaction
+func GetTransactionConfirmations(w http.ResponseWriter, r *http.Request) {
+	// Create context with timeout
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	transactionID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid transaction ID format", http.StatusBadRequest)
+		return
+	}
+
+	var status string
+	err = db.Pool.QueryRow(ctx, "SELECT status FROM transactions WHERE id = $1", transactionID).Scan(&status)
+	if err == pgx.ErrNoRows {
+		http.Error(w, "Transaction not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to retrieve transaction: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := db.Pool.Query(ctx, `
+		SELECT user_id, status, note, updated_at
+		FROM transaction_confirmations
+		WHERE transaction_id = $1
+		ORDER BY updated_at
+	`, transactionID)
+	if err != nil {
+		http.Error(w, "Failed to retrieve confirmations: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	confirmations, err := pgx.CollectRows(rows, pgx.RowToStructByName[TransactionConfirmation])
+	if err != nil {
+		http.Error(w, "Failed to process confirmations: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":            transactionID,
+		"status":        status,
+		"confirmations": confirmations,
+	})
+}
@@ -5,8 +5,6 @@ import (
     "encoding/json"
     "fmt"
     "net/http"
-    "sort"
-    "strconv"
     "time"
 
     "github.com/google/uuid"
@@ -21,17 +19,20 @@ type Transaction struct {
     Amount     float64     `json:"amount" db:"amount"`
     Members    []uuid.UUID `json:"members" db:"members"`
     Remark     string      `json:"remark" db:"remark"`
+    Status     string      `json:"status" db:"status"`
     CreatedAt time.Time   `json:"created_at" db:"created_at"`
+    OccurredOn time.Time  `json:"occurred_on" db:"occurred_on"`
     IsDeleted  bool        `json:"is_deleted" db:"is_deleted"`
     DeletedAt  *time.Time  `json:"deleted_at,omitempty" db:"deleted_at"`
 }
 
 func AddTransaction(w http.ResponseWriter, r *http.Request) {
     type TransactionInput struct {
-        PayerID string   `json:"payer_id"`
-        Amount  float64  `json:"amount"`
-        Members []string `json:"members"`
-        Remark  string   `json:"remark"`
+        PayerID    string   `json:"payer_id"`
+        Amount     float64  `json:"amount"`
+        Members    []string `json:"members"`
+        Remark     string   `json:"remark"`
+        OccurredOn string   `json:"occurred_on"`
     }
 
     var input TransactionInput
@@ -40,6 +41,18 @@ func AddTransaction(w http.ResponseWriter, r *http.Request) {
         return
     }
 
+    // Backdated expenses say when they happened; otherwise it was today
+    prefs, err := preferencesFor(r.Context(), r.URL.Query())
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    occurredOn, err := parseOccurredOn(input.OccurredOn, prefs.Location)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
     // Convert members strings to uuid.UUID
     var membersUUID []uuid.UUID
     for _, member := range input.Members {
@@ -51,19 +64,53 @@ func AddTransaction(w http.ResponseWriter, r *http.Request) {
         membersUUID = append(membersUUID, memberUUID)
     }
 
+    payerUUID, err := uuid.Parse(input.PayerID)
+    if err != nil {
+        http.Error(w, "Invalid payer UUID", http.StatusBadRequest)
+        return
+    }
+
     // Create transaction and insert into DB
-    transactionID := uuid.New().String()
-    query := "INSERT INTO transactions (id, payer_id, amount, members, created_at, remark) VALUES ($1, $2, $3, $4, now(), $5)"
+    transaction := db.Transaction{
+        ID:         uuid.New(),
+        PayerID:    payerUUID,
+        Amount:     input.Amount,
+        Members:    membersUUID,
+        Remark:     input.Remark,
+        Status:     db.DeriveTransactionStatus(payerUUID, membersUUID, nil),
+        OccurredOn: occurredOn,
+    }
+    query := "INSERT INTO transactions (id, payer_id, amount, members, created_at, remark, status, occurred_on) VALUES ($1, $2, $3, $4, now(), $5, $6, $7) RETURNING created_at"
 
-    _, err := db.Pool.Exec(r.Context(), query, transactionID, input.PayerID, input.Amount, membersUUID, input.Remark)
+    err = db.WithActor(r.Context(), db.Pool, auditActor(r.Context()), func(tx pgx.Tx) error {
+        return tx.QueryRow(r.Context(), query, transaction.ID, transaction.PayerID, transaction.Amount, transaction.Members, transaction.Remark, transaction.Status, transaction.OccurredOn).Scan(&transaction.CreatedAt)
+    })
     if err != nil {
+        if writeClosedPeriod(w, err) {
+            return
+        }
         http.Error(w, "Failed to add transaction: "+err.Error(), http.StatusInternalServerError)
         return
     }
 
+    publish(r.Context(), Event{
+        Topic:    TopicTransactions,
+        Type:     MessageTransactionCreated,
+        Data:     ExtendedTransaction{Transaction: transaction, Type: TransactionTypeSend},
+        Audience: append([]uuid.UUID{transaction.PayerID}, transaction.Members...),
+    })
+
     w.Header().Set("Content-Type", "application/json")
     w.WriteHeader(http.StatusCreated)
-    json.NewEncoder(w).Encode(map[string]string{"id": transactionID})
+    json.NewEncoder(w).Encode(map[string]string{"id": transaction.ID.String()})
+}
+
+// sortedTransaction is a listed transaction with its tags and the value it was
+// sorted by.
+type sortedTransaction struct {
+	Transaction
+	Tags    []string `json:"tags" db:"tags"`
+	SortKey string `json:"-" db:"sort_key"`
 }
 
 func GetTransactions(w http.ResponseWriter, r *http.Request) {
@@ -73,68 +120,40 @@ func GetTransactions(w http.ResponseWriter, r *http.Request) {
 
 	// Parse query parameters
 	query := r.URL.Query()
-	
-	// Default pagination
-	page := 1
-	limit := 20
-	
-	if pageStr := query.Get("page"); pageStr != "" {
-		if p, err := strconv.Atoi(pageStr); err == nil && p > 0 {
-			page = p
-		}
-	}
-	
-	if limitStr := query.Get("limit"); limitStr != "" {
-		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 && l <= 100 {
-			limit = l
-		}
-	}
 
-	// Calculate offset
-	offset := (page - 1) * limit
-
-	// Build base query with flexible filtering
-	sqlQuery := `
-    SELECT id, payer_id, amount, members, created_at, remark, is_deleted, deleted_at
-    FROM transactions
-    WHERE is_deleted = false
-`
-	
-	// Optional filters
-	var args []interface{}
-	argCount := 1
-
-	// Filter by payer ID if provided
-	if payerID := query.Get("payer_id"); payerID != "" {
-		sqlQuery += " AND payer_id = $" + strconv.Itoa(argCount)
-		args = append(args, payerID)
-		argCount++
+	page, err := pageRequestFromQuery(query, ledgerSorts, "-date")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	// Filter by date range if provided
-	if startDate := query.Get("start_date"); startDate != "" {
-		if parsedDate, err := time.Parse("2006-01-02", startDate); err == nil {
-			sqlQuery += " AND timestamp >= $" + strconv.Itoa(argCount)
-			args = append(args, parsedDate)
-			argCount++
-		}
+	// Build filters shared with the payment list
+	filter, err := ledgerFilter(query, "(payer_id = ? OR ? = ANY(members))", taggableTransaction)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	if endDate := query.Get("end_date"); endDate != "" {
-		if parsedDate, err := time.Parse("2006-01-02", endDate); err == nil {
-			sqlQuery += " AND timestamp <= $" + strconv.Itoa(argCount)
-			args = append(args, parsedDate)
-			argCount++
+	var total *int
+	if page.IncludeTotal {
+		if total, err = countRows(ctx, "transactions"+filter.where(), filter.args); err != nil {
+			http.Error(w, "Failed to count transactions: "+err.Error(), http.StatusInternalServerError)
+			return
 		}
 	}
 
 	// Add pagination
-	sqlQuery += " ORDER BY timestamp DESC LIMIT $" + strconv.Itoa(argCount) + 
-				" OFFSET $" + strconv.Itoa(argCount+1)
-	args = append(args, limit, offset)
+	keyset, keysetArgs, err := page.keyset("id", filter.nextArg(), stringID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sqlQuery := `
+    SELECT id, payer_id, amount, members, created_at, occurred_on, remark, status, is_deleted, deleted_at, ` + taggableTransaction.tagsColumn() + `, ` + page.sortColumn() + `
+    FROM transactions` + filter.where() + keyset
 
 	// Execute query
-	rows, err := db.Pool.Query(ctx, sqlQuery, args...)
+	rows, err := db.Pool.Query(ctx, sqlQuery, append(filter.args, keysetArgs...)...)
 	if err != nil {
 		http.Error(w, "Failed to retrieve transactions: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -142,24 +161,19 @@ func GetTransactions(w http.ResponseWriter, r *http.Request) {
 	defer rows.Close()
 
 	// Collect rows
-	transactions, err := pgx.CollectRows(rows, pgx.RowToStructByName[Transaction])
+	transactions, err := pgx.CollectRows(rows, pgx.RowToStructByName[sortedTransaction])
 	if err != nil {
 		http.Error(w, "Failed to process transactions: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Handle empty result
-	if len(transactions) == 0 {
-		w.WriteHeader(http.StatusNoContent)
-		return
-	}
+	transactions, next, prev := pageOf(transactions, page, func(row sortedTransaction) (string, string) {
+		return row.SortKey, row.ID.String()
+	})
 
 	// Prepare response with pagination info
-	response := map[string]interface{}{
-		"transactions": transactions,
-		"page":         page,
-		"limit":        limit,
-	}
+	response := writePageLinks(w, r, page, next, prev, total)
+	response["transactions"] = transactions
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
@@ -181,20 +195,28 @@ func GetTransactionByID(w http.ResponseWriter, r *http.Request) {
 
     // Prepare query
     query := `
-    SELECT id, payer_id, amount, members, created_at, remark, is_deleted, deleted_at
+    SELECT id, payer_id, amount, members, created_at, occurred_on, remark, status, is_deleted, deleted_at, version
     FROM transactions
     WHERE id = $1
     `
 
     // Execute query
-    var transaction Transaction
+    var (
+        transaction Transaction
+        version     int
+    )
     err = db.Pool.QueryRow(ctx, query, transactionID).Scan(
         &transaction.ID,
         &transaction.PayerID,
         &transaction.Amount,
         &transaction.Members,
         &transaction.CreatedAt,
+        &transaction.OccurredOn,
         &transaction.Remark,
+        &transaction.Status,
+        &transaction.IsDeleted,
+        &transaction.DeletedAt,
+        &version,
     )
 
     if err == pgx.ErrNoRows {
@@ -205,9 +227,13 @@ func GetTransactionByID(w http.ResponseWriter, r *http.Request) {
         return
     }
 
+    w.Header().Set("ETag", versionETag(version))
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(transaction)
 }
+
+// DeleteTransaction removes a transaction for good. If-Match is optional;
+// without it the delete applies to whatever version is current.
 func DeleteTransaction(w http.ResponseWriter, r *http.Request) {
 	// Create context with timeout
 	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
@@ -223,27 +249,44 @@ func DeleteTransaction(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Prepare delete query
+	// Prepare delete query, guarded by If-Match if sent
 	query := `
 		DELETE FROM transactions
 		WHERE id = $1
-		RETURNING id
+		AND ($2::int[] IS NULL OR version = ANY($2))
+		RETURNING id, payer_id, members
 	`
 
 	// Execute delete operation
-	var deletedID string
-	err := db.Pool.QueryRow(ctx, query, transactionID).Scan(&deletedID)
+	var (
+		deletedID string
+		payerID   uuid.UUID
+		members   []uuid.UUID
+	)
+	err := db.WithActor(ctx, db.Pool, auditActor(ctx), func(tx pgx.Tx) error {
+		return tx.QueryRow(ctx, query, transactionID, ifMatchVersions(r)).Scan(&deletedID, &payerID, &members)
+	})
 
 	if err == pgx.ErrNoRows {
-		// No transaction found with given ID
-		http.Error(w, "Transaction not found", http.StatusNotFound)
+		// No transaction found with given ID, or not at the expected version
+		writeVersionMismatch(ctx, w, "transactions", transactionID, false, "Transaction not found")
 		return
 	} else if err != nil {
 		// Other database error
+		if writeClosedPeriod(w, err) {
+			return
+		}
 		http.Error(w, "Failed to delete transaction: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	publish(ctx, Event{
+		Topic:    TopicTransactions,
+		Type:     MessageTransactionDeleted,
+		Data:     map[string]string{"id": deletedID},
+		Audience: append([]uuid.UUID{payerID}, members...),
+	})
+
 	// Prepare response
 	response := map[string]string{
 		"message": "Transaction deleted successfully",
@@ -255,6 +298,8 @@ func DeleteTransaction(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+// SoftDeleteTransaction moves a transaction to the trash. If-Match is
+// optional; without it the delete applies to whatever version is current.
 func SoftDeleteTransaction(w http.ResponseWriter, r *http.Request) {
 	// Create context with timeout
 	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
@@ -270,29 +315,48 @@ func SoftDeleteTransaction(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Prepare soft delete query
+	// Prepare soft delete query, guarded by If-Match if sent
 	query := `
 		UPDATE transactions
 		SET is_deleted = true,
-		    deleted_at = NOW()
+		    deleted_at = NOW(),
+		    deleted_by = $2
 		WHERE id = $1 AND is_deleted = false
-		RETURNING id
+		AND ($3::int[] IS NULL OR version = ANY($3))
+		RETURNING id, payer_id, members
 	`
 
 	// Execute soft delete operation
-	var deletedID string
-	err := db.Pool.QueryRow(ctx, query, transactionID).Scan(&deletedID)
+	var (
+		deletedID string
+		payerID   uuid.UUID
+		members   []uuid.UUID
+	)
+	actorID := auditActor(ctx)
+	err := db.WithActor(ctx, db.Pool, actorID, func(tx pgx.Tx) error {
+		return tx.QueryRow(ctx, query, transactionID, nullableID(actorID), ifMatchVersions(r)).Scan(&deletedID, &payerID, &members)
+	})
 
 	if err == pgx.ErrNoRows {
-		// No transaction found or already deleted
-		http.Error(w, "Transaction not found or already deleted", http.StatusNotFound)
+		// No transaction found, already deleted, or not at the expected version
+		writeVersionMismatch(ctx, w, "transactions", transactionID, true, "Transaction not found or already deleted")
 		return
 	} else if err != nil {
 		// Other database error
+		if writeClosedPeriod(w, err) {
+			return
+		}
 		http.Error(w, "Failed to soft delete transaction: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	publish(ctx, Event{
+		Topic:    TopicTransactions,
+		Type:     MessageTransactionDeleted,
+		Data:     map[string]string{"id": deletedID},
+		Audience: append([]uuid.UUID{payerID}, members...),
+	})
+
 	// Prepare response
 	response := map[string]string{
 		"message": "Transaction soft deleted successfully",
@@ -304,193 +368,61 @@ func SoftDeleteTransaction(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-// calculateBalances calculates the net balance for each member.
+// GenerateSummary reports totals, per-user spending, balances and daily
+// stats for the transactions in a date range.
 func GenerateSummary(w http.ResponseWriter, r *http.Request) {
 	// Parse query parameters for date range
 	startDate := r.URL.Query().Get("start_date")
 	endDate := r.URL.Query().Get("end_date")
 
-	// Create context with timeout
-	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
-	defer cancel()
+	// Optionally count only transactions every member has confirmed
+	confirmedOnly := r.URL.Query().Get("confirmed_only") == "true"
 
-	// Build query with date filtering if provided
-	sqlQuery := `
-		WITH daily_stats AS (
-			SELECT
-				DATE(created_at) as date,
-				COUNT(*) as daily_count,
-				SUM(amount) as daily_total,
-				MAX(amount) as max_transaction
-			FROM transactions
-			WHERE is_deleted = false
-			AND ($1 = '' OR created_at >= $1::timestamp)
-			AND ($2 = '' OR created_at <= $2::timestamp)
-			GROUP BY DATE(created_at)
-		)
-		SELECT
-			t.id,
-			t.payer_id,
-			t.amount,
-			t.members,
-			t.created_at,
-			t.remark,
-			t.is_deleted,
-			t.deleted_at,
-			u.username,
-			u.email
-		FROM transactions t
-		LEFT JOIN users u ON t.payer_id = u.id
-		WHERE t.is_deleted = false
-		AND ($1 = '' OR t.created_at >= $1::timestamp)
-		AND ($2 = '' OR t.created_at <= $2::timestamp)
-	`
-
-	// Execute query
-	rows, err := db.Pool.Query(ctx, sqlQuery, startDate, endDate)
+	// Optionally reconstruct the summary as it stood at an earlier moment
+	asOf, err := parseAsOf(r.URL.Query().Get("as_of"))
 	if err != nil {
-		http.Error(w, "Failed to retrieve transactions: "+err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	defer rows.Close()
 
-	// Data structures for aggregation
-	type TransactionWithMeta struct {
-		Transaction
-		Username string `json:"username"`
-		Email    string `json:"email"`
-	}
+	// Create context with timeout
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
 
-	var transactions []TransactionWithMeta
-	userMap := make(map[uuid.UUID]struct {
-		Username string
-		Email    string
+	summary, err := summarizeTransactions(ctx, summaryOptions{
+		StartDate:     startDate,
+		EndDate:       endDate,
+		ConfirmedOnly: confirmedOnly,
+		AsOf:          asOf,
 	})
-
-	// Collect and process rows
-	for rows.Next() {
-		var t TransactionWithMeta
-		err := rows.Scan(
-			&t.ID,
-			&t.PayerID,
-			&t.Amount,
-			&t.Members,
-			&t.CreatedAt,
-			&t.Remark,
-			&t.IsDeleted,
-			&t.DeletedAt,
-			&t.Username,
-			&t.Email,
-		)
-		if err != nil {
-			http.Error(w, "Failed to scan row: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
-		transactions = append(transactions, t)
-		userMap[t.PayerID] = struct {
-			Username string
-			Email    string
-		}{t.Username, t.Email}
-	}
-
-	// Calculate various metrics
-	var (
-		totalExpense     float64
-		categoryExpenses = make(map[string]float64)
-		userExpenses    = make(map[uuid.UUID]float64)
-		userBalances    = make(map[uuid.UUID]float64)
-		dailyStats      = make(map[string]struct {
-			Count     int
-			Total     float64
-			MaxAmount float64
-		})
-		transactionCount = len(transactions)
-	)
-
-	// Process transactions
-	for _, t := range transactions {
-		totalExpense += t.Amount
-
-		// User expenses
-		userExpenses[t.PayerID] += t.Amount
-
-		// Calculate balances
-		memberCount := float64(len(t.Members))
-		if memberCount > 0 {
-			share := t.Amount / memberCount
-			for _, member := range t.Members {
-				userBalances[member] -= share
-			}
-			userBalances[t.PayerID] += t.Amount
-		}
-
-		// Daily statistics
-		dateKey := t.CreatedAt.Format("2006-01-02")
-		daily := dailyStats[dateKey]
-		daily.Count++
-		daily.Total += t.Amount
-		if t.Amount > daily.MaxAmount {
-			daily.MaxAmount = t.Amount
-		}
-		dailyStats[dateKey] = daily
-	}
-
-	// Calculate additional metrics
-	var (
-		avgTransactionAmount float64
-		maxTransactionAmount float64
-		activeUserCount     = len(userExpenses)
-	)
-
-	if transactionCount > 0 {
-		avgTransactionAmount = totalExpense / float64(transactionCount)
-	}
-
-	for _, t := range transactions {
-		if t.Amount > maxTransactionAmount {
-			maxTransactionAmount = t.Amount
-		}
-	}
-
-	// Prepare users array
-	users := make([]map[string]interface{}, 0, len(userMap))
-	for id, user := range userMap {
-		users = append(users, map[string]interface{}{
-			"id":       id,
-			"username": user.Username,
-			"email":    user.Email,
-		})
+	if err != nil {
+		http.Error(w, "Failed to summarize transactions: "+err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	// Calculate expense trends
-	var dailyTrends []map[string]interface{}
-	for date, stats := range dailyStats {
-		dailyTrends = append(dailyTrends, map[string]interface{}{
-			"date":          date,
-			"total":         stats.Total,
-			"count":         stats.Count,
-			"max_amount":    stats.MaxAmount,
-			"avg_amount":    stats.Total / float64(stats.Count),
-		})
+	// Open money requests, shown next to the balances they would settle
+	outstanding, err := outstandingRequests(ctx, asOf)
+	if err != nil {
+		http.Error(w, "Failed to retrieve payment requests: "+err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	// Sort daily trends by date
-	sort.Slice(dailyTrends, func(i, j int) bool {
-		return dailyTrends[i]["date"].(string) < dailyTrends[j]["date"].(string)
-	})
-
 	// Prepare response
 	response := map[string]interface{}{
-		"total_expenses":        totalExpense,
-		"transaction_count":     transactionCount,
-		"average_transaction":   avgTransactionAmount,
-		"largest_transaction":   maxTransactionAmount,
-		"active_users":         activeUserCount,
-		"category_expenses":     categoryExpenses,
-		"user_expenses":        userExpenses,
-		"user_balances":        userBalances,
-		"daily_trends":         dailyTrends,
-		"users":                users,
+		"total_expenses":        summary.TotalExpense,
+		"transaction_count":     summary.TransactionCount,
+		"average_transaction":   summary.AverageTransaction,
+		"largest_transaction":   summary.LargestTransaction,
+		"active_users":         summary.ActiveUsers,
+		"category_expenses":     map[string]float64{},
+		"tag_expenses":          summary.TagExpenses,
+		"user_expenses":        summary.UserExpenses,
+		"user_balances":        summary.UserBalances,
+		"outstanding_requests": outstanding,
+		"daily_trends":         summary.DailyTrends,
+		"users":                summary.Users,
+		"confirmed_only":       confirmedOnly,
+		"as_of":                asOf,
 		"period": map[string]string{
 			"start_date": startDate,
 			"end_date":   endDate,
@@ -505,6 +437,9 @@ func GenerateSummary(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// EditTransaction replaces a transaction's figures. If-Match is optional,
+// but a client that leaves it out overwrites whatever version is current,
+// so a change made since it read the transaction is lost.
 func EditTransaction(w http.ResponseWriter, r *http.Request) {
     type TransactionInput struct {
 	ID      uuid.UUID `json:"id"`
@@ -512,6 +447,8 @@ func EditTransaction(w http.ResponseWriter, r *http.Request) {
         Amount  float64   `json:"amount"`
         Members []string  `json:"members"`
         Remark  string    `json:"remark"`
+        // Left out, the date is kept
+        OccurredOn string `json:"occurred_on,omitempty"`
     }
 
     // Get transaction ID from URL
@@ -537,18 +474,102 @@ func EditTransaction(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    // Update the transaction in the database
+    payerUUID, err := uuid.Parse(updatedTransaction.PayerID)
+    if err != nil {
+        http.Error(w, "Invalid payer UUID", http.StatusBadRequest)
+        return
+    }
+    var membersUUID []uuid.UUID
+    for _, member := range updatedTransaction.Members {
+        memberUUID, err := uuid.Parse(member)
+        if err != nil {
+            http.Error(w, "Invalid member UUID", http.StatusBadRequest)
+            return
+        }
+        membersUUID = append(membersUUID, memberUUID)
+    }
+    var occurredOn *time.Time
+    if updatedTransaction.OccurredOn != "" {
+        prefs, err := preferencesFor(r.Context(), r.URL.Query())
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        date, err := parseOccurredOn(updatedTransaction.OccurredOn, prefs.Location)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        occurredOn = &date
+    }
+
+    tx, err := db.Pool.Begin(r.Context())
+    if err != nil {
+        http.Error(w, fmt.Sprintf("Failed to update transaction: %v", err), http.StatusInternalServerError)
+        return
+    }
+    defer tx.Rollback(r.Context())
+    if err := db.SetActor(r.Context(), tx, auditActor(r.Context())); err != nil {
+        http.Error(w, fmt.Sprintf("Failed to update transaction: %v", err), http.StatusInternalServerError)
+        return
+    }
+
+    // Whoever the edit drops has to hear of it too
+    var previous []uuid.UUID
+    err = tx.QueryRow(r.Context(), `
+        SELECT array_prepend(payer_id, members) FROM transactions WHERE id = $1 AND is_deleted = false FOR UPDATE
+    `, transactionID).Scan(&previous)
+    if err == pgx.ErrNoRows {
+        tx.Rollback(r.Context())
+        writeVersionMismatch(r.Context(), w, "transactions", transactionID.String(), true, "Transaction not found")
+        return
+    } else if err != nil {
+        http.Error(w, fmt.Sprintf("Failed to update transaction: %v", err), http.StatusInternalServerError)
+        return
+    }
+
+    // Update the transaction in the database, unless someone else changed it
+    // since the version named in If-Match. Earlier confirmations were given
+    // for different figures, so the members have to confirm again.
     query := `
         UPDATE transactions
-        SET payer_id = $1, amount = $2, members = $3, remark = $4
-        WHERE id = $5`
-    _, err = db.Pool.Exec(r.Context(), query, updatedTransaction.PayerID, updatedTransaction.Amount, updatedTransaction.Members, updatedTransaction.Remark, transactionID)
+        SET payer_id = $1, amount = $2, members = $3, remark = $4, status = $5, occurred_on = COALESCE($8, occurred_on)
+        WHERE id = $6 AND is_deleted = false
+        AND ($7::int[] IS NULL OR version = ANY($7))
+        RETURNING version`
+    status := db.DeriveTransactionStatus(payerUUID, membersUUID, nil)
+    var version int
+    err = tx.QueryRow(r.Context(), query, payerUUID, updatedTransaction.Amount, membersUUID, updatedTransaction.Remark, status, transactionID, ifMatchVersions(r), occurredOn).Scan(&version)
+    if err == pgx.ErrNoRows {
+        tx.Rollback(r.Context())
+        writeVersionMismatch(r.Context(), w, "transactions", transactionID.String(), true, "Transaction not found")
+        return
+    } else if err != nil {
+        if writeClosedPeriod(w, err) {
+            return
+        }
+        http.Error(w, fmt.Sprintf("Failed to update transaction: %v", err), http.StatusInternalServerError)
+        return
+    }
+    _, err = tx.Exec(r.Context(), "DELETE FROM transaction_confirmations WHERE transaction_id = $1", transactionID)
     if err != nil {
         http.Error(w, fmt.Sprintf("Failed to update transaction: %v", err), http.StatusInternalServerError)
         return
     }
+    if err := tx.Commit(r.Context()); err != nil {
+        http.Error(w, fmt.Sprintf("Failed to update transaction: %v", err), http.StatusInternalServerError)
+        return
+    }
+
+    publish(r.Context(), Event{
+        Topic:    TopicTransactions,
+        Type:     MessageTransactionUpdated,
+        Data:     updatedTransaction,
+        Audience: audienceOf(previous, []uuid.UUID{payerUUID}, membersUUID),
+    })
 
     // Respond with the updated transaction
+    w.Header().Set("ETag", versionETag(version))
     w.Header().Set("Content-Type", "application/json")
     w.WriteHeader(http.StatusOK)
     json.NewEncoder(w).Encode(updatedTransaction)
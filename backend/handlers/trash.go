@@ -0,0 +1,371 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/ishushreyas/expense-tracker/db"
+	"github.com/jackc/pgx/v5"
+)
+
+// TrashRetention is how long soft-deleted records stay restorable before
+// RunTrashPurge removes them for good. Zero keeps them forever.
+var TrashRetention time.Duration
+
+// trashInfo says who deleted a record and when it will be purged.
+type trashInfo struct {
+	DeletedBy     *uuid.UUID `json:"deleted_by"`
+	DeletedByName string     `json:"deleted_by_name,omitempty"`
+	PurgeAt       *time.Time `json:"purge_at,omitempty"`
+	sortKey       string
+}
+
+type trashedTransaction struct {
+	Transaction
+	trashInfo
+}
+
+type trashedPayment struct {
+	Payment
+	trashInfo
+}
+
+func newTrashInfo(deletedBy *uuid.UUID, deletedAt *time.Time, names map[uuid.UUID]string) trashInfo {
+	info := trashInfo{DeletedBy: deletedBy}
+	if deletedBy != nil {
+		info.DeletedByName = names[*deletedBy]
+	}
+	if TrashRetention > 0 && deletedAt != nil {
+		purgeAt := deletedAt.Add(TrashRetention)
+		info.PurgeAt = &purgeAt
+	}
+	return info
+}
+
+// trashSorts are the orders the trash can be listed in.
+var trashSorts = map[string]sortKey{
+	"deleted": {Expr: "COALESCE(deleted_at, created_at)", Type: "timestamptz"},
+}
+
+// GetTrash lists the caller's soft-deleted records of one ?type=
+// (transactions, the default, or payments) that they are a party to, most
+// recently deleted first, with who deleted them. It is paged like the
+// other lists.
+func GetTrash(w http.ResponseWriter, r *http.Request) {
+	// Create context with timeout
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	userID, err := sessionUserID(ctx)
+	if err != nil {
+		http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+		return
+	}
+
+	query := r.URL.Query()
+	kind := query.Get("type")
+	if kind == "" {
+		kind = "transactions"
+	}
+	if kind != "transactions" && kind != "payments" {
+		http.Error(w, "Invalid type, expected transactions or payments", http.StatusBadRequest)
+		return
+	}
+
+	page, err := pageRequestFromQuery(query, trashSorts, "-deleted")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	filter := &listFilter{}
+	filter.add("is_deleted = ?", true)
+	if kind == "transactions" {
+		filter.add("(payer_id = ? OR ? = ANY(members))", userID)
+	} else {
+		filter.add("? IN (payer_id, reciever_id)", userID)
+	}
+
+	var total *int
+	if page.IncludeTotal {
+		if total, err = countRows(ctx, kind+filter.where(), filter.args); err != nil {
+			http.Error(w, "Failed to count "+kind+": "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	keyset, keysetArgs, err := page.keyset("id", filter.nextArg(), stringID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	args := append(filter.args, keysetArgs...)
+
+	names, err := loadUsernames(ctx)
+	if err != nil {
+		http.Error(w, "Failed to retrieve users: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var response map[string]interface{}
+	if kind == "transactions" {
+		rows, err := db.Pool.Query(ctx, `
+			SELECT id, payer_id, amount, members, remark, status, created_at, occurred_on, is_deleted, deleted_at, deleted_by, `+page.sortColumn()+`
+			FROM transactions`+filter.where()+keyset, args...)
+		if err != nil {
+			http.Error(w, "Failed to retrieve transactions: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		transactions := []trashedTransaction{}
+		for rows.Next() {
+			var (
+				t         trashedTransaction
+				deletedBy *uuid.UUID
+			)
+			if err := rows.Scan(&t.ID, &t.PayerID, &t.Amount, &t.Members, &t.Remark, &t.Status, &t.CreatedAt, &t.OccurredOn, &t.IsDeleted, &t.DeletedAt, &deletedBy, &t.sortKey); err != nil {
+				rows.Close()
+				http.Error(w, "Failed to scan transaction: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			t.trashInfo = newTrashInfo(deletedBy, t.DeletedAt, names)
+			transactions = append(transactions, t)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			http.Error(w, "Failed to retrieve transactions: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		transactions, next, prev := pageOf(transactions, page, func(t trashedTransaction) (string, string) {
+			return t.sortKey, t.ID.String()
+		})
+		response = writePageLinks(w, r, page, next, prev, total)
+		response["transactions"] = transactions
+	} else {
+		rows, err := db.Pool.Query(ctx, `
+			SELECT id, payer_id, amount, reciever_id, remark, status, confirmed_at, created_at, occurred_on, is_deleted, deleted_at, deleted_by, `+page.sortColumn()+`
+			FROM payments`+filter.where()+keyset, args...)
+		if err != nil {
+			http.Error(w, "Failed to retrieve payments: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		payments := []trashedPayment{}
+		for rows.Next() {
+			var (
+				p         trashedPayment
+				deletedBy *uuid.UUID
+			)
+			if err := rows.Scan(&p.ID, &p.PayerID, &p.Amount, &p.RecieverID, &p.Remark, &p.Status, &p.ConfirmedAt, &p.CreatedAt, &p.OccurredOn, &p.IsDeleted, &p.DeletedAt, &deletedBy, &p.sortKey); err != nil {
+				rows.Close()
+				http.Error(w, "Failed to scan payment: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			p.trashInfo = newTrashInfo(deletedBy, p.DeletedAt, names)
+			payments = append(payments, p)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			http.Error(w, "Failed to retrieve payments: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		payments, next, prev := pageOf(payments, page, func(p trashedPayment) (string, string) {
+			return p.sortKey, p.ID.String()
+		})
+		response = writePageLinks(w, r, page, next, prev, total)
+		response["payments"] = payments
+	}
+	response["type"] = kind
+	response["retention_days"] = int(TrashRetention / (24 * time.Hour))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// RestoreTransaction takes a soft-deleted transaction out of the trash. Only
+// its payer or a member can.
+func RestoreTransaction(w http.ResponseWriter, r *http.Request) {
+	// Create context with timeout
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	transactionID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid transaction ID format", http.StatusBadRequest)
+		return
+	}
+
+	userID, err := sessionUserID(ctx)
+	if err != nil {
+		http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var (
+		t        Transaction
+		outsider bool
+	)
+	err = db.WithActor(ctx, db.Pool, userID, func(tx pgx.Tx) error {
+		var (
+			payerID uuid.UUID
+			members []uuid.UUID
+		)
+		err := tx.QueryRow(ctx, `
+			SELECT payer_id, members FROM transactions WHERE id = $1 AND is_deleted = true FOR UPDATE
+		`, transactionID).Scan(&payerID, &members)
+		if err != nil {
+			return err
+		}
+		if outsider = !isParty(userID, append([]uuid.UUID{payerID}, members...)...); outsider {
+			return nil
+		}
+
+		return tx.QueryRow(ctx, `
+			UPDATE transactions
+			SET is_deleted = false,
+			    deleted_at = NULL,
+			    deleted_by = NULL
+			WHERE id = $1 AND is_deleted = true
+			RETURNING id, payer_id, amount, members, remark, status, created_at, occurred_on, is_deleted, deleted_at
+		`, transactionID).Scan(&t.ID, &t.PayerID, &t.Amount, &t.Members, &t.Remark, &t.Status, &t.CreatedAt, &t.OccurredOn, &t.IsDeleted, &t.DeletedAt)
+	})
+	if err == pgx.ErrNoRows {
+		http.Error(w, "Transaction not found in trash", http.StatusNotFound)
+		return
+	} else if err != nil {
+		if writeClosedPeriod(w, err) {
+			return
+		}
+		http.Error(w, "Failed to restore transaction: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if outsider {
+		http.Error(w, "Only the payer or a member can restore a transaction", http.StatusForbidden)
+		return
+	}
+
+	publish(ctx, Event{
+		Topic:    TopicTransactions,
+		Type:     MessageTransactionRestored,
+		Data:     t,
+		Audience: append([]uuid.UUID{t.PayerID}, t.Members...),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+// RestorePayment takes a soft-deleted payment out of the trash. Only its
+// payer or reciever can.
+func RestorePayment(w http.ResponseWriter, r *http.Request) {
+	// Create context with timeout
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	paymentID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid payment ID format", http.StatusBadRequest)
+		return
+	}
+
+	userID, err := sessionUserID(ctx)
+	if err != nil {
+		http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var (
+		p        Payment
+		outsider bool
+	)
+	err = db.WithActor(ctx, db.Pool, userID, func(tx pgx.Tx) error {
+		var payerID, recieverID uuid.UUID
+		err := tx.QueryRow(ctx, `
+			SELECT payer_id, reciever_id FROM payments WHERE id = $1 AND is_deleted = true FOR UPDATE
+		`, paymentID).Scan(&payerID, &recieverID)
+		if err != nil {
+			return err
+		}
+		if outsider = !isParty(userID, payerID, recieverID); outsider {
+			return nil
+		}
+
+		return tx.QueryRow(ctx, `
+			UPDATE payments
+			SET is_deleted = false,
+			    deleted_at = NULL,
+			    deleted_by = NULL
+			WHERE id = $1 AND is_deleted = true
+			RETURNING id, payer_id, amount, reciever_id, remark, status, confirmed_at, created_at, occurred_on, is_deleted, deleted_at
+		`, paymentID).Scan(&p.ID, &p.PayerID, &p.Amount, &p.RecieverID, &p.Remark, &p.Status, &p.ConfirmedAt, &p.CreatedAt, &p.OccurredOn, &p.IsDeleted, &p.DeletedAt)
+	})
+	if err == pgx.ErrNoRows {
+		http.Error(w, "Payment not found in trash", http.StatusNotFound)
+		return
+	} else if err != nil {
+		if writeClosedPeriod(w, err) {
+			return
+		}
+		http.Error(w, "Failed to restore payment: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if outsider {
+		http.Error(w, "Only the payer or the reciever can restore a payment", http.StatusForbidden)
+		return
+	}
+
+	publish(ctx, Event{
+		Topic:    TopicPayments,
+		Type:     MessagePaymentRestored,
+		Data:     p,
+		Audience: []uuid.UUID{p.PayerID, p.RecieverID},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+// RunTrashPurge permanently deletes records that have been in the trash
+// longer than retention, checking every interval. A zero retention
+// disables it.
+func RunTrashPurge(ctx context.Context, retention, interval time.Duration) {
+	if retention <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := purgeTrash(ctx, retention); err != nil {
+			log.Printf("Error purging trash: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func purgeTrash(ctx context.Context, retention time.Duration) error {
+	if retention <= 0 {
+		return nil
+	}
+	cutoff := time.Now().Add(-retention)
+	for _, table := range []string{"transactions", "payments"} {
+		tag, err := db.Pool.Exec(ctx, "DELETE FROM "+table+" WHERE is_deleted = true AND deleted_at < $1", cutoff)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() > 0 {
+			log.Printf("Purged %d %s from the trash", tag.RowsAffected(), table)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ishushreyas/expense-tracker/db"
+)
+
+// trendBuckets are the periods /trends can total spending over.
+var trendBuckets = map[string]bool{"day": true, "week": true, "month": true, "year": true}
+
+// maxTrendBuckets is how many buckets a trend may span.
+const maxTrendBuckets = 1000
+
+// trendGroups select what each series of /trends is keyed by. A member is
+// credited with their equal share of each transaction they are part of,
+// split between its distinct members as the ledger does.
+var trendGroups = map[string]string{
+	"":      `SELECT local_at, amount, NULL::uuid AS grp FROM filtered`,
+	"payer": `SELECT local_at, amount, payer_id AS grp FROM filtered`,
+	"member": `SELECT f.local_at, f.amount / COUNT(*) OVER (PARTITION BY f.id) AS amount, m.member AS grp
+		FROM filtered f, LATERAL (SELECT DISTINCT unnest(f.members) AS member) m`,
+}
+
+// TrendPoint is the spending in one bucket. Start is when the bucket
+// begins in the requested timezone.
+type TrendPoint struct {
+	Start time.Time `json:"start"`
+	Count int       `json:"count"`
+	Total float64   `json:"total"`
+}
+
+// TrendSeries is a run of buckets for one payer or member, or for
+// everyone when the trend isn't grouped.
+type TrendSeries struct {
+	UserID   *uuid.UUID   `json:"user_id,omitempty"`
+	Username string       `json:"username,omitempty"`
+	Points   []TrendPoint `json:"points"`
+}
+
+// GetTrends totals spending per ?bucket= (day, week, month or year; month
+// by default) with empty buckets filled in as zero, optionally as one
+// series per payer or member (?group_by=). Transactions are bucketed by
+// the day they occurred on; the caller's timezone or ?tz= decides what
+// today is and labels the buckets. The start_date/end_date range
+// (YYYY-MM-DD, inclusive) and the other transaction list filters apply.
+// Trends spanning more than maxTrendBuckets buckets are refused.
+func GetTrends(w http.ResponseWriter, r *http.Request) {
+	// Create context with timeout
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	query := r.URL.Query()
+
+	bucket := query.Get("bucket")
+	if bucket == "" {
+		bucket = "month"
+	}
+	if !trendBuckets[bucket] {
+		http.Error(w, "Invalid bucket, expected day, week, month or year", http.StatusBadRequest)
+		return
+	}
+
+	groupBy := query.Get("group_by")
+	items, ok := trendGroups[groupBy]
+	if !ok {
+		http.Error(w, "Invalid group_by, expected payer or member", http.StatusBadRequest)
+		return
+	}
+
+	prefs, err := preferencesFor(ctx, query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tz, loc := prefs.Timezone, prefs.Location
+
+	var start, end *time.Time
+	for param, bound := range map[string]**time.Time{"start_date": &start, "end_date": &end} {
+		if value := query.Get(param); value != "" {
+			date, err := time.Parse("2006-01-02", value)
+			if err != nil {
+				http.Error(w, "Invalid "+param+", expected YYYY-MM-DD", http.StatusBadRequest)
+				return
+			}
+			*bound = &date
+		}
+	}
+
+	// The date range is applied below, alongside the bucketing
+	query.Del("start_date")
+	query.Del("end_date")
+	filter, err := ledgerFilter(query, "(payer_id = ? OR ? = ANY(members))", taggableTransaction)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if query.Get("status") == "" {
+		filter.add("status <> ?", "rejected")
+	}
+
+	n := filter.nextArg()
+	tzArg := fmt.Sprintf("$%d::text", n)
+	bucketArg := fmt.Sprintf("$%d::text", n+1)
+	startArg := fmt.Sprintf("$%d::timestamp", n+2)
+	endArg := fmt.Sprintf("$%d::timestamp", n+3)
+	args := append(filter.args, tz, bucket, start, end)
+
+	// An ungrouped trend is a single series even when nothing was spent
+	groups := `SELECT DISTINCT grp FROM items`
+	if groupBy == "" {
+		groups = `SELECT NULL::uuid AS grp`
+	}
+
+	sqlQuery := `
+		WITH filtered AS (
+			SELECT id, occurred_on::timestamp AS local_at, amount::float8 AS amount, payer_id, members
+			FROM transactions` + filter.where() + `
+			AND (` + startArg + ` IS NULL OR occurred_on >= ` + startArg + `)
+			AND (` + endArg + ` IS NULL OR occurred_on <= ` + endArg + `)
+		), items AS (
+			` + items + `
+		), bounds AS (
+			SELECT date_trunc(` + bucketArg + `, COALESCE(` + startArg + `, MIN(local_at), ` + endArg + `, now() AT TIME ZONE ` + tzArg + `)) AS lo,
+				date_trunc(` + bucketArg + `, COALESCE(` + endArg + `, now() AT TIME ZONE ` + tzArg + `)) AS hi
+			FROM items
+		), buckets AS (
+			SELECT generate_series(lo, hi, ('1 ' || ` + bucketArg + `)::interval) AS bucket FROM bounds
+			LIMIT ` + fmt.Sprint(maxTrendBuckets+1) + `
+		), groups AS (
+			` + groups + `
+		)
+		SELECT b.bucket, g.grp, u.username, COUNT(i.amount), COALESCE(SUM(i.amount), 0)
+		FROM buckets b
+		CROSS JOIN groups g
+		LEFT JOIN items i ON date_trunc(` + bucketArg + `, i.local_at) = b.bucket AND i.grp IS NOT DISTINCT FROM g.grp
+		LEFT JOIN users u ON u.id = g.grp
+		GROUP BY b.bucket, g.grp, u.username
+		ORDER BY g.grp NULLS FIRST, b.bucket
+	`
+	rows, err := db.Pool.Query(ctx, sqlQuery, args...)
+	if err != nil {
+		http.Error(w, "Failed to retrieve trends: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	series := []*TrendSeries{}
+	for rows.Next() {
+		var (
+			point    TrendPoint
+			local    time.Time
+			userID   *uuid.UUID
+			username *string
+		)
+		if err := rows.Scan(&local, &userID, &username, &point.Count, &point.Total); err != nil {
+			http.Error(w, "Failed to scan trend: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Buckets come back as wall-clock times in tz
+		point.Start = time.Date(local.Year(), local.Month(), local.Day(), local.Hour(), local.Minute(), local.Second(), 0, loc)
+
+		if len(series) == 0 || !sameUser(series[len(series)-1].UserID, userID) {
+			s := &TrendSeries{UserID: userID}
+			if username != nil {
+				s.Username = *username
+			}
+			series = append(series, s)
+		}
+		current := series[len(series)-1]
+		current.Points = append(current.Points, point)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Failed to retrieve trends: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(series) > 0 && len(series[0].Points) > maxTrendBuckets {
+		http.Error(w, fmt.Sprintf("Trend spans more than %d buckets, narrow the date range or use a larger bucket", maxTrendBuckets), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"bucket":   bucket,
+		"group_by": groupBy,
+		"timezone": tz,
+		"series":   series,
+	})
+}
+
+func sameUser(a, b *uuid.UUID) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
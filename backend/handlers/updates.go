@@ -4,10 +4,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/gorilla/mux"
+	"github.com/ishushreyas/expense-tracker/db"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -33,22 +36,47 @@ func NewHandler(db *pgxpool.Pool, storage *storage.Client, bucketName string) *H
 	}
 }
 
-// GetStories retrieves all stories, ordered by timestamp
+// storySorts are the orders the story list can be sorted in.
+var storySorts = map[string]sortKey{
+	"date": {Expr: "timestamp", Type: "timestamptz"},
+}
+
+// GetStories retrieves a page of stories, newest first
 func (h *Handler) GetStories(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	
+
+	page, err := pageRequestFromQuery(r.URL.Query(), storySorts, "-date")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var total *int
+	if page.IncludeTotal {
+		var count int
+		if err := h.db.QueryRow(ctx, "SELECT COUNT(*) FROM stories").Scan(&count); err != nil {
+			http.Error(w, "Failed to count stories", http.StatusInternalServerError)
+			return
+		}
+		total = &count
+	}
+
+	keyset, args, err := page.keyset("id", 1, int64ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	rows, err := h.db.Query(ctx, `
 		SELECT id, username, content, image_url, timestamp 
 		FROM stories 
-		ORDER BY timestamp DESC
-	`)
+		WHERE true`+keyset, args...)
 	if err != nil {
 		http.Error(w, "Failed to fetch stories", http.StatusInternalServerError)
 		return
 	}
 	defer rows.Close()
 
-	var stories []Story
+	stories := []Story{}
 	for rows.Next() {
 		var story Story
 		err := rows.Scan(&story.ID, &story.Username, &story.Content, &story.ImageURL, &story.Timestamp)
@@ -59,8 +87,15 @@ func (h *Handler) GetStories(w http.ResponseWriter, r *http.Request) {
 		stories = append(stories, story)
 	}
 
+	stories, next, prev := pageOf(stories, page, func(s Story) (string, string) {
+		return s.Timestamp.Format(time.RFC3339Nano), strconv.FormatInt(s.ID, 10)
+	})
+
+	response := writePageLinks(w, r, page, next, prev, total)
+	response["stories"] = stories
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(stories)
+	json.NewEncoder(w).Encode(response)
 }
 
 // CreateStory handles creating a new story with optional image upload
@@ -108,19 +143,23 @@ func (h *Handler) CreateStory(w http.ResponseWriter, r *http.Request) {
 
 	// Insert story into database
 	var story Story
-	err = h.db.QueryRow(ctx, `
-		INSERT INTO stories (username, content, image_url, timestamp)
-		VALUES ($1, $2, $3, NOW())
-		RETURNING id, username, content, image_url, timestamp
-	`, username, content, imageURL).Scan(
-		&story.ID, &story.Username, &story.Content, &story.ImageURL, &story.Timestamp,
-	)
+	err = db.WithActor(ctx, h.db, auditActor(ctx), func(tx pgx.Tx) error {
+		return tx.QueryRow(ctx, `
+			INSERT INTO stories (username, content, image_url, timestamp)
+			VALUES ($1, $2, $3, NOW())
+			RETURNING id, username, content, image_url, timestamp
+		`, username, content, imageURL).Scan(
+			&story.ID, &story.Username, &story.Content, &story.ImageURL, &story.Timestamp,
+		)
+	})
 
 	if err != nil {
 		http.Error(w, "Failed to create story", http.StatusInternalServerError)
 		return
 	}
 
+	publish(ctx, Event{Topic: TopicStories, Type: MessageStoryCreated, Data: story})
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(story)
 }
@@ -149,18 +188,24 @@ func (h *Handler) DeleteStory(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Delete story from database
-	_, err = h.db.Exec(ctx, "DELETE FROM stories WHERE id = $1", id)
+	err = db.WithActor(ctx, h.db, auditActor(ctx), func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, "DELETE FROM stories WHERE id = $1", id)
+		return err
+	})
 	if err != nil {
 		http.Error(w, "Failed to delete story", http.StatusInternalServerError)
 		return
 	}
 
+	publish(ctx, Event{Topic: TopicStories, Type: MessageStoryDeleted, Data: map[string]string{"id": id}})
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
-// SetupRoutes configures the routes for the stories API
-func (h *Handler) SetupRoutes(r *mux.Router) {
+// SetupRoutes configures the routes for the stories API. identify attaches
+// the caller's session, if any, so changes can be attributed to them.
+func (h *Handler) SetupRoutes(r *mux.Router, identify func(http.HandlerFunc) http.HandlerFunc) {
 	r.HandleFunc("/stories", h.GetStories).Methods("GET")
-	r.HandleFunc("/stories", h.CreateStory).Methods("POST")
-	r.HandleFunc("/stories/{id}", h.DeleteStory).Methods("DELETE")
+	r.HandleFunc("/stories", identify(Idempotent(h.CreateStory))).Methods("POST")
+	r.HandleFunc("/stories/{id}", identify(h.DeleteStory)).Methods("DELETE")
 }
@@ -11,6 +11,7 @@ import (
     "github.com/gorilla/mux"
     "github.com/ishushreyas/expense-tracker/db"
     "github.com/jackc/pgx/v5"
+    "github.com/jackc/pgx/v5/pgconn"
 )
 
 func AddUser(w http.ResponseWriter, r *http.Request) {
@@ -38,7 +39,10 @@ func AddUser(w http.ResponseWriter, r *http.Request) {
     query := "INSERT INTO users (id, name, email) VALUES ($1, $2, true)"
     
     // Use connection from pool with context
-    _, err := db.Pool.Exec(ctx, query, userID, input.Name)
+    err := db.WithActor(ctx, db.Pool, auditActor(ctx), func(tx pgx.Tx) error {
+        _, err := tx.Exec(ctx, query, userID, input.Name)
+        return err
+    })
     if err != nil {
         http.Error(w, "Failed to add user: "+err.Error(), http.StatusInternalServerError)
         return
@@ -49,15 +53,39 @@ func AddUser(w http.ResponseWriter, r *http.Request) {
     json.NewEncoder(w).Encode(map[string]string{"id": userID, "name": input.Name})
 }
 
+// userSorts are the orders the user list can be sorted in.
+var userSorts = map[string]sortKey{
+    "date": {Expr: "created_at", Type: "timestamptz"},
+}
+
 func GetUsers(w http.ResponseWriter, r *http.Request) {
     // Create context with timeout
     ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
     defer cancel()
 
-    query := "SELECT id, username, email FROM users"
+    page, err := pageRequestFromQuery(r.URL.Query(), userSorts, "-date")
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    var total *int
+    if page.IncludeTotal {
+        if total, err = countRows(ctx, "users", nil); err != nil {
+            http.Error(w, "Failed to count users: "+err.Error(), http.StatusInternalServerError)
+            return
+        }
+    }
+
+    keyset, args, err := page.keyset("id", 1, stringID)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    query := "SELECT id, username, email, created_at FROM users WHERE true" + keyset
     
     // Use connection from pool with context
-    rows, err := db.Pool.Query(ctx, query)
+    rows, err := db.Pool.Query(ctx, query, args...)
     if err != nil {
         http.Error(w, "Failed to retrieve users: "+err.Error(), http.StatusInternalServerError)
         return
@@ -71,14 +99,15 @@ func GetUsers(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    // Handle case of no users
-    if len(users) == 0 {
-        w.WriteHeader(http.StatusNoContent)
-        return
-    }
+    users, next, prev := pageOf(users, page, func(u User) (string, string) {
+        return u.CreatedAt.Format(time.RFC3339Nano), u.ID
+    })
+
+    response := writePageLinks(w, r, page, next, prev, total)
+    response["users"] = users
 
     w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(users)
+    json.NewEncoder(w).Encode(response)
 }
 
 func GetUserByID(w http.ResponseWriter, r *http.Request) {
@@ -96,14 +125,14 @@ func GetUserByID(w http.ResponseWriter, r *http.Request) {
     defer cancel()
 
     // Query to retrieve user by ID
-    query := "SELECT id, username, email FROM users WHERE id = $1"
+    query := "SELECT id, username, email, created_at FROM users WHERE id = $1"
 
     // Execute the query
     row := db.Pool.QueryRow(ctx, query, id)
 
     // Parse the result into a User struct
     var user User
-    err := row.Scan(&user.ID, &user.Username, &user.Email)
+    err := row.Scan(&user.ID, &user.Username, &user.Email, &user.CreatedAt)
     if err != nil {
         if err == pgx.ErrNoRows {
             http.Error(w, "User not found", http.StatusNotFound)
@@ -130,7 +159,12 @@ func DeleteUser(w http.ResponseWriter, r *http.Request) {
     defer cancel()
 
     // Execute delete query
-    commandTag, err := db.Pool.Exec(ctx, "DELETE FROM users WHERE id = $1", userID)
+    var commandTag pgconn.CommandTag
+    err := db.WithActor(ctx, db.Pool, auditActor(ctx), func(tx pgx.Tx) error {
+        var err error
+        commandTag, err = tx.Exec(ctx, "DELETE FROM users WHERE id = $1", userID)
+        return err
+    })
     if err != nil {
         http.Error(w, "Failed to delete user: "+err.Error(), http.StatusInternalServerError)
         return
@@ -151,4 +185,5 @@ type User struct {
     ID       string `json:"id" db:"id"`
     Username     string `json:"username" db:"username"`
     Email      string	   `json:"email"`
+    CreatedAt  time.Time `json:"created_at" db:"created_at"`
 }
@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/ishushreyas/expense-tracker/db"
+)
+
+func TestAsOfMatchesThen(t *testing.T) {
+	testDatabase(t)
+	seedTransactions(t, 500)
+	seedPayments(t, 300)
+	ctx := context.Background()
+
+	var asOf time.Time
+	if err := db.Pool.QueryRow(ctx, "SELECT now()").Scan(&asOf); err != nil {
+		t.Fatal(err)
+	}
+	thenSummary, err := summarizeTransactions(ctx, summaryOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	thenLedger, err := loadLedger(ctx, balanceOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Later writes must not share the moment captured above
+	time.Sleep(10 * time.Millisecond)
+
+	for _, stmt := range []string{
+		`UPDATE transactions SET amount = amount + 1 WHERE id IN (SELECT id FROM transactions ORDER BY id LIMIT 50)`,
+		`UPDATE transactions SET members = members[2:] WHERE id IN (SELECT id FROM transactions ORDER BY id DESC LIMIT 50)`,
+		`UPDATE transactions SET is_deleted = true, deleted_at = now() WHERE id IN (SELECT id FROM transactions WHERE NOT is_deleted ORDER BY created_at LIMIT 50)`,
+		`UPDATE transactions SET is_deleted = false, deleted_at = NULL WHERE id IN (SELECT id FROM transactions WHERE is_deleted ORDER BY created_at DESC LIMIT 10)`,
+		`DELETE FROM transactions WHERE id IN (SELECT id FROM transactions ORDER BY created_at DESC LIMIT 20)`,
+		`INSERT INTO transactions (id, payer_id, amount, members, occurred_on)
+			SELECT gen_random_uuid(), id, 100, ARRAY[id], DATE '2023-01-01' FROM users`,
+		`UPDATE payments SET status = 'confirmed', confirmed_at = now() WHERE id IN (SELECT id FROM payments WHERE status = 'pending' ORDER BY id LIMIT 30)`,
+		`UPDATE payments SET amount = amount + 1 WHERE id IN (SELECT id FROM payments ORDER BY id LIMIT 50)`,
+		`UPDATE payments SET is_deleted = true, deleted_at = now() WHERE id IN (SELECT id FROM payments WHERE NOT is_deleted ORDER BY created_at DESC LIMIT 40)`,
+		`UPDATE payments SET is_deleted = false, deleted_at = NULL WHERE id IN (SELECT id FROM payments WHERE is_deleted ORDER BY created_at LIMIT 10)`,
+		`DELETE FROM payments WHERE id IN (SELECT id FROM payments ORDER BY amount DESC LIMIT 20)`,
+	} {
+		if _, err := db.Pool.Exec(ctx, stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Tags are not versioned, so tag totals are left out
+	got, err := summarizeTransactions(ctx, summaryOptions{AsOf: &asOf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.TransactionCount != thenSummary.TransactionCount || !approxEqual(got.TotalExpense, thenSummary.TotalExpense, 1e-9) {
+		t.Errorf("as of then: %d transactions totalling %v, want %d totalling %v",
+			got.TransactionCount, got.TotalExpense, thenSummary.TransactionCount, thenSummary.TotalExpense)
+	}
+	if len(got.UserExpenses) != len(thenSummary.UserExpenses) {
+		t.Errorf("as of then: %d payers, want %d", len(got.UserExpenses), len(thenSummary.UserExpenses))
+	}
+	for userID, amount := range thenSummary.UserExpenses {
+		if !approxEqual(got.UserExpenses[userID], amount, 1e-9) {
+			t.Errorf("as of then: expenses of %s = %v, want %v", userID, got.UserExpenses[userID], amount)
+		}
+	}
+	for userID, amount := range thenSummary.UserBalances {
+		if math.Abs(got.UserBalances[userID]-amount) > 0.011 {
+			t.Errorf("as of then: summary balance of %s = %v, want %v", userID, got.UserBalances[userID], amount)
+		}
+	}
+	if len(got.DailyTrends) != len(thenSummary.DailyTrends) {
+		t.Fatalf("as of then: %d days, want %d", len(got.DailyTrends), len(thenSummary.DailyTrends))
+	}
+	for i, day := range thenSummary.DailyTrends {
+		if g := got.DailyTrends[i]; g.Date != day.Date || g.Count != day.Count || !approxEqual(g.Total, day.Total, 1e-9) {
+			t.Errorf("as of then: day %+v, want %+v", g, day)
+		}
+	}
+
+	gotLedger, err := loadLedger(ctx, balanceOptions{AsOf: &asOf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, userID := range thenLedger.Members() {
+		if math.Abs(gotLedger.Balance(userID)-thenLedger.Balance(userID)) > 0.011 {
+			t.Errorf("as of then: balance of %s = %v, want %v", userID, gotLedger.Balance(userID), thenLedger.Balance(userID))
+		}
+	}
+	for _, pair := range thenLedger.Pairs() {
+		if owes := gotLedger.Owes(pair.DebtorID, pair.CreditorID); math.Abs(owes-pair.Amount) > 0.011 {
+			t.Errorf("as of then: %s owes %s %v, want %v", pair.DebtorID, pair.CreditorID, owes, pair.Amount)
+		}
+	}
+	if len(gotLedger.Pairs()) != len(thenLedger.Pairs()) {
+		t.Errorf("as of then: %d pairs, want %d", len(gotLedger.Pairs()), len(thenLedger.Pairs()))
+	}
+
+	// Without as_of the writes show
+	now, err := summarizeTransactions(ctx, summaryOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if now.TransactionCount == thenSummary.TransactionCount && now.TotalExpense == thenSummary.TotalExpense {
+		t.Error("summary unchanged by the writes")
+	}
+}
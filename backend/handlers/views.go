@@ -0,0 +1,447 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/ishushreyas/expense-tracker/db"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// A saved view is a named set of query parameters for the transaction list
+// or the summary. Running it gives what requesting that endpoint with the
+// same parameters would; "me" as payer_id or member_id stands for whoever
+// runs it, so a shared view like "my share of groceries" works for
+// everyone. Likewise period (this_month, last_month or this_year) stands
+// for the dates it covers when the view runs, in the runner's timezone.
+// Views are private to their owner unless shared.
+
+// SavedView is a stored filter and sort preset.
+type SavedView struct {
+	ID        uuid.UUID  `json:"id" db:"id"`
+	OwnerID   uuid.UUID  `json:"owner_id" db:"owner_id"`
+	Name      string     `json:"name" db:"name"`
+	Target    string     `json:"target" db:"target"`
+	Query     string     `json:"query" db:"query"`
+	Shared    bool       `json:"shared" db:"shared"`
+	CreatedAt time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt *time.Time `json:"updated_at" db:"updated_at"`
+}
+
+const savedViewColumns = `id, owner_id, name, target, query, shared, created_at, updated_at`
+
+// viewTargets maps what a view can be saved for to the handler that runs
+// it and the parameters it accepts.
+var viewTargets = map[string]struct {
+	handler http.HandlerFunc
+	params  []string
+}{
+	"transactions": {
+		handler: GetTransactions,
+		params: []string{"payer_id", "member_id", "tag", "status", "start_date", "end_date",
+			"min_amount", "max_amount", "remark", "deleted", "sort", "limit", "include_total", "period"},
+	},
+	"summary": {
+		handler: GenerateSummary,
+		params:  []string{"start_date", "end_date", "confirmed_only", "as_of", "period"},
+	},
+}
+
+// viewPeriods are the relative periods a view can cover.
+var viewPeriods = []string{"this_month", "last_month", "this_year"}
+
+// viewRunParams may be given when running a view, to page through it.
+var viewRunParams = []string{"after", "before", "limit", "include_total"}
+
+// parseViewQuery checks a view's query string against its target and
+// returns it in canonical form.
+func parseViewQuery(target, raw string) (string, error) {
+	t, ok := viewTargets[target]
+	if !ok {
+		names := make([]string, 0, len(viewTargets))
+		for name := range viewTargets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return "", fmt.Errorf("Invalid target, expected one of %s", strings.Join(names, ", "))
+	}
+
+	query, err := url.ParseQuery(strings.TrimPrefix(raw, "?"))
+	if err != nil {
+		return "", fmt.Errorf("Invalid query: %v", err)
+	}
+	for name := range query {
+		if !contains(t.params, name) {
+			return "", fmt.Errorf("Parameter %s cannot be saved in a %s view", name, target)
+		}
+	}
+
+	if period := query.Get("period"); period != "" {
+		if !contains(viewPeriods, period) {
+			return "", fmt.Errorf("Invalid period, expected one of %s", strings.Join(viewPeriods, ", "))
+		}
+		if query.Has("start_date") || query.Has("end_date") {
+			return "", errors.New("period cannot be combined with start_date or end_date")
+		}
+	}
+
+	// Catch mistakes now rather than every time the view runs
+	check := withPeriod(withCaller(query, uuid.Nil), time.Now(), time.UTC)
+	switch target {
+	case "transactions":
+		if _, err := pageRequestFromQuery(check, ledgerSorts, "-date"); err != nil {
+			return "", err
+		}
+		if _, err := ledgerFilter(check, "true", taggableTransaction); err != nil {
+			return "", err
+		}
+	case "summary":
+		if _, err := parseAsOf(check.Get("as_of")); err != nil {
+			return "", err
+		}
+	}
+	return query.Encode(), nil
+}
+
+// withCaller substitutes userID for "me" in the user filters.
+func withCaller(query url.Values, userID uuid.UUID) url.Values {
+	resolved := url.Values{}
+	for name, values := range query {
+		for _, value := range values {
+			if value == "me" && (name == "payer_id" || name == "member_id") {
+				value = userID.String()
+			}
+			resolved.Add(name, value)
+		}
+	}
+	return resolved
+}
+
+// withPeriod replaces period with the start_date and end_date it covers
+// on now's date in loc.
+func withPeriod(query url.Values, now time.Time, loc *time.Location) url.Values {
+	period := query.Get("period")
+	if period == "" {
+		return query
+	}
+	year, month, _ := now.In(loc).Date()
+	var start, end time.Time
+	switch period {
+	case "this_month":
+		start = time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+		end = start.AddDate(0, 1, -1)
+	case "last_month":
+		start = time.Date(year, month-1, 1, 0, 0, 0, 0, time.UTC)
+		end = start.AddDate(0, 1, -1)
+	case "this_year":
+		start = time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC)
+		end = time.Date(year, time.December, 31, 0, 0, 0, 0, time.UTC)
+	}
+
+	resolved := url.Values{}
+	for name, values := range query {
+		if name != "period" {
+			resolved[name] = values
+		}
+	}
+	resolved.Set("start_date", start.Format("2006-01-02"))
+	resolved.Set("end_date", end.Format("2006-01-02"))
+	return resolved
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// GetSavedViews lists the caller's views and those shared with everyone.
+func GetSavedViews(w http.ResponseWriter, r *http.Request) {
+	// Create context with timeout
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	userID, err := sessionUserID(ctx)
+	if err != nil {
+		http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+		return
+	}
+
+	sqlQuery := `SELECT ` + savedViewColumns + ` FROM saved_views WHERE (owner_id = $1 OR shared)`
+	args := []interface{}{userID}
+	if target := r.URL.Query().Get("target"); target != "" {
+		sqlQuery += " AND target = $2"
+		args = append(args, target)
+	}
+	sqlQuery += " ORDER BY name"
+
+	rows, err := db.Pool.Query(ctx, sqlQuery, args...)
+	if err != nil {
+		http.Error(w, "Failed to retrieve saved views: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	views, err := pgx.CollectRows(rows, pgx.RowToStructByName[SavedView])
+	if err != nil {
+		http.Error(w, "Failed to process saved views: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"views": views,
+	})
+}
+
+// CreateSavedView saves {"name", "target", "query", "shared"} as a view
+// owned by the caller.
+func CreateSavedView(w http.ResponseWriter, r *http.Request) {
+	type ViewInput struct {
+		Name   string `json:"name"`
+		Target string `json:"target"`
+		Query  string `json:"query"`
+		Shared bool   `json:"shared"`
+	}
+
+	// Create context with timeout
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	userID, err := sessionUserID(ctx)
+	if err != nil {
+		http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var input ViewInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	input.Name = strings.TrimSpace(input.Name)
+	if input.Name == "" {
+		http.Error(w, "Name cannot be empty", http.StatusBadRequest)
+		return
+	}
+	query, err := parseViewQuery(input.Target, input.Query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.Pool.Query(ctx, `
+		INSERT INTO saved_views (id, owner_id, name, target, query, shared)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING `+savedViewColumns,
+		uuid.New(), userID, input.Name, input.Target, query, input.Shared)
+	if err != nil {
+		http.Error(w, "Failed to save view: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	view, err := pgx.CollectOneRow(rows, pgx.RowToStructByName[SavedView])
+	if err != nil {
+		if isUniqueViolation(err) {
+			http.Error(w, "You already have a view named "+input.Name, http.StatusConflict)
+			return
+		}
+		http.Error(w, "Failed to save view: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(view)
+}
+
+// UpdateSavedView renames, re-queries or (un)shares one of the caller's
+// views; fields left out of the body are kept.
+func UpdateSavedView(w http.ResponseWriter, r *http.Request) {
+	type ViewInput struct {
+		Name   *string `json:"name"`
+		Query  *string `json:"query"`
+		Shared *bool   `json:"shared"`
+	}
+
+	// Create context with timeout
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	userID, err := sessionUserID(ctx)
+	if err != nil {
+		http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+		return
+	}
+
+	viewID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid view ID format", http.StatusBadRequest)
+		return
+	}
+
+	var input ViewInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	view, err := ownedView(ctx, viewID, userID)
+	if err == pgx.ErrNoRows {
+		http.Error(w, "View not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to retrieve view: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if input.Name != nil {
+		view.Name = strings.TrimSpace(*input.Name)
+		if view.Name == "" {
+			http.Error(w, "Name cannot be empty", http.StatusBadRequest)
+			return
+		}
+	}
+	if input.Query != nil {
+		if view.Query, err = parseViewQuery(view.Target, *input.Query); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if input.Shared != nil {
+		view.Shared = *input.Shared
+	}
+
+	rows, err := db.Pool.Query(ctx, `
+		UPDATE saved_views
+		SET name = $2, query = $3, shared = $4, updated_at = now()
+		WHERE id = $1
+		RETURNING `+savedViewColumns,
+		viewID, view.Name, view.Query, view.Shared)
+	if err != nil {
+		http.Error(w, "Failed to update view: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	updated, err := pgx.CollectOneRow(rows, pgx.RowToStructByName[SavedView])
+	if err != nil {
+		if isUniqueViolation(err) {
+			http.Error(w, "You already have a view named "+view.Name, http.StatusConflict)
+			return
+		}
+		http.Error(w, "Failed to update view: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+}
+
+// DeleteSavedView deletes one of the caller's views.
+func DeleteSavedView(w http.ResponseWriter, r *http.Request) {
+	// Create context with timeout
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	userID, err := sessionUserID(ctx)
+	if err != nil {
+		http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+		return
+	}
+
+	viewID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid view ID format", http.StatusBadRequest)
+		return
+	}
+
+	commandTag, err := db.Pool.Exec(ctx, "DELETE FROM saved_views WHERE id = $1 AND owner_id = $2", viewID, userID)
+	if err != nil {
+		http.Error(w, "Failed to delete view: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if commandTag.RowsAffected() == 0 {
+		http.Error(w, "View not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RunSavedView answers as the view's endpoint would for its parameters.
+// Paging parameters on the request are passed through, so the cursors and
+// Link header of a transactions view lead to its next page.
+func RunSavedView(w http.ResponseWriter, r *http.Request) {
+	// Create context with timeout
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	userID, err := sessionUserID(ctx)
+	if err != nil {
+		http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+		return
+	}
+
+	viewID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid view ID format", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.Pool.Query(ctx, `SELECT `+savedViewColumns+` FROM saved_views WHERE id = $1 AND (owner_id = $2 OR shared)`, viewID, userID)
+	var view SavedView
+	if err == nil {
+		view, err = pgx.CollectOneRow(rows, pgx.RowToStructByName[SavedView])
+	}
+	if err == pgx.ErrNoRows {
+		http.Error(w, "View not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to retrieve view: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Relative periods follow the runner's timezone
+	prefs, err := preferencesFor(ctx, url.Values{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	stored, _ := url.ParseQuery(view.Query)
+	query := withPeriod(withCaller(stored, userID), time.Now(), prefs.Location)
+	for _, name := range viewRunParams {
+		if values, ok := r.URL.Query()[name]; ok {
+			query[name] = values
+		}
+	}
+
+	run := r.Clone(r.Context())
+	run.URL.RawQuery = query.Encode()
+	w.Header().Set("X-Saved-View", view.ID.String())
+	viewTargets[view.Target].handler(w, run)
+}
+
+// ownedView loads one of userID's views.
+func ownedView(ctx context.Context, viewID, userID uuid.UUID) (SavedView, error) {
+	rows, err := db.Pool.Query(ctx, `SELECT `+savedViewColumns+` FROM saved_views WHERE id = $1 AND owner_id = $2`, viewID, userID)
+	if err != nil {
+		return SavedView{}, err
+	}
+	return pgx.CollectOneRow(rows, pgx.RowToStructByName[SavedView])
+}
+
+// isUniqueViolation reports whether err is Postgres refusing a duplicate.
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
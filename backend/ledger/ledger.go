@@ -0,0 +1,234 @@
+// Package ledger nets shared expenses and settlement payments into balances.
+//
+// An expense paid by P for members M is split equally between the distinct
+// members. Every member other than P owes P their share, so P's net balance
+// goes up by the amount minus their own share and each other member's goes
+// down by one share. A payer who is not among the members paid entirely on
+// behalf of others.
+//
+// A settlement is money handed from one member to another outside of an
+// expense. It reduces what the sender owes the reciever (or, past zero, makes
+// the reciever owe the sender): the sender's balance goes up and the
+// reciever's goes down by the amount.
+//
+// Net balances always sum to zero. A positive balance means the member is
+// owed money overall; a negative one means they owe.
+package ledger
+
+import (
+	"math"
+	"sort"
+
+	"github.com/google/uuid"
+)
+
+// Amounts smaller than this are treated as settled.
+const epsilon = 0.005
+
+type Expense struct {
+	ID      uuid.UUID
+	PayerID uuid.UUID
+	Amount  float64
+	Members []uuid.UUID
+}
+
+type Settlement struct {
+	ID     uuid.UUID
+	FromID uuid.UUID
+	ToID   uuid.UUID
+	Amount float64
+}
+
+// PairBalance says Debtor owes Creditor Amount once everything between the
+// two of them is netted.
+type PairBalance struct {
+	DebtorID   uuid.UUID `json:"debtor_id"`
+	CreditorID uuid.UUID `json:"creditor_id"`
+	Amount     float64   `json:"amount"`
+}
+
+// Kinds of record that contribute to a pair's balance.
+const (
+	KindExpense    = "expense"
+	KindSettlement = "settlement"
+)
+
+// Contribution is one record's effect on what a debtor owes a creditor.
+// A positive amount increased the debt; a negative one paid it down.
+type Contribution struct {
+	Kind   string    `json:"kind"`
+	ID     uuid.UUID `json:"id"`
+	Amount float64   `json:"amount"`
+}
+
+// pairKey orders a pair so that A < B; the stored value is what A owes B.
+type pairKey struct {
+	A, B uuid.UUID
+}
+
+func keyFor(debtor, creditor uuid.UUID) (pairKey, float64) {
+	if debtor.String() < creditor.String() {
+		return pairKey{debtor, creditor}, 1
+	}
+	return pairKey{creditor, debtor}, -1
+}
+
+type Ledger struct {
+	net     map[uuid.UUID]float64
+	pairs   map[pairKey]float64
+	sources map[pairKey][]Contribution
+}
+
+func New() *Ledger {
+	return &Ledger{
+		net:     make(map[uuid.UUID]float64),
+		pairs:   make(map[pairKey]float64),
+		sources: make(map[pairKey][]Contribution),
+	}
+}
+
+// FromSnapshot rebuilds a ledger from stored net balances and pair
+// amounts, e.g. the running balances the database keeps. It knows nothing
+// of the records behind them, so Contributions is always empty.
+func FromSnapshot(net map[uuid.UUID]float64, pairs []PairBalance) *Ledger {
+	l := New()
+	for userID, amount := range net {
+		l.net[userID] = amount
+	}
+	for _, pair := range pairs {
+		key, sign := keyFor(pair.DebtorID, pair.CreditorID)
+		l.pairs[key] += sign * pair.Amount
+	}
+	return l
+}
+
+// Shares returns what each distinct member owes for an expense. Expenses
+// without members have nobody to split between and yield nil.
+func Shares(e Expense) map[uuid.UUID]float64 {
+	distinct := make(map[uuid.UUID]bool, len(e.Members))
+	for _, member := range e.Members {
+		distinct[member] = true
+	}
+	if len(distinct) == 0 {
+		return nil
+	}
+
+	share := e.Amount / float64(len(distinct))
+	shares := make(map[uuid.UUID]float64, len(distinct))
+	for member := range distinct {
+		shares[member] = share
+	}
+	return shares
+}
+
+// AddExpense records an expense and reports whether it affected anyone.
+func (l *Ledger) AddExpense(e Expense) bool {
+	shares := Shares(e)
+	if shares == nil {
+		return false
+	}
+
+	l.net[e.PayerID] += e.Amount
+	for member, share := range shares {
+		l.net[member] -= share
+		if member != e.PayerID {
+			l.owe(member, e.PayerID, share, KindExpense, e.ID)
+		}
+	}
+	return true
+}
+
+// AddSettlement records money handed from FromID to ToID.
+func (l *Ledger) AddSettlement(s Settlement) {
+	if s.FromID == s.ToID {
+		return
+	}
+	l.net[s.FromID] += s.Amount
+	l.net[s.ToID] -= s.Amount
+	l.owe(s.FromID, s.ToID, -s.Amount, KindSettlement, s.ID)
+}
+
+func (l *Ledger) owe(debtor, creditor uuid.UUID, amount float64, kind string, id uuid.UUID) {
+	key, sign := keyFor(debtor, creditor)
+	l.pairs[key] += sign * amount
+	l.sources[key] = append(l.sources[key], Contribution{Kind: kind, ID: id, Amount: sign * amount})
+}
+
+// Balance is a member's net position, rounded to cents.
+func (l *Ledger) Balance(userID uuid.UUID) float64 {
+	return Round(l.net[userID])
+}
+
+// Balances returns every member's net position, rounded to cents.
+func (l *Ledger) Balances() map[uuid.UUID]float64 {
+	balances := make(map[uuid.UUID]float64, len(l.net))
+	for userID, amount := range l.net {
+		balances[userID] = Round(amount)
+	}
+	return balances
+}
+
+// Owes returns how much debtor owes creditor between the two of them; a
+// negative result means creditor owes debtor.
+func (l *Ledger) Owes(debtor, creditor uuid.UUID) float64 {
+	key, sign := keyFor(debtor, creditor)
+	return Round(sign * l.pairs[key])
+}
+
+// Contributions lists the records behind Owes(debtor, creditor), in the
+// order they were added, with amounts signed from the debtor's side.
+func (l *Ledger) Contributions(debtor, creditor uuid.UUID) []Contribution {
+	key, sign := keyFor(debtor, creditor)
+	contributions := make([]Contribution, 0, len(l.sources[key]))
+	for _, c := range l.sources[key] {
+		c.Amount = Round(sign * c.Amount)
+		contributions = append(contributions, c)
+	}
+	return contributions
+}
+
+// Members lists everyone the ledger has seen.
+func (l *Ledger) Members() []uuid.UUID {
+	members := make([]uuid.UUID, 0, len(l.net))
+	for userID := range l.net {
+		members = append(members, userID)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].String() < members[j].String()
+	})
+	return members
+}
+
+// Pairs lists every pair of members with money outstanding between them,
+// largest debt first.
+func (l *Ledger) Pairs() []PairBalance {
+	pairs := make([]PairBalance, 0, len(l.pairs))
+	for key, amount := range l.pairs {
+		switch {
+		case amount >= epsilon:
+			pairs = append(pairs, PairBalance{DebtorID: key.A, CreditorID: key.B, Amount: Round(amount)})
+		case amount <= -epsilon:
+			pairs = append(pairs, PairBalance{DebtorID: key.B, CreditorID: key.A, Amount: Round(-amount)})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].Amount != pairs[j].Amount {
+			return pairs[i].Amount > pairs[j].Amount
+		}
+		if pairs[i].DebtorID != pairs[j].DebtorID {
+			return pairs[i].DebtorID.String() < pairs[j].DebtorID.String()
+		}
+		return pairs[i].CreditorID.String() < pairs[j].CreditorID.String()
+	})
+	return pairs
+}
+
+// Round rounds an amount to cents.
+func Round(amount float64) float64 {
+	rounded := math.Round(amount*100) / 100
+	if rounded == 0 {
+		// Avoid reporting -0
+		return 0
+	}
+	return rounded
+}
@@ -0,0 +1,190 @@
+package ledger
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+var (
+	alice = uuid.MustParse("00000000-0000-0000-0000-00000000000a")
+	bob   = uuid.MustParse("00000000-0000-0000-0000-00000000000b")
+	carol = uuid.MustParse("00000000-0000-0000-0000-00000000000c")
+)
+
+func assertBalances(t *testing.T, l *Ledger, want map[uuid.UUID]float64) {
+	t.Helper()
+	for userID, amount := range l.Balances() {
+		if want[userID] != amount {
+			t.Errorf("balance of %s = %v, want %v", userID, amount, want[userID])
+		}
+	}
+	for userID, amount := range want {
+		if got := l.Balance(userID); got != amount {
+			t.Errorf("balance of %s = %v, want %v", userID, got, amount)
+		}
+	}
+	var sum float64
+	for _, amount := range l.net {
+		sum += amount
+	}
+	if Round(sum) != 0 {
+		t.Errorf("balances sum to %v, want 0", sum)
+	}
+}
+
+func TestExpenseSplitsEquallyBetweenMembers(t *testing.T) {
+	l := New()
+	l.AddExpense(Expense{PayerID: alice, Amount: 90, Members: []uuid.UUID{alice, bob, carol}})
+
+	assertBalances(t, l, map[uuid.UUID]float64{alice: 60, bob: -30, carol: -30})
+	if got := l.Owes(bob, alice); got != 30 {
+		t.Errorf("bob owes alice %v, want 30", got)
+	}
+	if got := l.Owes(alice, bob); got != -30 {
+		t.Errorf("alice owes bob %v, want -30", got)
+	}
+	if got := l.Owes(bob, carol); got != 0 {
+		t.Errorf("bob owes carol %v, want 0", got)
+	}
+}
+
+func TestPayerOutsideMembersIsOwedEverything(t *testing.T) {
+	l := New()
+	l.AddExpense(Expense{PayerID: alice, Amount: 50, Members: []uuid.UUID{bob, carol}})
+
+	assertBalances(t, l, map[uuid.UUID]float64{alice: 50, bob: -25, carol: -25})
+}
+
+func TestExpenseWithoutMembersIsIgnored(t *testing.T) {
+	l := New()
+	if l.AddExpense(Expense{PayerID: alice, Amount: 50}) {
+		t.Fatal("expense without members reported as applied")
+	}
+	assertBalances(t, l, map[uuid.UUID]float64{})
+	if len(l.Pairs()) != 0 {
+		t.Errorf("pairs = %v, want none", l.Pairs())
+	}
+}
+
+func TestDuplicateMembersCountOnce(t *testing.T) {
+	l := New()
+	l.AddExpense(Expense{PayerID: alice, Amount: 40, Members: []uuid.UUID{alice, bob, bob}})
+
+	assertBalances(t, l, map[uuid.UUID]float64{alice: 20, bob: -20})
+}
+
+func TestSettlementPaysDownDebt(t *testing.T) {
+	l := New()
+	l.AddExpense(Expense{PayerID: alice, Amount: 90, Members: []uuid.UUID{alice, bob, carol}})
+	l.AddSettlement(Settlement{FromID: bob, ToID: alice, Amount: 30})
+
+	assertBalances(t, l, map[uuid.UUID]float64{alice: 30, bob: 0, carol: -30})
+	if got := l.Owes(bob, alice); got != 0 {
+		t.Errorf("bob owes alice %v after settling, want 0", got)
+	}
+	pairs := l.Pairs()
+	if len(pairs) != 1 || pairs[0] != (PairBalance{DebtorID: carol, CreditorID: alice, Amount: 30}) {
+		t.Errorf("pairs = %+v, want only carol owing alice 30", pairs)
+	}
+}
+
+func TestOverpaymentReversesDebt(t *testing.T) {
+	l := New()
+	l.AddExpense(Expense{PayerID: alice, Amount: 20, Members: []uuid.UUID{alice, bob}})
+	l.AddSettlement(Settlement{FromID: bob, ToID: alice, Amount: 25})
+
+	assertBalances(t, l, map[uuid.UUID]float64{alice: -15, bob: 15})
+	if got := l.Owes(alice, bob); got != 15 {
+		t.Errorf("alice owes bob %v, want 15", got)
+	}
+}
+
+func TestPairsNetExpensesInBothDirections(t *testing.T) {
+	l := New()
+	l.AddExpense(Expense{PayerID: alice, Amount: 100, Members: []uuid.UUID{alice, bob}})
+	l.AddExpense(Expense{PayerID: bob, Amount: 60, Members: []uuid.UUID{alice, bob}})
+
+	assertBalances(t, l, map[uuid.UUID]float64{alice: 20, bob: -20})
+	pairs := l.Pairs()
+	if len(pairs) != 1 || pairs[0] != (PairBalance{DebtorID: bob, CreditorID: alice, Amount: 20}) {
+		t.Errorf("pairs = %+v, want bob owing alice 20", pairs)
+	}
+}
+
+func TestSettlementToSelfIsIgnored(t *testing.T) {
+	l := New()
+	l.AddSettlement(Settlement{FromID: alice, ToID: alice, Amount: 10})
+	assertBalances(t, l, map[uuid.UUID]float64{})
+}
+
+func TestBalancesRoundToCents(t *testing.T) {
+	l := New()
+	l.AddExpense(Expense{PayerID: alice, Amount: 100, Members: []uuid.UUID{alice, bob, carol}})
+
+	assertBalances(t, l, map[uuid.UUID]float64{alice: 66.67, bob: -33.33, carol: -33.33})
+}
+
+func TestContributionsExplainPairBalance(t *testing.T) {
+	dinner := uuid.MustParse("00000000-0000-0000-0000-000000000101")
+	taxi := uuid.MustParse("00000000-0000-0000-0000-000000000102")
+	payback := uuid.MustParse("00000000-0000-0000-0000-000000000201")
+
+	l := New()
+	l.AddExpense(Expense{ID: dinner, PayerID: alice, Amount: 60, Members: []uuid.UUID{alice, bob}})
+	l.AddExpense(Expense{ID: taxi, PayerID: bob, Amount: 20, Members: []uuid.UUID{alice, bob}})
+	l.AddSettlement(Settlement{ID: payback, FromID: bob, ToID: alice, Amount: 5})
+
+	want := []Contribution{
+		{Kind: KindExpense, ID: dinner, Amount: 30},
+		{Kind: KindExpense, ID: taxi, Amount: -10},
+		{Kind: KindSettlement, ID: payback, Amount: -5},
+	}
+	got := l.Contributions(bob, alice)
+	if len(got) != len(want) {
+		t.Fatalf("contributions = %+v, want %+v", got, want)
+	}
+	var total float64
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("contribution %d = %+v, want %+v", i, got[i], want[i])
+		}
+		total += got[i].Amount
+	}
+	if total != l.Owes(bob, alice) {
+		t.Errorf("contributions add up to %v, but bob owes alice %v", total, l.Owes(bob, alice))
+	}
+
+	// Seen from the other side, every contribution flips sign
+	for i, c := range l.Contributions(alice, bob) {
+		if c.Amount != -want[i].Amount {
+			t.Errorf("reverse contribution %d = %v, want %v", i, c.Amount, -want[i].Amount)
+		}
+	}
+}
+
+func TestFromSnapshotMatchesReplay(t *testing.T) {
+	replayed := New()
+	replayed.AddExpense(Expense{PayerID: alice, Amount: 90, Members: []uuid.UUID{alice, bob, carol}})
+	replayed.AddSettlement(Settlement{FromID: bob, ToID: alice, Amount: 10})
+
+	// Pairs may be stored from either side
+	l := FromSnapshot(
+		map[uuid.UUID]float64{alice: 50, bob: -20, carol: -30},
+		[]PairBalance{
+			{DebtorID: bob, CreditorID: alice, Amount: 20},
+			{DebtorID: alice, CreditorID: carol, Amount: -30},
+		},
+	)
+
+	assertBalances(t, l, replayed.Balances())
+	got, want := l.Pairs(), replayed.Pairs()
+	if len(got) != len(want) {
+		t.Fatalf("pairs = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("pair %d = %v, want %v", i, got[i], want[i])
+		}
+	}
+}
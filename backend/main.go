@@ -6,7 +6,11 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
 	"time"
+	// Timezones for /trends even where the host has no zoneinfo
+	_ "time/tzdata"
 
 	"cloud.google.com/go/storage"
 	"github.com/gorilla/mux"
@@ -38,6 +42,20 @@ func initStorage() *storage.Client {
 	return storageClient
 }
 
+// envDays reads a whole number of days from the environment. Zero is only
+// accepted where it switches the feature off.
+func envDays(name string, fallback int, allowZero bool) time.Duration {
+	days := fallback
+	if value := os.Getenv(name); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && (parsed > 0 || parsed == 0 && allowZero) {
+			days = parsed
+		} else {
+			log.Printf("Ignoring invalid %s=%q", name, value)
+		}
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
 // Extract ID token from the request body
 func getIDTokenFromBody(r *http.Request) (string, error) {
 	var data map[string]string
@@ -123,6 +141,27 @@ func verifySessionMiddleware(client *auth.Client, next http.HandlerFunc) http.Ha
 	}
 }
 
+// identifySessionMiddleware attaches the session user to the context when
+// the request has a valid session cookie, but lets anonymous requests through
+func identifySessionMiddleware(client *auth.Client, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie("session")
+		if err != nil || cookie == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		decodedToken, err := client.VerifySessionCookieAndCheckRevoked(r.Context(), cookie.Value)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "user", decodedToken)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+}
+
 func main() {
 	client, err := initFirebase()
 	if err != nil {
@@ -142,15 +181,45 @@ func main() {
 	// Initialize repositories and controllers
 	transactionRepo := db.NewTransactionRepository(dbPool)
 	wsServer := handlers.NewWebSocketServer(transactionRepo)
+	handlers.Realtime = wsServer
 	transactionController := handlers.NewTransactionController(transactionRepo, wsServer)
 
 	// Start WebSocket server
 	go wsServer.Run()
 
-	// Define routes
-	transactionController.Routes()
+	// Remind recievers about payments they haven't confirmed
+	go handlers.RunPaymentReminders(context.Background(), envDays("PAYMENT_REMINDER_DAYS", 3, false), time.Hour)
+
+	// Purge soft-deleted records once they have been in the trash long
+	// enough; TRASH_RETENTION_DAYS=0 keeps them forever
+	handlers.TrashRetention = envDays("TRASH_RETENTION_DAYS", 30, true)
+	if handlers.TrashRetention > 0 {
+		log.Printf("Purging trash older than %v", handlers.TrashRetention)
+	} else {
+		log.Println("Trash purge disabled")
+	}
+	go handlers.RunTrashPurge(context.Background(), handlers.TrashRetention, time.Hour)
+
+	// Keep responses to Idempotency-Key requests around for client retries
+	handlers.IdempotencyRetention = envDays("IDEMPOTENCY_RETENTION_DAYS", 1, false)
+	go handlers.RunIdempotencyKeyPurge(context.Background(), handlers.IdempotencyRetention, time.Hour)
+
+	// Keep the event log long enough for clients to resume after a while away
+	handlers.EventRetention = envDays("EVENT_RETENTION_DAYS", 7, false)
+	go handlers.RunEventPurge(context.Background(), handlers.EventRetention, time.Hour)
 
 	r := mux.NewRouter()
+	requireSession := func(next http.HandlerFunc) http.HandlerFunc {
+		return verifySessionMiddleware(client, next)
+	}
+	// Routes open to anonymous callers still credit signed-in users in the audit log
+	identify := func(next http.HandlerFunc) http.HandlerFunc {
+		return identifySessionMiddleware(client, next)
+	}
+
+	// Define routes. Reads that involve dates identify the caller so their
+	// timezone and locale apply.
+	transactionController.Routes(r, requireSession)
 	r.HandleFunc("/sessionLogin", createSessionHandler(client)).Methods("POST")
 	r.HandleFunc("/profile", verifySessionMiddleware(client, func(w http.ResponseWriter, r *http.Request) {
 	user, err := getLoggedInUser(r)
@@ -167,25 +236,65 @@ func main() {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 })).Methods("GET")
-	r.HandleFunc("/users", handlers.AddUser).Methods("POST")
+	r.HandleFunc("/users", identify(handlers.AddUser)).Methods("POST")
 	r.HandleFunc("/users", handlers.GetUsers).Methods("GET")
 	r.HandleFunc("/users/{id}", handlers.GetUserByID).Methods("GET")
-	r.HandleFunc("/users/{id}", handlers.DeleteUser).Methods("DELETE")
-	r.HandleFunc("/transactions", handlers.GetTransactions).Methods("GET")
+	r.HandleFunc("/preferences", requireSession(handlers.GetPreferences)).Methods("GET")
+	r.HandleFunc("/preferences", requireSession(handlers.UpdatePreferences)).Methods("PATCH")
+	r.HandleFunc("/users/{id}", identify(handlers.DeleteUser)).Methods("DELETE")
+	r.HandleFunc("/users/{id}/statement", identify(handlers.GetUserStatement)).Methods("GET")
+	r.HandleFunc("/transactions", identify(handlers.GetTransactions)).Methods("GET")
 	r.HandleFunc("/transactions/{id}", handlers.GetTransactionByID).Methods("GET")
-	r.HandleFunc("/transactions", verifySessionMiddleware(client, handlers.AddTransaction)).Methods("POST")
+	r.HandleFunc("/transactions", verifySessionMiddleware(client, handlers.Idempotent(handlers.AddTransaction))).Methods("POST")
 	r.HandleFunc("/transactions/{id}", verifySessionMiddleware(client, handlers.EditTransaction)).Methods("PUT")
-	r.HandleFunc("/transactions/{id}", handlers.DeleteTransaction).Methods("DELETE")
-	r.HandleFunc("/transactions/{id}/soft-delete", handlers.SoftDeleteTransaction).Methods("DELETE")
-	r.HandleFunc("/summary", handlers.GenerateSummary).Methods("GET")
-	r.HandleFunc("/payments", handlers.GetPayments).Methods("GET")
+	r.HandleFunc("/transactions/{id}", identify(handlers.DeleteTransaction)).Methods("DELETE")
+	r.HandleFunc("/transactions/{id}/soft-delete", identify(handlers.SoftDeleteTransaction)).Methods("DELETE")
+	r.HandleFunc("/transactions/{id}/confirmations", handlers.GetTransactionConfirmations).Methods("GET")
+	r.HandleFunc("/transactions/{id}/history", handlers.GetTransactionHistory).Methods("GET")
+	r.HandleFunc("/transactions/{id}/restore", requireSession(handlers.RestoreTransaction)).Methods("POST")
+	r.HandleFunc("/transactions/{id}/confirm", requireSession(handlers.ConfirmTransaction)).Methods("POST")
+	r.HandleFunc("/transactions/{id}/dispute", requireSession(handlers.DisputeTransaction)).Methods("POST")
+	r.HandleFunc("/transactions/{id}/reject", requireSession(handlers.RejectTransaction)).Methods("POST")
+	r.HandleFunc("/summary", identify(handlers.GenerateSummary)).Methods("GET")
+	r.HandleFunc("/trends", identify(handlers.GetTrends)).Methods("GET")
+	r.HandleFunc("/balances", identify(handlers.GetBalances)).Methods("GET")
+	r.HandleFunc("/balances/matrix", identify(handlers.GetBalanceMatrix)).Methods("GET")
+	r.HandleFunc("/payments", identify(handlers.GetPayments)).Methods("GET")
 	r.HandleFunc("/payments/{id}", handlers.GetPaymentByID).Methods("GET")
-	r.HandleFunc("/payments", handlers.AddPayment).Methods("POST")
-	r.HandleFunc("/payments/{id}", handlers.DeletePayment).Methods("DELETE")
-	r.HandleFunc("/payments/{id}/soft-delete", handlers.SoftDeletePayment).Methods("DELETE")
+	r.HandleFunc("/payments", identify(handlers.Idempotent(handlers.AddPayment))).Methods("POST")
+	r.HandleFunc("/payments/{id}", requireSession(handlers.EditPayment)).Methods("PUT")
+	r.HandleFunc("/payments/{id}", identify(handlers.DeletePayment)).Methods("DELETE")
+	r.HandleFunc("/payments/{id}/soft-delete", identify(handlers.SoftDeletePayment)).Methods("DELETE")
+	r.HandleFunc("/payments/{id}/restore", requireSession(handlers.RestorePayment)).Methods("POST")
+	r.HandleFunc("/trash", requireSession(handlers.GetTrash)).Methods("GET")
+	r.HandleFunc("/search", requireSession(handlers.Search)).Methods("GET")
+	r.HandleFunc("/tags", handlers.GetTags).Methods("GET")
+	r.HandleFunc("/views", requireSession(handlers.GetSavedViews)).Methods("GET")
+	r.HandleFunc("/views", requireSession(handlers.CreateSavedView)).Methods("POST")
+	r.HandleFunc("/views/{id}", requireSession(handlers.UpdateSavedView)).Methods("PATCH")
+	r.HandleFunc("/views/{id}", requireSession(handlers.DeleteSavedView)).Methods("DELETE")
+	r.HandleFunc("/views/{id}/run", requireSession(handlers.RunSavedView)).Methods("GET")
+	r.HandleFunc("/transactions/{id}/tags", handlers.GetTransactionTags).Methods("GET")
+	r.HandleFunc("/transactions/{id}/tags", requireSession(handlers.AddTransactionTags)).Methods("POST")
+	r.HandleFunc("/transactions/{id}/tags/{tag}", requireSession(handlers.RemoveTransactionTag)).Methods("DELETE")
+	r.HandleFunc("/payments/{id}/tags", handlers.GetPaymentTags).Methods("GET")
+	r.HandleFunc("/payments/{id}/tags", requireSession(handlers.AddPaymentTags)).Methods("POST")
+	r.HandleFunc("/payments/{id}/tags/{tag}", requireSession(handlers.RemovePaymentTag)).Methods("DELETE")
+	r.HandleFunc("/batch", requireSession(handlers.Idempotent(handlers.BatchOperations))).Methods("POST")
+	r.HandleFunc("/payments/{id}/confirm", requireSession(handlers.ConfirmPayment)).Methods("POST")
+	r.HandleFunc("/payments/{id}/reject", requireSession(handlers.RejectPayment)).Methods("POST")
 	r.HandleFunc("/payment-summary", handlers.GeneratePaymentSummary).Methods("GET")
+	r.HandleFunc("/payment-requests", requireSession(handlers.GetPaymentRequests)).Methods("GET")
+	r.HandleFunc("/payment-requests", requireSession(handlers.CreatePaymentRequest)).Methods("POST")
+	r.HandleFunc("/payment-requests/{id}", requireSession(handlers.GetPaymentRequestByID)).Methods("GET")
+	r.HandleFunc("/payment-requests/{id}/accept", requireSession(handlers.AcceptPaymentRequest)).Methods("POST")
+	r.HandleFunc("/payment-requests/{id}/decline", requireSession(handlers.DeclinePaymentRequest)).Methods("POST")
+	r.HandleFunc("/payment-requests/{id}/cancel", requireSession(handlers.CancelPaymentRequest)).Methods("POST")
+	r.HandleFunc("/periods", handlers.GetClosedPeriods).Methods("GET")
+	r.HandleFunc("/periods", requireSession(handlers.ClosePeriod)).Methods("POST")
+	r.HandleFunc("/periods/{id}/reopen", requireSession(handlers.ReopenPeriod)).Methods("POST")
 	h := handlers.NewHandler(dbPool, storageClient, "FIREBASE_BUCKET")
-	h.SetupRoutes(r)
+	h.SetupRoutes(r, identify)
 
 	log.Println("Server running on :8080")
 	log.Fatal(http.ListenAndServe(":8080", r))
@@ -0,0 +1,81 @@
+package report
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Locale says how amounts and dates are written in a report. The zero
+// Locale writes plain 1234.50 and 2006-01-02, which is what every report
+// used before locales existed.
+type Locale struct {
+	Tag     string
+	Decimal string
+	Group   string
+	// Lakh groups digits above the thousands in twos, as in 12,34,567.89
+	Lakh       bool
+	DateLayout string
+}
+
+// locales are the locales reports can be written in, by BCP 47 tag. Group
+// separators stay within Latin-1 so the PDF font can show them.
+var locales = map[string]Locale{
+	"en-US": {Tag: "en-US", Decimal: ".", Group: ",", DateLayout: "01/02/2006"},
+	"en-GB": {Tag: "en-GB", Decimal: ".", Group: ",", DateLayout: "02/01/2006"},
+	"en-IN": {Tag: "en-IN", Decimal: ".", Group: ",", Lakh: true, DateLayout: "02/01/2006"},
+	"hi-IN": {Tag: "hi-IN", Decimal: ".", Group: ",", Lakh: true, DateLayout: "02-01-2006"},
+	"de-DE": {Tag: "de-DE", Decimal: ",", Group: ".", DateLayout: "02.01.2006"},
+	"fr-FR": {Tag: "fr-FR", Decimal: ",", Group: " ", DateLayout: "02/01/2006"},
+	"es-ES": {Tag: "es-ES", Decimal: ",", Group: ".", DateLayout: "02/01/2006"},
+}
+
+// LookupLocale finds a locale by tag, ignoring case and accepting _ for -.
+// The empty tag is the zero Locale.
+func LookupLocale(tag string) (Locale, bool) {
+	if tag == "" {
+		return Locale{}, true
+	}
+	tag = strings.ReplaceAll(tag, "_", "-")
+	for name, locale := range locales {
+		if strings.EqualFold(name, tag) {
+			return locale, true
+		}
+	}
+	return Locale{}, false
+}
+
+// Amount writes an amount with two decimals.
+func (l Locale) Amount(amount float64) string {
+	plain := strconv.FormatFloat(amount, 'f', 2, 64)
+	if l.Tag == "" {
+		return plain
+	}
+
+	sign := ""
+	if strings.HasPrefix(plain, "-") {
+		sign, plain = "-", plain[1:]
+	}
+	whole, cents, _ := strings.Cut(plain, ".")
+
+	// Split off the last three digits, then groups of two (lakh) or three
+	var groups []string
+	size := 3
+	for len(whole) > size {
+		groups = append([]string{whole[len(whole)-size:]}, groups...)
+		whole = whole[:len(whole)-size]
+		if l.Lakh {
+			size = 2
+		}
+	}
+	groups = append([]string{whole}, groups...)
+	return sign + strings.Join(groups, l.Group) + l.Decimal + cents
+}
+
+// Date writes the calendar date of t, in t's location.
+func (l Locale) Date(t time.Time) string {
+	if l.DateLayout == "" {
+		return t.Format("2006-01-02")
+	}
+	return t.Format(l.DateLayout)
+}
@@ -0,0 +1,51 @@
+package report
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLocaleAmount(t *testing.T) {
+	for _, tc := range []struct {
+		tag    string
+		amount float64
+		want   string
+	}{
+		{"", 1234567.5, "1234567.50"},
+		{"en-US", 1234567.5, "1,234,567.50"},
+		{"en-US", -999.999, "-1,000.00"},
+		{"en-US", 12, "12.00"},
+		{"en-IN", 1234567.89, "12,34,567.89"},
+		{"en-IN", 123456, "1,23,456.00"},
+		{"en-IN", 999, "999.00"},
+		{"de-DE", -1234.5, "-1.234,50"},
+		{"fr-FR", 1234.5, "1 234,50"},
+	} {
+		locale, ok := LookupLocale(tc.tag)
+		if !ok {
+			t.Fatalf("locale %q not found", tc.tag)
+		}
+		if got := locale.Amount(tc.amount); got != tc.want {
+			t.Errorf("%s: Amount(%v) = %q, want %q", tc.tag, tc.amount, got, tc.want)
+		}
+	}
+}
+
+func TestLocaleDate(t *testing.T) {
+	date := time.Date(2024, 3, 9, 23, 30, 0, 0, time.UTC)
+	for tag, want := range map[string]string{"": "2024-03-09", "en-US": "03/09/2024", "en-IN": "09/03/2024", "de-DE": "09.03.2024"} {
+		locale, _ := LookupLocale(tag)
+		if got := locale.Date(date); got != want {
+			t.Errorf("%s: Date = %q, want %q", tag, got, want)
+		}
+	}
+}
+
+func TestLookupLocaleIsLenient(t *testing.T) {
+	if locale, ok := LookupLocale("en_in"); !ok || locale.Tag != "en-IN" {
+		t.Errorf("LookupLocale(en_in) = %v, %v", locale, ok)
+	}
+	if _, ok := LookupLocale("xx-XX"); ok {
+		t.Error("LookupLocale(xx-XX) found a locale")
+	}
+}
@@ -0,0 +1,85 @@
+package report
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestWritePDFStructure(t *testing.T) {
+	for _, tc := range []struct {
+		lines int
+		pages int
+	}{
+		{0, 1},
+		{3, 1},
+		{linesPerPage, 1},
+		{linesPerPage + 1, 2},
+		{3*linesPerPage + 5, 4},
+	} {
+		lines := make([]string, tc.lines)
+		for i := range lines {
+			lines[i] = fmt.Sprintf("line %d (with parens) and café", i)
+		}
+		var buf bytes.Buffer
+		if err := WritePDF(&buf, "Statement for (ann)", lines); err != nil {
+			t.Fatal(err)
+		}
+		doc := buf.Bytes()
+		name := fmt.Sprintf("%d lines", tc.lines)
+
+		if !bytes.HasPrefix(doc, []byte("%PDF-1.4\n")) || !bytes.HasSuffix(doc, []byte("%%EOF\n")) {
+			t.Fatalf("%s: missing header or trailer", name)
+		}
+
+		// Catalog, page tree and font, two objects per page, then the info
+		objects := 3 + 2*tc.pages + 1
+		if got := len(regexp.MustCompile(`(?m)^\d+ 0 obj$`).FindAll(doc, -1)); got != objects {
+			t.Errorf("%s: %d objects, want %d", name, got, objects)
+		}
+		if got := bytes.Count(doc, []byte("/Type /Page ")); got != tc.pages {
+			t.Errorf("%s: %d pages, want %d", name, got, tc.pages)
+		}
+
+		m := regexp.MustCompile(`startxref\n(\d+)\n%%EOF\n$`).FindSubmatch(doc)
+		if m == nil {
+			t.Fatalf("%s: no startxref", name)
+		}
+		xref, _ := strconv.Atoi(string(m[1]))
+		if !bytes.HasPrefix(doc[xref:], []byte(fmt.Sprintf("xref\n0 %d\n0000000000 65535 f \n", objects+1))) {
+			t.Fatalf("%s: startxref %d does not point at an xref table for %d objects", name, xref, objects)
+		}
+
+		// Every entry is 20 bytes and points at the start of its object
+		entries := doc[xref+len(fmt.Sprintf("xref\n0 %d\n", objects+1))+20:]
+		for i := 1; i <= objects; i++ {
+			entry := string(entries[(i-1)*20 : i*20])
+			if !strings.HasSuffix(entry, " 00000 n \n") {
+				t.Fatalf("%s: malformed xref entry %d: %q", name, i, entry)
+			}
+			offset, _ := strconv.Atoi(entry[:10])
+			if !bytes.HasPrefix(doc[offset:], []byte(fmt.Sprintf("%d 0 obj\n", i))) {
+				t.Errorf("%s: xref entry %d points at %q", name, i, doc[offset:offset+10])
+			}
+		}
+
+		trailer := fmt.Sprintf("trailer\n<< /Size %d /Root 1 0 R /Info %d 0 R >>\n", objects+1, objects)
+		if !bytes.Contains(doc, []byte(trailer)) {
+			t.Errorf("%s: trailer is not %q", name, trailer)
+		}
+		info := fmt.Sprintf("%d 0 obj\n<< /Title (Statement for \\(ann\\)) >>\nendobj\n", objects)
+		if !bytes.Contains(doc, []byte(info)) {
+			t.Errorf("%s: info object is not %q", name, info)
+		}
+
+		// Stream lengths match what is between stream and endstream
+		for _, s := range regexp.MustCompile(`(?s)<< /Length (\d+) >>\nstream\n(.*?)endstream`).FindAllSubmatch(doc, -1) {
+			if length, _ := strconv.Atoi(string(s[1])); length != len(s[2]) {
+				t.Errorf("%s: stream /Length %d, actual %d", name, length, len(s[2]))
+			}
+		}
+	}
+}
@@ -61,8 +61,17 @@ function ExpenseTracker( {currentUser} ) {
   const fetchUsers = async () => {
     setLoading(true);
     try {
-      const data = await apiRequest(`${API_BASE_URL}/users`);
-      setUsers(data || []);
+      // Users come a page at a time; follow next_cursor to get them all
+      const allUsers = [];
+      let cursor = null;
+      do {
+        const params = new URLSearchParams({ limit: "100" });
+        if (cursor) params.set("after", cursor);
+        const data = await apiRequest(`${API_BASE_URL}/users?${params}`);
+        allUsers.push(...(data?.users || []));
+        cursor = data?.next_cursor;
+      } while (cursor);
+      setUsers(allUsers);
     } catch (err) {
       setError(`Failed to fetch users: ${err.message}`);
     } finally {
@@ -167,7 +176,11 @@ function ExpenseTracker( {currentUser} ) {
     try {
       const data = await apiRequest(`${API_BASE_URL}/transactions`, {
         method: "POST",
-        headers: { "Content-Type": "application/json" },
+        headers: {
+          "Content-Type": "application/json",
+          // Lets the server drop duplicates if the request is retried
+          "Idempotency-Key": crypto.randomUUID(),
+        },
         body: JSON.stringify({
           payer_id: newTransaction.payerId,
           amount,
@@ -200,7 +213,11 @@ const handleAddPayment = async (e) => {
     try {
       const data = await apiRequest(`${API_BASE_URL}/payments`, {
         method: "POST",
-        headers: { "Content-Type": "application/json" },
+        headers: {
+          "Content-Type": "application/json",
+          // Lets the server drop duplicates if the request is retried
+          "Idempotency-Key": crypto.randomUUID(),
+        },
         body: JSON.stringify({
           payer_id: newPayment.payerId,
           amount,
@@ -15,7 +15,7 @@ const UpdatesTab = ({ currentUser }) => {
     try {
       const response = await fetch('/api/stories');
       const data = await response.json();
-      setStories(data);
+      setStories(data.stories || []);
     } catch (error) {
       console.error('Error fetching stories:', error);
     }
@@ -33,6 +33,7 @@ const UpdatesTab = ({ currentUser }) => {
       try {
         const response = await fetch('/api/stories', {
           method: 'POST',
+          headers: { 'Idempotency-Key': crypto.randomUUID() },
           body: formData,
         });
         if (response.ok) {